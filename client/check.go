@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"nemu-client/ignore"
+	"nemu-client/report"
+	"nemu-client/validate"
+	"os"
+	"path/filepath"
+)
+
+// 站点校验模式
+const (
+	validateOff   = "off"   // 不校验
+	validateWarn  = "warn"  // 输出问题, 继续部署
+	validateError = "error" // 有问题时中止部署
+)
+
+// validateOptions 站点校验参数, deploy 与 validate 共用
+type validateOptions struct {
+	mode        string
+	maxFileSize int
+	baseURL     string
+}
+
+// register 注册校验规则的参数; 校验模式只对 deploy 有意义, 由 registerMode 注册
+func (o *validateOptions) register(fs *flag.FlagSet) {
+	fs.IntVar(&o.maxFileSize, "max-file-size", 20, "单个文件的大小上限(MB), 0 为不检查")
+	fs.StringVar(&o.baseURL, "base-url", "", "站点地址, 指向它的绝对链接按站内链接检查")
+}
+
+// registerMode 注册 deploy 的 --validate, 默认不校验
+func (o *validateOptions) registerMode(fs *flag.FlagSet) {
+	fs.StringVar(&o.mode, "validate", validateOff, "部署前校验站点 off / warn / error (error 时有问题即中止)")
+}
+
+// enabled 校验模式是否有效且需要校验, 模式无效时以 ExitUsage 退出
+func (o *validateOptions) enabled() bool {
+	switch o.mode {
+	case validateOff, "":
+		return false
+	case validateWarn, validateError:
+		return true
+	default:
+		r.Fail(report.ExitUsage, "校验模式无效", fmt.Errorf("unsupported validate mode: %s (off, warn, error)", o.mode))
+		return false
+	}
+}
+
+// run 校验 pubdir 并输出结果
+func (o *validateOptions) run(pubdir string, matcher *ignore.Matcher) (*validate.Report, error) {
+	result, err := validate.Run(validate.Options{
+		Root:        pubdir,
+		Ignore:      matcher,
+		MaxFileSize: int64(o.maxFileSize) << 20,
+		BaseURL:     o.baseURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r.Event("validation", map[string]any{
+		"mode":   o.mode,
+		"files":  result.Files,
+		"links":  result.Links,
+		"issues": result.Issues,
+	})
+	if !r.JSON() {
+		for _, issue := range result.Issues {
+			fmt.Fprintln(os.Stderr, issue.String())
+		}
+		if !result.OK() {
+			fmt.Fprintf(os.Stderr, "校验了 %d 个文件, %d 个站内链接, 发现 %d 个问题\n", result.Files, result.Links, len(result.Issues))
+		}
+	}
+	return result, nil
+}
+
+// check 校验 pubdir, error 模式下有问题时以 ExitValidation 退出
+// 返回是否通过, 未启用校验时直接返回 true
+func (o *validateOptions) check(pubdir string, matcher *ignore.Matcher) bool {
+	if !o.enabled() {
+		return true
+	}
+	result, err := o.run(pubdir, matcher)
+	if err != nil {
+		r.Fail(report.ExitLocal, "站点校验失败", err)
+	}
+	if !result.OK() && o.mode == validateError {
+		r.Fail(report.ExitValidation, "站点校验未通过", fmt.Errorf("%d issues found", len(result.Issues)))
+	}
+	return result.OK()
+}
+
+// runValidate nemu validate
+func runValidate(args []string) {
+	var (
+		opts   = validateOptions{mode: validateError} // 有问题时总是以 ExitValidation 退出
+		dir    string
+		build  bool
+		output string
+	)
+	fs := newFlagSet("validate", "[选项]", "检查 public 目录中失效的站内链接, 缺失的资源与过大的文件, 有问题时以退出码 9 退出")
+	opts.register(fs)
+	fs.StringVar(&dir, "dir", "public", "站点目录")
+	fs.BoolVar(&build, "render", false, "校验前先执行 hugo 渲染")
+	fs.StringVar(&output, "output", report.FormatText, "输出格式 text / json")
+	fs.Parse(args)
+
+	remote := remoteOptions{output: output}
+	r = remote.reporter()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		r.Fail(report.ExitLocal, "获取当前目录失败", err)
+	}
+	if build {
+		renderSite(cwd)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		r.Fail(report.ExitLocal, "站点目录不存在", err)
+	}
+	matcher, err := loadIgnore(cwd)
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取忽略规则失败", err)
+	}
+	if opts.check(filepath.Clean(dir), matcher) {
+		r.Println("校验通过")
+	}
+}
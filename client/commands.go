@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"nemu-client/encode"
+	"nemu-client/report"
+	"os"
+	"strings"
+	"time"
+)
+
+// runHash nemu hash
+func runHash(args []string) {
+	var (
+		password string
+		output   string
+	)
+	fs := newFlagSet("hash", "-p <password>", "把输入的密码转换为sha512, 填入服务端配置的 server.token")
+	fs.StringVar(&password, "password", "", "密码")
+	fs.StringVar(&password, "p", "", "密码")
+	fs.StringVar(&output, "output", report.FormatText, "输出格式 text / json")
+	fs.Parse(args)
+	if password == "" && fs.NArg() > 0 {
+		password = fs.Arg(0)
+	}
+
+	remote := remoteOptions{output: output}
+	r = remote.reporter()
+	printHash(password)
+}
+
+// printHash 输出密码的 sha512 并退出
+func printHash(password string) {
+	if password == "" {
+		r.Fail(report.ExitUsage, "密码不能为空", nil)
+	}
+	nemuTokenHash := sha512.Sum512([]byte(password))
+	nemuTokenHashStr := fmt.Sprintf("%x", nemuTokenHash)
+	if r.JSON() {
+		r.Event("hash", map[string]any{"hash": nemuTokenHashStr})
+	} else {
+		fmt.Println(nemuTokenHashStr)
+	}
+	os.Exit(report.ExitOK)
+}
+
+// runStatus nemu status
+func runStatus(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("status", "[选项]", "查看服务端当前的线上版本")
+	remote.register(fs)
+	fs.Parse(args)
+	r = remote.reporter()
+	cfg := remote.config(fs)
+
+	result, err := encode.Status(context.Background(), remote.httpClient(), cfg)
+	if err != nil {
+		r.Fail(uploadExitCode(err), "获取状态失败", err)
+	}
+	if r.JSON() {
+		r.Event("status", map[string]any{"release": result.Release, "releases": result.Releases})
+		return
+	}
+	fmt.Printf("服务端: %s\n", apiBase(cfg))
+	if result.Release == nil {
+		fmt.Println("尚未部署任何版本")
+		return
+	}
+	fmt.Printf("当前版本: %s\n", result.Release.ID)
+	fmt.Printf("部署时间: %s\n", result.Release.Created.Local().Format(time.DateTime))
+	fmt.Printf("文件: %d 个, %s\n", result.Release.Entries, formatBytes(result.Release.Size))
+	if rel := result.Release; rel.Commit != "" {
+		fmt.Printf("Commit: %s%s\n", rel.Commit, dirtySuffix(rel.Dirty))
+		if rel.Branch != "" {
+			fmt.Printf("分支: %s\n", rel.Branch)
+		}
+		if rel.Author != "" {
+			fmt.Printf("作者: %s\n", rel.Author)
+		}
+	}
+	if result.Release.Message != "" {
+		fmt.Printf("说明: %s\n", result.Release.Message)
+	}
+	fmt.Printf("保留版本: %d 个\n", result.Releases)
+}
+
+// runReleases nemu releases
+func runReleases(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("releases", "[选项]", "列出服务端保留的版本, * 为当前线上版本")
+	remote.register(fs)
+	fs.Parse(args)
+	r = remote.reporter()
+	cfg := remote.config(fs)
+
+	list, err := encode.Releases(context.Background(), remote.httpClient(), cfg)
+	if err != nil {
+		r.Fail(uploadExitCode(err), "获取版本列表失败", err)
+	}
+	if r.JSON() {
+		r.Event("releases", map[string]any{"releases": list})
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("尚未部署任何版本")
+		return
+	}
+	for _, rel := range list {
+		mark := " "
+		if rel.Active {
+			mark = "*"
+		}
+		fmt.Printf("%s %s  %s  %5d 个文件  %-9s  %s\n", mark, rel.ID,
+			rel.Created.Local().Format(time.DateTime), rel.Entries, formatBytes(rel.Size), releaseSummary(rel))
+	}
+}
+
+// releaseSummary 版本列表中的一行说明: 短 commit, 分支与说明的第一行
+func releaseSummary(rel encode.Release) string {
+	var parts []string
+	if rel.Commit != "" {
+		commit := rel.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		parts = append(parts, commit+dirtySuffix(rel.Dirty))
+	}
+	if rel.Branch != "" {
+		parts = append(parts, "("+rel.Branch+")")
+	}
+	if rel.Message != "" {
+		line, _, _ := strings.Cut(rel.Message, "\n")
+		parts = append(parts, line)
+	}
+	return strings.Join(parts, " ")
+}
+
+// dirtySuffix 部署时工作区有未提交的修改
+func dirtySuffix(dirty bool) string {
+	if dirty {
+		return "-dirty"
+	}
+	return ""
+}
+
+// runRollback nemu rollback [id]
+func runRollback(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("rollback", "[选项] [版本ID]", "回滚到指定版本, 未指定时回滚到当前版本的上一个版本")
+	remote.register(fs)
+	fs.Parse(args)
+	r = remote.reporter()
+	cfg := remote.config(fs)
+
+	id, err := encode.Rollback(context.Background(), remote.httpClient(), cfg, fs.Arg(0))
+	if err != nil {
+		r.Fail(uploadExitCode(err), "回滚失败", err)
+	}
+	r.Event("rollback", map[string]any{"release": id})
+	r.Println("已回滚到版本 " + id)
+}
+
+// runPreviews nemu previews
+func runPreviews(args []string) {
+	var (
+		remote remoteOptions
+		remove string
+	)
+	fs := newFlagSet("previews", "[选项]", "列出服务端未过期的预览部署, * 为需要密码的预览; 或以 --delete 删除一个预览")
+	remote.register(fs)
+	fs.StringVar(&remove, "delete", "", "删除指定名称的预览")
+	fs.Parse(args)
+	r = remote.reporter()
+	cfg := remote.config(fs)
+	client := remote.httpClient()
+
+	if remove != "" {
+		if err := encode.DeletePreview(context.Background(), client, cfg, remove); err != nil {
+			r.Fail(uploadExitCode(err), "删除预览失败", err)
+		}
+		r.Event("preview_deleted", map[string]any{"name": remove})
+		r.Println("已删除预览 " + remove)
+		return
+	}
+
+	list, err := encode.Previews(context.Background(), client, cfg)
+	if err != nil {
+		r.Fail(uploadExitCode(err), "获取预览列表失败", err)
+	}
+	if r.JSON() {
+		r.Event("previews", map[string]any{"previews": list})
+		return
+	}
+	if len(list) == 0 {
+		fmt.Println("没有预览部署")
+		return
+	}
+	for _, p := range list {
+		expires := "不过期"
+		if p.Expires != nil {
+			expires = p.Expires.Local().Format(time.DateTime) + " 过期"
+		}
+		lock := " "
+		if p.Protected {
+			lock = "*"
+		}
+		fmt.Printf("%s %-20s  %s  %5d 个文件  %-9s  %s  %s\n", lock, p.Name,
+			p.Created.Local().Format(time.DateTime), p.Entries, formatBytes(p.Size), expires, apiBase(cfg)+p.Path)
+	}
+}
+
+// apiBase 返回不含 /nemu/upload 的服务端地址
+func apiBase(cfg *encode.ClientConfig) string {
+	return normalizeHost(cfg.ServerURL, true)
+}
@@ -0,0 +1,119 @@
+package credential
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileName 凭据文件名, 位于用户配置目录下的 nemu 目录
+const FileName = "credentials.json"
+
+// Host 一个服务端的凭据
+type Host struct {
+	Token string `json:"token"` // sha512 处理后的 Token, 不保存明文密码
+}
+
+// Store nemu login 保存的凭据
+type Store struct {
+	Default string          `json:"default"` // 未指定 --host 时使用的服务端
+	Hosts   map[string]Host `json:"hosts"`   // 以服务端地址 (不含 /nemu/upload) 为键
+
+	Profiles map[string][]string `json:"profiles,omitempty"` // 目标组, 名称 -> 服务端地址列表, 用于 deploy --profile
+
+	path string
+}
+
+// DefaultPath 返回凭据文件的默认路径
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+	return filepath.Join(dir, "nemu", FileName), nil
+}
+
+// Load 读取凭据文件, 文件不存在时返回空的 Store
+func Load() (*Store, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{Hosts: make(map[string]Host), Profiles: make(map[string][]string), path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	if store.Hosts == nil {
+		store.Hosts = make(map[string]Host)
+	}
+	if store.Profiles == nil {
+		store.Profiles = make(map[string][]string)
+	}
+	return store, nil
+}
+
+// Get 返回 host 的凭据, host 为空时使用默认服务端
+func (s *Store) Get(host string) (string, Host, bool) {
+	if host == "" {
+		host = s.Default
+	}
+	cred, ok := s.Hosts[host]
+	return host, cred, ok
+}
+
+// Set 保存 host 的凭据并设为默认服务端
+func (s *Store) Set(host string, cred Host) {
+	s.Hosts[host] = cred
+	s.Default = host
+}
+
+// Delete 删除 host 的凭据
+func (s *Store) Delete(host string) bool {
+	if _, ok := s.Hosts[host]; !ok {
+		return false
+	}
+	delete(s.Hosts, host)
+	if s.Default == host {
+		s.Default = ""
+	}
+	return true
+}
+
+// DeleteProfile 删除目标组
+func (s *Store) DeleteProfile(name string) bool {
+	if _, ok := s.Profiles[name]; !ok {
+		return false
+	}
+	delete(s.Profiles, name)
+	return true
+}
+
+// Save 写回凭据文件, 仅当前用户可读写
+func (s *Store) Save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Path 返回凭据文件路径
+func (s *Store) Path() string {
+	return s.path
+}
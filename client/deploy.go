@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"nemu-client/encode"
+	"nemu-client/gitinfo"
+	"nemu-client/ignore"
+	"nemu-client/render"
+	"nemu-client/report"
+	"nemu-client/watch"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	remote   remoteOptions
+	help     bool
+	hash     bool
+	delete   bool
+	norender bool
+
+	chunked   bool
+	chunkSize int
+	retries   int
+	resume    string
+
+	excludes stringSlice
+	includes stringSlice
+	list     bool
+	dryRun   bool
+
+	compression string
+	level       int
+	threads     int
+
+	watchMode bool
+	debounce  time.Duration
+
+	checks validateOptions
+
+	message string
+	noGit   bool
+
+	serverBuild bool
+
+	profile      string
+	allOrNothing bool
+
+	previewName     string
+	previewExpires  string
+	previewPassword string
+
+	prefix string
+
+	secret  string
+	signKey string
+)
+
+// stringSlice 可重复指定的字符串参数
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func deployFlags() *flag.FlagSet {
+	// --password / -p 密码
+	// --host / -h 目标域名
+	// --help 帮助信息
+	// --hash 把输入的密码转换为sha512 (兼容旧版, 同 nemu hash)
+	// --debug 允许跳过host检查
+	// --delete / -d 删除public目录
+	// --norender 不进行渲染
+	// --chunked 使用分块上传, 失败自动重试
+	// --chunk-size 分块大小(MB)
+	// --retries 单个分块的最大重试次数
+	// --resume 恢复指定 ID 的分块上传会话
+	// --exclude 排除匹配的路径 (gitignore 语法, 可重复)
+	// --include 重新包含被排除的路径 (可重复)
+	// --list 仅列出将被上传的内容
+	// --dry-run 只预览与线上版本的差异, 不进行部署
+	// --compress 压缩格式 gzip / zstd / none
+	// --level 压缩级别 (gzip 1-9, zstd 1-22)
+	// --threads 并行压缩线程数
+	// --output 输出格式 text / json
+	// --watch 监视项目变化, 自动重新渲染并增量上传
+	// --debounce 最后一次变化后等待的时间
+	// --validate 部署前校验站点 off / warn / error
+	// --max-file-size 单个文件的大小上限(MB)
+	// --base-url 站点地址
+	// --message / -m 部署说明
+	// --no-git 不发送 git 信息
+	// --server-build 上传源码, 由服务端构建
+	// --profile 部署到目标组中的全部服务端
+	// --all-or-nothing 多目标部署时有目标失败则回滚成功的目标
+	// --preview 部署为预览, 不影响线上版本
+	// --preview-expires 预览的有效期
+	// --preview-password 预览的访问密码
+	// --prefix 只部署站点的一个子路径
+	// --secret 上传加密的共享密钥
+	// --sign-key 签名归档的私钥
+
+	fs := newFlagSet("deploy", "[选项]", "渲染站点并上传到服务端, 成为新的线上版本")
+	remote.register(fs)
+	fs.BoolVar(&help, "help", false, "帮助信息")
+	fs.BoolVar(&hash, "hash", false, "把输入的密码转换为sha512")
+	fs.BoolVar(&delete, "delete", false, "删除public目录")
+	fs.BoolVar(&norender, "norender", false, "不进行渲染")
+	fs.BoolVar(&chunked, "chunked", false, "使用分块上传, 失败自动重试")
+	fs.IntVar(&chunkSize, "chunk-size", encode.DefaultChunkSize>>20, "分块大小(MB)")
+	fs.IntVar(&retries, "retries", encode.DefaultRetries, "单个分块的最大重试次数")
+	fs.StringVar(&resume, "resume", "", "恢复指定 ID 的分块上传会话")
+	fs.Var(&excludes, "exclude", "排除匹配的路径 (gitignore 语法, 可重复)")
+	fs.Var(&includes, "include", "重新包含被排除的路径 (可重复)")
+	fs.BoolVar(&list, "list", false, "仅列出将被上传的内容")
+	fs.BoolVar(&dryRun, "dry-run", false, "只预览与线上版本的差异, 不进行部署")
+	fs.StringVar(&compression, "compress", "gzip", "压缩格式 gzip / zstd / none")
+	fs.IntVar(&level, "level", 0, "压缩级别 (gzip 1-9, zstd 1-22), 0 为默认")
+	fs.IntVar(&threads, "threads", 0, "并行压缩线程数, 0 为全部 CPU 核心")
+	fs.BoolVar(&watchMode, "watch", false, "监视项目变化, 自动重新渲染并增量上传")
+	fs.DurationVar(&debounce, "debounce", watch.DefaultDebounce, "最后一次变化后等待的时间")
+	checks.registerMode(fs)
+	checks.register(fs)
+	fs.StringVar(&message, "message", "", "部署说明, 随版本保存")
+	fs.StringVar(&message, "m", "", "部署说明")
+	fs.BoolVar(&noGit, "no-git", false, "不发送站点仓库的 commit, 分支与作者")
+	fs.BoolVar(&serverBuild, "server-build", false, "上传站点源码, 由服务端构建并部署")
+	fs.StringVar(&profile, "profile", "", "部署到 nemu profile 保存的目标组中的全部服务端")
+	fs.BoolVar(&allOrNothing, "all-or-nothing", false, "多目标部署时, 有目标失败则把成功的目标回滚到部署前的版本")
+	fs.StringVar(&previewName, "preview", "", "部署为名为该值的预览, 在 /_preview/<名称>/ 访问, 不影响线上版本")
+	fs.StringVar(&previewExpires, "preview-expires", "", "预览的有效期, 如 24h, 0 表示不过期, 默认使用服务端的 preview.ttl")
+	fs.StringVar(&previewPassword, "preview-password", "", "预览的访问密码, 访问时以 HTTP Basic 认证输入")
+	fs.StringVar(&prefix, "prefix", "", "只部署 public 下的这个子路径 (如 docs), 线上版本的其余内容保持不变")
+	fs.StringVar(&signKey, "sign-key", "", "以该私钥 (nemu keygen 生成) 签名归档, 默认读取环境变量 "+signKeyEnv+" 指定的路径")
+	fs.StringVar(&secret, "secret", "", "加密上传的归档, 与服务端 encryption.secret 相同, 默认读取环境变量 "+secretEnv)
+	return fs
+}
+
+// runDeploy nemu deploy
+// 旧版的平铺参数 (nemu -h example.com -p xxx) 同样由这里处理
+func runDeploy(args []string) {
+	fs := deployFlags()
+	fs.Parse(args)
+
+	if help {
+		fs.Usage()
+		os.Exit(report.ExitOK)
+	}
+	r = remote.reporter()
+
+	// 生成hash
+	if hash {
+		printHash(remote.password)
+	}
+
+	if watchMode {
+		if conflicts := watchConflicts(); conflicts != "" {
+			r.Fail(report.ExitUsage, "--watch 不能与 "+conflicts+" 同时使用", nil)
+		}
+	}
+	if serverBuild {
+		if conflicts := serverBuildConflicts(); conflicts != "" {
+			r.Fail(report.ExitUsage, "--server-build 不能与 "+conflicts+" 同时使用", nil)
+		}
+	}
+	if previewName != "" {
+		if conflicts := previewConflicts(); conflicts != "" {
+			r.Fail(report.ExitUsage, "--preview 不能与 "+conflicts+" 同时使用", nil)
+		}
+	} else if previewExpires != "" || previewPassword != "" {
+		r.Fail(report.ExitUsage, "--preview-expires 与 --preview-password 需要与 --preview 一起使用", nil)
+	}
+	if prefix != "" {
+		if conflicts := prefixConflicts(); conflicts != "" {
+			r.Fail(report.ExitUsage, "--prefix 不能与 "+conflicts+" 同时使用", nil)
+		}
+		cleaned, err := cleanPrefix(prefix)
+		if err != nil {
+			r.Fail(report.ExitUsage, "--prefix 无效", err)
+		}
+		prefix = cleaned
+	}
+
+	if secret != "" && serverBuild {
+		r.Fail(report.ExitUsage, "--secret 不能与 --server-build 同时使用, 源码上传不支持加密", nil)
+	}
+	if secret == "" && !serverBuild {
+		secret = os.Getenv(secretEnv)
+	}
+	if signKey != "" && serverBuild {
+		r.Fail(report.ExitUsage, "--sign-key 不能与 --server-build 同时使用, 源码上传不支持签名", nil)
+	}
+	if signKey == "" && !serverBuild {
+		signKey = os.Getenv(signKeyEnv)
+	}
+
+	// 仅列出将被上传的内容
+	if list {
+		listFiles()
+		return
+	}
+
+	// 处理host与密码, 未指定时使用 nemu login 保存的凭据
+	// 重复的 --host 或 --profile 指定多个目标
+	targets := remote.targets(fs, profile)
+	cfg := targets[0]
+	if len(targets) > 1 {
+		if conflicts := multiConflicts(); conflicts != "" {
+			r.Fail(report.ExitUsage, "多目标部署不能与 "+conflicts+" 同时使用", nil)
+		}
+	}
+
+	// 处理当前目录
+	dir, err := os.Getwd()
+	pubdir := dir + "/public"
+	if err != nil {
+		r.Fail(report.ExitLocal, "获取当前目录失败", err)
+	}
+
+	// 在渲染之前读取 git 状态, 以免渲染结果被计为未提交的修改
+	cfg.Meta = deployMeta(dir)
+
+	encoding, err := encode.NormalizeCompression(compression)
+	if err == nil {
+		err = encode.CheckLevel(encoding, level)
+	}
+	if err != nil {
+		r.Fail(report.ExitUsage, "压缩参数无效", err)
+	}
+
+	// 由服务端构建时不在本地渲染与校验
+	if serverBuild {
+		cfg.Compression = encoding
+		cfg.CompressionLevel = level
+		cfg.Concurrency = threads
+		runServerBuild(dir, cfg, remote.httpClient())
+		return
+	}
+
+	// 恢复会话时直接使用本地暂存的归档, 无需重新渲染
+	if !norender && resume == "" {
+		renderSite(dir)
+	}
+
+	// 检测目录是否存在
+	if _, err := os.Stat(pubdir); os.IsNotExist(err) && resume == "" {
+		r.Fail(report.ExitLocal, "public目录不存在", err)
+	}
+	if prefix != "" {
+		if info, err := os.Stat(filepath.Join(pubdir, prefix)); err != nil || !info.IsDir() {
+			r.Fail(report.ExitLocal, "public/"+prefix+" 不是目录", err)
+		}
+	}
+
+	// 构造客户端配置
+	matcher, err := loadIgnore(dir)
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取忽略规则失败", err)
+	}
+
+	// 校验站点, 恢复会话时上传的是之前打包的归档, 无需校验
+	if resume == "" && !watchMode {
+		checks.check(pubdir, matcher)
+	}
+
+	cfg.SourcePath = pubdir
+	cfg.Ignore = matcher
+	cfg.Prefix = prefix
+	cfg.ChunkSize = int64(chunkSize) << 20
+	cfg.Retries = retries
+	cfg.SessionID = resume
+	cfg.StateDir = dir + "/.nemu/sessions"
+	cfg.Compression = encoding
+	cfg.CompressionLevel = level
+	cfg.Concurrency = threads
+	cfg.Secret = secret
+	if signKey != "" {
+		if cfg.SigningKey, err = loadSigningKey(signKey); err != nil {
+			r.Fail(report.ExitLocal, "读取签名私钥失败", err)
+		}
+	}
+	if previewName != "" {
+		cfg.Preview = &encode.PreviewOptions{Name: previewName, Expires: previewExpires, Password: previewPassword}
+	}
+
+	// 创建 HTTP 客户端
+	client := remote.httpClient()
+
+	// 同一个归档同时上传到全部目标
+	if len(targets) > 1 {
+		for _, target := range targets[1:] {
+			target.SourcePath, target.Ignore, target.Prefix, target.Meta, target.Preview = cfg.SourcePath, cfg.Ignore, cfg.Prefix, cfg.Meta, cfg.Preview
+			target.Compression, target.CompressionLevel, target.Concurrency = encoding, level, threads
+			target.Secret, target.SigningKey = secret, cfg.SigningKey
+		}
+		runMultiDeploy(targets, client, pubdir)
+		return
+	}
+
+	// 持续监视, 直到 Ctrl+C
+	if watchMode {
+		runWatch(dir, cfg, client)
+		return
+	}
+
+	// 只预览差异
+	if dryRun {
+		result, err := encode.Preview(context.Background(), client, cfg)
+		if err != nil {
+			r.Fail(uploadExitCode(err), "获取差异预览失败", err)
+		}
+		if r.JSON() {
+			r.Event("preview", map[string]any{"diff": result})
+		} else {
+			printPreview(result)
+		}
+		return
+	}
+
+	// 发送数据
+	mode := "stream"
+	if chunked || resume != "" {
+		mode = "chunked"
+	}
+	r.Event("upload_started", map[string]any{
+		"url":         cfg.ServerURL,
+		"mode":        mode,
+		"compression": encoding,
+		"session":     resume,
+		"prefix":      prefix,
+		"meta":        cfg.Meta,
+	})
+	cfg.OnEvent = serverEvents("server_", "")
+	start := time.Now()
+	var result *encode.UploadResult
+	if mode == "chunked" {
+		result, err = encode.SendChunked(context.Background(), client, cfg)
+	} else {
+		result, err = encode.SendStreamingTarGz(context.Background(), client, cfg)
+	}
+	if err != nil {
+		var statusErr *encode.StatusError
+		if errors.As(err, &statusErr) {
+			reportResponse(statusErr.StatusCode, statusErr.Body)
+		}
+		r.Fail(uploadExitCode(err), "发送数据失败", err)
+	}
+	r.Event("upload_finished", map[string]any{
+		"bytes_sent":  result.BytesSent,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	reportResponse(http.StatusOK, result.Response)
+
+	r.Println("发送数据成功")
+	if url := previewURL(cfg, result.Response); url != "" {
+		r.Println("预览地址: " + url)
+	}
+	if prefix != "" {
+		r.Println("只替换了线上版本中的 /" + prefix + "/")
+	}
+
+	// 删除public目录
+	if delete {
+		err = os.RemoveAll(pubdir)
+		if err != nil {
+			r.Fail(report.ExitLocal, "删除public目录失败", err)
+		}
+	}
+
+	r.Event("done", map[string]any{"exit": report.ExitOK})
+	os.Exit(report.ExitOK)
+
+}
+
+// deployMeta 收集随版本保存的元数据, 不在 git 仓库中时只包含 --message
+func deployMeta(dir string) *encode.Meta {
+	meta := &encode.Meta{Message: message}
+	if !noGit {
+		info, err := gitinfo.Collect(dir)
+		if err == nil {
+			meta.Commit = info.Commit
+			meta.Dirty = info.Dirty
+			meta.Branch = info.Branch
+			meta.Author = info.Author
+		} else if !errors.Is(err, gitinfo.ErrNotRepository) {
+			fmt.Fprintln(os.Stderr, "读取 git 信息失败:", err)
+		}
+	}
+	if *meta == (encode.Meta{}) {
+		return nil
+	}
+	return meta
+}
+
+// renderSite 调用 hugo 渲染站点, 失败时以 ExitRender 退出
+func renderSite(dir string) {
+	r.Event("build_started", map[string]any{"dir": dir})
+	start := time.Now()
+	if err := render.HugoRenderTo(dir, r.Stdout()); err != nil {
+		r.Fail(report.ExitRender, "渲染失败", err)
+	}
+	r.Event("build_finished", map[string]any{"duration_ms": time.Since(start).Milliseconds()})
+}
+
+// reportResponse 输出服务端响应事件, 响应体为 JSON 时原样嵌入, 并提取版本 ID
+func reportResponse(status int, body []byte) {
+	fields := map[string]any{"status": status}
+	var parsed map[string]any
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		fields["response"] = parsed
+		if release, ok := parsed["release"]; ok {
+			fields["release"] = release
+		}
+	} else {
+		fields["response"] = string(body)
+	}
+	r.Event("server_response", fields)
+}
+
+// serverEvents 返回输出服务端推送的部署事件的回调
+// text 模式下打印构建与钩子的输出及进度, 警告输出到 stderr; json 模式下转为 <prefix><事件名> 事件
+// done 与 error 是最终结果, 由调用方处理
+// 多目标部署时 target 为服务端地址, text 模式下作为每行的前缀, json 模式下作为 target 字段
+func serverEvents(prefix, target string) func(event map[string]any) {
+	label := ""
+	if target != "" {
+		label = "[" + target + "] "
+	}
+	return func(event map[string]any) {
+		name, _ := event["event"].(string)
+		switch name {
+		case "done", "error", "":
+			return
+		}
+		if r.JSON() {
+			fields := make(map[string]any, len(event))
+			for k, v := range event {
+				if k != "event" && k != "time" {
+					fields[k] = v
+				}
+			}
+			if target != "" {
+				fields["target"] = target
+			}
+			r.Event(prefix+name, fields)
+			return
+		}
+		switch name {
+		case "log":
+			line, _ := event["line"].(string)
+			if hook, ok := event["hook"].(string); ok {
+				line = "[" + hook + "] " + line
+			}
+			fmt.Fprintln(os.Stdout, label+line)
+		case "warning":
+			fmt.Fprintln(os.Stderr, label+"警告:", event["message"])
+		case "received":
+			r.Println(label + fmt.Sprintf("服务端已接收 %v 个条目", event["entries"]))
+		case "waiting":
+			r.Println(label + "等待服务端的其他构建完成")
+		case "deploying":
+			r.Println(label + "构建完成, 正在部署")
+		case "hook":
+			switch event["status"] {
+			case "running":
+				r.Println(label + fmt.Sprintf("执行 %v 钩子: %v", event["hook"], event["command"]))
+			case "failed":
+				fmt.Fprintf(os.Stderr, label+"%v 钩子失败: %v\n", event["hook"], event["error"])
+			}
+		case "activated":
+			r.Println(label + fmt.Sprintf("已激活版本 %v", event["release"]))
+		case "deduplicated":
+			if saved, _ := event["saved"].(float64); saved > 0 {
+				r.Println(label + fmt.Sprintf("%v 个文件与已有版本相同, 节省 %s", event["reused"], formatBytes(int64(saved))))
+			}
+		case "replicating":
+			r.Println(label + fmt.Sprintf("复制到 %v 个节点, 需要 %v 个成功", event["peers"], event["quorum"]))
+		case "replicated":
+			if event["status"] == "ok" {
+				r.Println(label + fmt.Sprintf("已复制到 %v: 版本 %v", event["peer"], event["release"]))
+			} else {
+				fmt.Fprintf(os.Stderr, label+"复制到 %v 失败: %v\n", event["peer"], event["error"])
+			}
+		case "pruned":
+			freed, _ := event["freed"].(float64)
+			r.Println(label + fmt.Sprintf("清理了 %v 个旧版本, 释放 %s", event["releases"], formatBytes(int64(freed))))
+		}
+	}
+}
+
+// previewConflicts 返回不支持预览部署的参数
+// 预览只接受完整的流式上传
+func previewConflicts() string {
+	var conflicts []string
+	if watchMode {
+		conflicts = append(conflicts, "--watch")
+	}
+	if chunked {
+		conflicts = append(conflicts, "--chunked")
+	}
+	if resume != "" {
+		conflicts = append(conflicts, "--resume")
+	}
+	if dryRun {
+		conflicts = append(conflicts, "--dry-run")
+	}
+	if serverBuild {
+		conflicts = append(conflicts, "--server-build")
+	}
+	if allOrNothing {
+		conflicts = append(conflicts, "--all-or-nothing")
+	}
+	return strings.Join(conflicts, ", ")
+}
+
+// prefixConflicts 返回不支持部分部署的参数
+// 差异预览与增量上传都按整个站点比较, 预览部署总是完整的站点
+func prefixConflicts() string {
+	var conflicts []string
+	if watchMode {
+		conflicts = append(conflicts, "--watch")
+	}
+	if resume != "" {
+		conflicts = append(conflicts, "--resume")
+	}
+	if dryRun {
+		conflicts = append(conflicts, "--dry-run")
+	}
+	if serverBuild {
+		conflicts = append(conflicts, "--server-build")
+	}
+	if previewName != "" {
+		conflicts = append(conflicts, "--preview")
+	}
+	return strings.Join(conflicts, ", ")
+}
+
+// secretEnv 未指定 --secret 时读取的环境变量, 避免密钥出现在命令行与 shell 历史中
+const secretEnv = "NEMU_SECRET"
+
+// cleanPrefix 规范化 --prefix: 以 / 分隔, 去除首尾的 /, 不能为空或包含 ..
+func cleanPrefix(raw string) (string, error) {
+	trimmed := strings.Trim(filepath.ToSlash(raw), "/")
+	for _, part := range strings.Split(trimmed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("路径 %q 包含 ..", raw)
+		}
+	}
+	cleaned := strings.Trim(path.Clean("/"+trimmed), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("%q 指向站点根目录", raw)
+	}
+	return cleaned, nil
+}
+
+// previewURL 从预览部署的响应中取出访问地址, 不是预览部署时返回空字符串
+func previewURL(cfg *encode.ClientConfig, body []byte) string {
+	var response struct {
+		Path string `json:"path"`
+	}
+	if cfg.Preview == nil || json.Unmarshal(body, &response) != nil || response.Path == "" {
+		return ""
+	}
+	return apiBase(cfg) + response.Path
+}
+
+// uploadExitCode 根据上传错误的类型选择退出码
+func uploadExitCode(err error) int {
+	var (
+		statusErr *encode.StatusError
+		packErr   *encode.PackageError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode == http.StatusUnauthorized {
+			return report.ExitAuth
+		}
+		return report.ExitServer
+	case errors.As(err, &packErr):
+		return report.ExitPackage
+	default:
+		return report.ExitNetwork
+	}
+}
+
+// loadIgnore 依次加载 .nemuignore, --exclude 与 --include 规则
+// 后加载的规则优先, 因此 --include 可以覆盖 .nemuignore 与 --exclude
+func loadIgnore(dir string) (*ignore.Matcher, error) {
+	matcher := ignore.New()
+	// 规则文件本身不应被发布
+	if err := matcher.Add(ignore.FileName); err != nil {
+		return nil, err
+	}
+	if err := matcher.AddFile(filepath.Join(dir, ignore.FileName)); err != nil {
+		return nil, err
+	}
+	for _, pattern := range excludes {
+		if err := matcher.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range includes {
+		if err := matcher.Add("!" + pattern); err != nil {
+			return nil, err
+		}
+	}
+	return matcher, nil
+}
+
+// listFiles 渲染(可选)后打印将被上传的全部条目
+func listFiles() {
+	dir, err := os.Getwd()
+	if err != nil {
+		r.Fail(report.ExitLocal, "获取当前目录失败", err)
+	}
+	pubdir := dir + "/public"
+
+	if !norender {
+		renderSite(dir)
+	}
+
+	matcher, err := loadIgnore(dir)
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取忽略规则失败", err)
+	}
+
+	cfg := encode.ClientConfig{
+		SourcePath: pubdir,
+		Ignore:     matcher,
+		Prefix:     prefix,
+	}
+	entries, err := encode.ListFiles(context.Background(), &cfg)
+	if err != nil {
+		r.Fail(report.ExitPackage, "列出文件失败", err)
+	}
+	if r.JSON() {
+		r.Event("list", map[string]any{"files": entries})
+		return
+	}
+	for _, entry := range entries {
+		fmt.Println(entry)
+	}
+}
+
+// printPreview 打印差异预览
+func printPreview(result *encode.PreviewResult) {
+	for _, change := range result.Added {
+		fmt.Printf("+ %s (%s)\n", change.Path, formatBytes(change.NewSize))
+	}
+	for _, change := range result.Modified {
+		fmt.Printf("~ %s (%s -> %s)\n", change.Path, formatBytes(change.OldSize), formatBytes(change.NewSize))
+	}
+	for _, change := range result.Deleted {
+		fmt.Printf("- %s (%s)\n", change.Path, formatBytes(change.OldSize))
+	}
+	fmt.Printf("新增 %d 个, 修改 %d 个, 删除 %d 个, 未变化 %d 个\n",
+		len(result.Added), len(result.Modified), len(result.Deleted), result.Unchanged)
+	delta := result.BytesAdded - result.BytesRemoved
+	sign := "+"
+	if delta < 0 {
+		sign = "-"
+		delta = -delta
+	}
+	fmt.Printf("字节变化: +%s / -%s (净 %s%s)\n",
+		formatBytes(result.BytesAdded), formatBytes(result.BytesRemoved), sign, formatBytes(delta))
+}
+
+// formatBytes 将字节数格式化为易读的形式
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,144 @@
+package encode
+
+import (
+	"fmt"
+	"io"
+	"nemu-server/seal"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// 上传数据支持的压缩格式, 取值即请求头 Content-Encoding
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "identity"
+)
+
+// NormalizeCompression 校验并规范化压缩格式名称, 空字符串表示 gzip
+func NormalizeCompression(name string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "gzip", "gz":
+		return CompressionGzip, nil
+	case "zstd", "zst":
+		return CompressionZstd, nil
+	case "none", "identity":
+		return CompressionNone, nil
+	default:
+		return "", fmt.Errorf("unsupported compression: %s (gzip, zstd, none)", name)
+	}
+}
+
+// CheckLevel 校验压缩级别是否适用于指定的压缩格式, 0 表示默认级别
+func CheckLevel(compression string, level int) error {
+	if level == 0 {
+		return nil
+	}
+	switch compression {
+	case CompressionGzip:
+		if level < 1 || level > 9 {
+			return fmt.Errorf("gzip level must be between 1 and 9, got %d", level)
+		}
+	case CompressionZstd:
+		if level < 1 || level > 22 {
+			return fmt.Errorf("zstd level must be between 1 and 22, got %d", level)
+		}
+	}
+	return nil
+}
+
+// archiveExt 返回暂存归档使用的扩展名
+func archiveExt(cfg *ClientConfig) string {
+	switch cfg.Compression {
+	case CompressionZstd:
+		return ".tar.zst"
+	case CompressionNone:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+// newCompressor 按 cfg 创建压缩 writer, 指定 Secret 时压缩后的数据再经过加密
+// Close 依次关闭压缩与加密, 不关闭 w
+func newCompressor(w io.Writer, cfg *ClientConfig) (io.WriteCloser, error) {
+	if cfg.Secret == "" {
+		return newCompressWriter(w, cfg)
+	}
+	sealer, err := seal.NewWriter(w, cfg.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up encryption: %w", err)
+	}
+	compressor, err := newCompressWriter(sealer, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedWriter{WriteCloser: compressor, sealer: sealer}, nil
+}
+
+// sealedWriter 先关闭压缩流, 再写出加密流的最后一块
+type sealedWriter struct {
+	io.WriteCloser
+	sealer *seal.Writer
+}
+
+func (s *sealedWriter) Close() error {
+	if err := s.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return s.sealer.Close()
+}
+
+// encryption 返回上传使用的加密方案, 未加密时为空
+func (cfg *ClientConfig) encryption() string {
+	if cfg.Secret == "" {
+		return ""
+	}
+	return seal.Scheme
+}
+
+// newCompressWriter 按 cfg 创建压缩 writer
+// Level 为 0 时使用各算法的默认级别; Concurrency 为 0 时使用全部 CPU 核心并行压缩
+func newCompressWriter(w io.Writer, cfg *ClientConfig) (io.WriteCloser, error) {
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	switch cfg.Compression {
+	case "", CompressionGzip:
+		level := pgzip.DefaultCompression
+		if cfg.CompressionLevel != 0 {
+			level = cfg.CompressionLevel
+		}
+		gzWriter, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip level %d: %w", cfg.CompressionLevel, err)
+		}
+		// 每个块 1MB, 最多 concurrency 个块同时压缩
+		if err := gzWriter.SetConcurrency(1<<20, concurrency); err != nil {
+			return nil, fmt.Errorf("failed to set gzip concurrency: %w", err)
+		}
+		return gzWriter, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(concurrency)}
+		if cfg.CompressionLevel != 0 {
+			// Level 使用 zstd 的 1-22 级, 映射到 klauspost/compress 支持的四个速度档位
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cfg.CompressionLevel)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", cfg.Compression)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
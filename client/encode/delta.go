@@ -0,0 +1,95 @@
+package encode
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// WhiteoutPrefix 增量上传中表示删除的空条目前缀, 与 OCI 镜像层的约定相同
+// 条目 a/.wh.b.html 表示删除线上版本中的 a/b.html
+const WhiteoutPrefix = ".wh."
+
+// ErrBaseChanged 增量上传的基准版本已不是线上版本 (期间有其他部署或回滚)
+var ErrBaseChanged = errors.New("base release is no longer active")
+
+// Delta 增量上传的内容
+// 服务端以 Base 版本为基础, 写入 Files 中的文件并删除 Deleted 中的路径
+type Delta struct {
+	Base    string   // 基准版本 ID, 即预览时的线上版本
+	Files   []string // 新增或修改的文件, 相对 SourcePath 的 '/' 分隔路径
+	Deleted []string // 需要删除的文件
+
+	files map[string]bool
+}
+
+// NewDelta 由差异预览生成增量上传内容
+func NewDelta(result *PreviewResult) *Delta {
+	d := &Delta{Base: result.Release}
+	for _, change := range result.Added {
+		d.Files = append(d.Files, change.Path)
+	}
+	for _, change := range result.Modified {
+		d.Files = append(d.Files, change.Path)
+	}
+	for _, change := range result.Deleted {
+		d.Deleted = append(d.Deleted, change.Path)
+	}
+	return d
+}
+
+// Empty 是否没有任何变化
+func (d *Delta) Empty() bool {
+	return len(d.Files) == 0 && len(d.Deleted) == 0
+}
+
+// includes 判断条目是否需要打包, 目录由服务端按需创建, 不单独打包
+func (d *Delta) includes(relPath string, info os.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	}
+	if d.files == nil {
+		d.files = make(map[string]bool, len(d.Files))
+		for _, file := range d.Files {
+			d.files[file] = true
+		}
+	}
+	return d.files[relPath]
+}
+
+// writeWhiteouts 为 Deleted 中的每个路径写入删除标记
+func (d *Delta) writeWhiteouts(tw *tar.Writer) error {
+	now := time.Now()
+	for _, file := range d.Deleted {
+		dir, name := path.Split(file)
+		header := &tar.Header{
+			Name:     dir + WhiteoutPrefix + name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendIncremental 只上传相对于线上版本的变化
+// 基准版本已变化时返回 ErrBaseChanged, 调用方应改为完整上传
+func SendIncremental(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, delta *Delta) (*UploadResult, error) {
+	incremental := *cfg
+	incremental.Delta = delta
+	result, err := SendStreamingTarGz(ctx, httpClient, &incremental)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		return nil, ErrBaseChanged
+	}
+	return result, err
+}
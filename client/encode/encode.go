@@ -2,18 +2,26 @@ package encode
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"nemu-client/ignore"
+	"nemu-server/seal"
+	"nemu-server/sign"
+	"nemu-server/tarball"
+
 	"github.com/WJQSERVER-STUDIO/httpc"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -22,13 +30,111 @@ import (
 type ClientConfig struct {
 	ServerURL  string // 服务器地址
 	Token      string // 认证 Token
+	TokenHash  string // 已经过 sha512 处理的 Token (来自 nemu login), 优先于 Token
 	SourcePath string // 源文件或目录路径
+
+	Ignore *ignore.Matcher // 打包时排除的路径, 为 nil 则打包全部内容
+
+	// 部分部署的子路径 (如 docs), 只打包 SourcePath 下的这个目录, 服务端只替换线上版本中的这一部分
+	// 归档中的路径相对该目录, Ignore 仍按相对 SourcePath 的完整路径匹配
+	Prefix string
+
+	// 分块上传
+	ChunkSize int64  // 分块大小, 单位字节, 0 表示使用默认值
+	Retries   int    // 单个请求失败后的最大重试次数
+	SessionID string // 需要恢复的会话 ID, 为空则新建会话
+	StateDir  string // 会话状态与暂存归档的目录, 默认为 .nemu/sessions
+
+	// 压缩
+	Compression      string // gzip (默认), zstd 或 identity
+	CompressionLevel int    // 压缩级别, 0 表示默认
+	Concurrency      int    // 并行压缩的线程数, 0 表示使用全部 CPU 核心
+
+	// 增量上传, 为 nil 时上传完整内容
+	Delta *Delta
+
+	// 随版本保存的元数据, 为 nil 时不发送
+	Meta *Meta
+
+	// 上传加密的共享密钥, 与服务端 encryption.secret 相同, 为空时不加密
+	// 压缩后的归档以 seal 格式分块加密, 密钥本身不会发送
+	Secret string
+
+	// 签名归档的私钥 (nemu keygen 生成), 为 nil 时不签名
+	SigningKey ed25519.PrivateKey
+
+	// 预览部署, 为 nil 时部署为线上版本
+	Preview *PreviewOptions
+
+	// 服务端以 NDJSON 事件流响应时, 每收到一个事件调用一次, 为 nil 时忽略事件
+	OnEvent func(event map[string]any)
+}
+
+// statement 返回签名的内容, 与上传请求的头部对应, 摘要与签名时间由签名时填写
+func (cfg *ClientConfig) statement() sign.Statement {
+	st := sign.Statement{
+		Encoding:   cfg.contentEncoding(),
+		Encryption: cfg.encryption(),
+		Prefix:     cfg.Prefix,
+	}
+	if cfg.Delta != nil {
+		st.Base = cfg.Delta.Base
+	}
+	if cfg.Preview != nil {
+		st.Preview, st.Expires, st.Password = cfg.Preview.Name, cfg.Preview.Expires, cfg.Preview.passwordHash()
+	}
+	if cfg.Meta != nil {
+		st.Commit, st.Dirty, st.Branch, st.Author, st.Message = cfg.Meta.Commit, cfg.Meta.Dirty, cfg.Meta.Branch, cfg.Meta.Author, cfg.Meta.Message
+	}
+	return st
+}
+
+// contentEncoding 返回上传使用的 Content-Encoding
+func (cfg *ClientConfig) contentEncoding() string {
+	if cfg.Compression == "" {
+		return CompressionGzip
+	}
+	return cfg.Compression
 }
 
-// setupHttpClient 创建并配置 HTTP 客户端
-func SetupHttpClient() *httpc.Client {
-	client := httpc.New()
-	return client
+// TLSOptions 服务端要求客户端证书 (mTLS) 时使用的证书, 各字段为 PEM 文件的路径
+type TLSOptions struct {
+	Cert string // 客户端证书, 需与 Key 同时指定
+	Key  string // 客户端私钥
+	CA   string // 校验服务端证书的 CA, 为空时使用系统的根证书
+}
+
+// SetupHttpClient 创建并配置 HTTP 客户端, opts 为零值时不使用客户端证书
+func SetupHttpClient(opts TLSOptions) (*httpc.Client, error) {
+	if opts == (TLSOptions{}) {
+		return httpc.New(), nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.Cert != "" || opts.Key != "" {
+		if opts.Cert == "" || opts.Key == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.CA != "" {
+		pem, err := os.ReadFile(opts.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	// 保留默认 Transport 的代理, 超时与连接池设置, 只替换 TLS 配置
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return httpc.New(httpc.WithTransport(transport)), nil
 }
 
 /*
@@ -325,10 +431,88 @@ func SendStreamingTarGz(client *httpc.Client, cfg *ClientConfig) error {
 }
 */
 
+// root 返回打包的目录
+func (cfg *ClientConfig) root() string {
+	if cfg.Prefix == "" {
+		return cfg.SourcePath
+	}
+	return filepath.Join(cfg.SourcePath, filepath.FromSlash(cfg.Prefix))
+}
+
+// walkFunc 处理 walkSource 遍历到的条目, relPath 为归档中使用的 '/' 分隔路径
+type walkFunc func(file, relPath string, info os.FileInfo) error
+
+// walkSource 遍历 cfg.SourcePath (指定 cfg.Prefix 时为其中的子目录), 跳过根目录条目本身以及被 cfg.Ignore 忽略的路径
+// 打包、--list 等所有需要枚举上传内容的地方都应通过它遍历, 保证结果一致
+func walkSource(ctx context.Context, cfg *ClientConfig, fn walkFunc) error {
+	root := cfg.root()
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		// 检查上下文是否已被取消
+		select {
+		case <-ctx.Done():
+			log.Printf("INFO: Walk: Context cancelled during walk at %s. Aborting.", file)
+			return ctx.Err() // 中断 Walk
+		default:
+		}
+
+		if err != nil {
+			log.Printf("ERROR: Walk: Walk error accessing %s: %v", file, err)
+			return fmt.Errorf("walk access error for %s: %w", file, err)
+		}
+
+		relPath, err := filepath.Rel(root, file)
+		if err != nil {
+			log.Printf("ERROR: Walk: Getting relative path for %s failed: %v", file, err)
+			return fmt.Errorf("failed to get relative path for %s: %w", file, err)
+		}
+		if relPath == "." && !info.IsDir() { // 如果源本身是文件
+			relPath = filepath.Base(root)
+		} else if relPath == "." && info.IsDir() {
+			// 对于根目录本身，Walk 可能会以 "." 访问它，但我们不希望添加一个名为 "." 的条目
+			// 通常，我们会添加其内容，或者如果它是一个空目录，则是一个表示该目录的条目。
+			// 如果 SourcePath 是目录，Walk 会首先访问它，然后访问其内容。
+			// 如果我们希望 tar 包含一个根文件夹，那么这里的 relPath 需要调整。
+			// 简单起见，如果 relPath 是 "." 且是目录，我们跳过，因为它的内容会被单独添加。
+			// 或者，如果需要一个顶层文件夹，可以这样做：
+			// header.Name = filepath.Base(cfg.SourcePath) + "/" // if it's the root dir itself
+			// 但标准的 tar 通常直接放内容，除非指定了父目录。
+			// 假设我们直接打包内容。
+			if file == root && info.IsDir() { // 跳过根目录条目本身，只打包其内容
+				return nil
+			}
+		}
+
+		relPath = filepath.ToSlash(relPath) // 确保 tar 中的路径是 '/' 分隔的
+
+		// 应用 .nemuignore 与 --exclude/--include 规则, 被忽略的目录整体跳过
+		if cfg.Ignore.Match(path.Join(cfg.Prefix, relPath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return fn(file, relPath, info)
+	})
+}
+
+// ListFiles 返回将被上传的全部条目, 目录以 '/' 结尾
+func ListFiles(ctx context.Context, cfg *ClientConfig) ([]string, error) {
+	var entries []string
+	err := walkSource(ctx, cfg, func(file, relPath string, info os.FileInfo) error {
+		if info.IsDir() {
+			relPath += "/"
+		}
+		entries = append(entries, relPath)
+		return nil
+	})
+	return entries, err
+}
+
 // runProducer Goroutine 负责打包、压缩并将数据写入 PipeWriter。
 // 它在完成或遇到不可恢复的错误时关闭 PipeWriter。
 // 它通过返回 error 来指示其最终状态。
-func runProducer(ctx context.Context, pw *io.PipeWriter, cfg *ClientConfig) (producerError error) {
+func runProducer(ctx context.Context, pw pipeWriter, cfg *ClientConfig) (producerError error) {
 	// 确保在函数退出时（无论是正常还是 panic），都会尝试关闭 PipeWriter
 	// 如果已经有关闭错误，则会附加新的错误信息
 	defer func() {
@@ -351,19 +535,23 @@ func runProducer(ctx context.Context, pw *io.PipeWriter, cfg *ClientConfig) (pro
 		}
 	}()
 
-	gzWriter := gzip.NewWriter(pw)
+	// 按 cfg.Compression 选择 gzip / zstd / 不压缩
+	compressor, err := newCompressor(pw, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
 	defer func() {
-		if err := gzWriter.Close(); err != nil && producerError == nil && !strings.Contains(err.Error(), "pipe closed") {
+		if err := compressor.Close(); err != nil && producerError == nil && !strings.Contains(err.Error(), "pipe closed") {
 			// 只有当没有其他错误时，才将此错误设为主要错误
 			// 忽略 "pipe closed" 错误，因为它可能是由消费者关闭引起的
-			log.Printf("ERROR: Producer: closing GzipWriter failed: %v", err)
-			producerError = fmt.Errorf("gzip writer close error: %w", err)
+			log.Printf("ERROR: Producer: closing compressor failed: %v", err)
+			producerError = fmt.Errorf("compressor close error: %w", err)
 		} else if err != nil {
-			log.Printf("INFO: Producer: GzipWriter.Close() error (likely pipe already closed): %v", err)
+			log.Printf("INFO: Producer: compressor.Close() error (likely pipe already closed): %v", err)
 		}
 	}()
 
-	tarWriter := tar.NewWriter(gzWriter)
+	tarWriter := tar.NewWriter(compressor)
 	defer func() {
 		if err := tarWriter.Close(); err != nil && producerError == nil && !strings.Contains(err.Error(), "pipe closed") {
 			log.Printf("ERROR: Producer: closing TarWriter failed: %v", err)
@@ -375,86 +563,29 @@ func runProducer(ctx context.Context, pw *io.PipeWriter, cfg *ClientConfig) (pro
 
 	log.Printf("INFO: Producer: Starting to pack %s", cfg.SourcePath)
 
-	errWalk := filepath.Walk(cfg.SourcePath, func(file string, info os.FileInfo, err error) error {
-		// 检查上下文是否已被取消
-		select {
-		case <-ctx.Done():
-			log.Printf("INFO: Producer: Context cancelled during walk at %s. Aborting.", file)
-			return ctx.Err() // 中断 Walk
-		default:
-		}
-
-		if err != nil {
-			log.Printf("ERROR: Producer: Walk error accessing %s: %v", file, err)
-			return fmt.Errorf("walk access error for %s: %w", file, err)
-		}
-
-		relPath, err := filepath.Rel(cfg.SourcePath, file)
-		if err != nil {
-			log.Printf("ERROR: Producer: Getting relative path for %s failed: %v", file, err)
-			return fmt.Errorf("failed to get relative path for %s: %w", file, err)
-		}
-		if relPath == "." && !info.IsDir() { // 如果源本身是文件
-			relPath = filepath.Base(cfg.SourcePath)
-		} else if relPath == "." && info.IsDir() {
-			// 对于根目录本身，Walk 可能会以 "." 访问它，但我们不希望添加一个名为 "." 的条目
-			// 通常，我们会添加其内容，或者如果它是一个空目录，则是一个表示该目录的条目。
-			// 如果 SourcePath 是目录，Walk 会首先访问它，然后访问其内容。
-			// 如果我们希望 tar 包含一个根文件夹，那么这里的 relPath 需要调整。
-			// 简单起见，如果 relPath 是 "." 且是目录，我们跳过，因为它的内容会被单独添加。
-			// 或者，如果需要一个顶层文件夹，可以这样做：
-			// header.Name = filepath.Base(cfg.SourcePath) + "/" // if it's the root dir itself
-			// 但标准的 tar 通常直接放内容，除非指定了父目录。
-			// 假设我们直接打包内容。
-			if file == cfg.SourcePath && info.IsDir() { // 跳过根目录条目本身，只打包其内容
-				return nil
-			}
-		}
-
-		header, err := tar.FileInfoHeader(info, info.Name()) // 使用 info.Name() 作为 link name (如果它是符号链接)
-		if err != nil {
-			log.Printf("ERROR: Producer: Creating tar header for %s failed: %v", file, err)
-			return fmt.Errorf("failed to create tar header for %s: %w", file, err)
+	errWalk := walkSource(ctx, cfg, func(file, relPath string, info os.FileInfo) error {
+		if cfg.Delta != nil && !cfg.Delta.includes(relPath, info) {
+			return nil
 		}
-		header.Name = filepath.ToSlash(relPath) // 确保 tar 中的路径是 '/' 分隔的
-
-		// 处理符号链接的目标
+		// 条目格式与服务端导出和复制的归档相同
+		entry := tarball.Entry{Path: relPath, Mode: info.Mode(), ModTime: info.ModTime(), Size: info.Size()} // walkSource 已确保路径是 '/' 分隔的
 		if info.Mode()&os.ModeSymlink != 0 {
 			linkTarget, err := os.Readlink(file)
 			if err != nil {
 				log.Printf("ERROR: Producer: Reading symlink target for %s failed: %v", file, err)
 				return fmt.Errorf("failed to read symlink target for %s: %w", file, err)
 			}
-			header.Linkname = linkTarget // FileInfoHeader 可能不会正确填充这个，对于某些系统
+			entry.Link = linkTarget
 		}
 
-		if err := tarWriter.WriteHeader(header); err != nil {
-			log.Printf("ERROR: Producer: Writing tar header for %s failed: %v", file, err)
-			if err == io.ErrClosedPipe || strings.Contains(err.Error(), "pipe closed") {
-				log.Println("INFO: Producer: Pipe closed while writing tar header. Aborting walk.")
+		err := tarball.Write(tarWriter, entry, func() (io.ReadCloser, error) { return os.Open(file) })
+		if err != nil {
+			if errors.Is(err, io.ErrClosedPipe) || strings.Contains(err.Error(), "pipe closed") {
+				log.Printf("INFO: Producer: Pipe closed while writing %s. Aborting walk.", relPath)
 				return filepath.SkipAll // 使用 SkipAll 而不是直接返回错误，以优雅停止 Walk
 			}
-			return fmt.Errorf("failed to write tar header for %s: %w", file, err)
-		}
-
-		if info.Mode().IsRegular() && info.Size() > 0 { // 仅为非空常规文件复制内容
-			fileHandle, err := os.Open(file)
-			if err != nil {
-				log.Printf("ERROR: Producer: Opening file %s failed: %v", file, err)
-				return fmt.Errorf("failed to open file %s: %w", file, err)
-			}
-			defer fileHandle.Close()
-
-			copiedBytes, err := io.Copy(tarWriter, fileHandle)
-			if err != nil {
-				log.Printf("ERROR: Producer: Copying content for %s failed: %v (copied %d bytes)", file, err, copiedBytes)
-				if err == io.ErrClosedPipe || strings.Contains(err.Error(), "pipe closed") {
-					log.Println("INFO: Producer: Pipe closed while copying file content. Aborting walk.")
-					return filepath.SkipAll
-				}
-				return fmt.Errorf("failed to copy content for %s: %w", file, err)
-			}
-			// log.Printf("DEBUG: Producer: Copied %d bytes for file %s", copiedBytes, file)
+			log.Printf("ERROR: Producer: %v", err)
+			return err
 		}
 		return nil
 	})
@@ -474,8 +605,15 @@ func runProducer(ctx context.Context, pw *io.PipeWriter, cfg *ClientConfig) (pro
 		}
 	}
 
+	// 增量上传在文件之后写入删除标记
+	if producerError == nil && errWalk == nil && cfg.Delta != nil {
+		if err := cfg.Delta.writeWhiteouts(tarWriter); err != nil {
+			producerError = fmt.Errorf("failed to write whiteouts: %w", err)
+		}
+	}
+
 	// 如果到这里 producerError 仍然是 nil，那么打包过程（Walk 和写入Header/Content）是成功的。
-	// 接下来 defer 中的 tarWriter.Close(), gzWriter.Close(), pw.Close() 将会执行。
+	// 接下来 defer 中的 tarWriter.Close(), compressor.Close(), pw.Close() 将会执行。
 	// 如果这些 Close 操作失败，它们可能会设置 producerError。
 
 	if producerError == nil {
@@ -484,8 +622,47 @@ func runProducer(ctx context.Context, pw *io.PipeWriter, cfg *ClientConfig) (pro
 	return producerError // 返回在 walk 或 panic 期间发生的任何错误
 }
 
-// SendStreamingTarGz 创建并流式传输 tar.gz 归档
-func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg *ClientConfig) error {
+// pipeWriter 生产者的输出, 由 *io.PipeWriter 或多目标上传的 teeWriter 实现
+type pipeWriter interface {
+	io.Writer
+	Close() error
+	CloseWithError(err error) error
+}
+
+// newUploadRequest 创建流式上传的请求, 请求体为 body
+func newUploadRequest(httpClient *httpc.Client, cfg *ClientConfig, body io.Reader) *httpc.RequestBuilder {
+	rb := httpClient.NewRequestBuilder("POST", cfg.ServerURL)
+	if cfg.SigningKey != nil {
+		// 读完归档后在请求体末尾追加签名
+		rb.SetHeader(sign.HeaderKey, sign.EncodePublicKey(cfg.SigningKey.Public().(ed25519.PublicKey)))
+		body = sign.NewReader(body, cfg.SigningKey, cfg.statement())
+	}
+	rb.SetBody(body)
+	rb.NoDefaultHeaders() // 假设这是必要的
+	rb.SetHeader("User-Agent", userAgent)
+	rb.SetHeader("Content-Type", "application/octet-stream") // 通常流式传输使用这个
+	rb.SetHeader("Content-Encoding", cfg.contentEncoding())
+	rb.SetHeader("Accept", eventStreamType+", application/json")
+
+	rb.SetHeader("Nemu-Token", tokenHash(cfg))
+	if cfg.Delta != nil {
+		rb.SetHeader("Nemu-Base", cfg.Delta.Base)
+	}
+	if cfg.Prefix != "" {
+		rb.SetHeader("Nemu-Prefix", cfg.Prefix)
+	}
+	if cfg.Secret != "" {
+		rb.SetHeader(seal.Header, seal.Scheme)
+	}
+	cfg.Meta.setHeaders(rb)
+	cfg.Preview.setHeaders(rb)
+	// 其他头部设置 (如 Nemu-Timestamp, 如果需要) 可以加在这里
+	return rb
+}
+
+// SendStreamingTarGz 创建并流式传输 tar 归档
+// 压缩格式由 cfg.Compression 决定, 通过 Content-Encoding 告知服务端
+func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg *ClientConfig) (*UploadResult, error) {
 	// 使用 context 控制生产者 goroutine 的生命周期
 	ctx, cancelProducer := context.WithCancel(parentCtx)
 	defer cancelProducer() // 确保在函数退出时，生产者 goroutine 会被通知取消
@@ -511,15 +688,8 @@ func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg
 	// --- 主 goroutine (消费者) ---
 	log.Printf("INFO: Main: Preparing to stream data from %s to %s", cfg.SourcePath, cfg.ServerURL)
 
-	rb := httpClient.NewRequestBuilder("POST", cfg.ServerURL)
-	rb.SetBody(pr)        // pr 会从生产者 goroutine 写入的 pw 读取数据
-	rb.NoDefaultHeaders() // 假设这是必要的
-	rb.SetHeader("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36 NemuClient/1.0")
-	rb.SetHeader("Content-Type", "application/octet-stream") // 通常流式传输使用这个
-
-	nemuTokenHash := sha512.Sum512([]byte(cfg.Token))
-	rb.SetHeader("Nemu-Token", fmt.Sprintf("%x", nemuTokenHash))
-	// 其他头部设置 (如 Nemu-Timestamp, 如果需要) 可以加在这里
+	counter := &countingReader{r: pr}
+	rb := newUploadRequest(httpClient, cfg, counter) // pr 会从生产者 goroutine 写入的 pw 读取数据
 
 	req, err := rb.Build()
 	if err != nil {
@@ -533,9 +703,9 @@ func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg
 		// 等待生产者完成（它可能会因为管道关闭或上下文取消而错误退出）
 		producerErr := <-producerErrCh
 		if producerErr != nil && producerErr != context.Canceled && !strings.Contains(producerErr.Error(), "pipe closed") {
-			return fmt.Errorf("failed to create HTTP request: %v, and producer also failed: %v", err, producerErr)
+			return nil, fmt.Errorf("failed to create HTTP request: %v, and producer also failed: %v", err, producerErr)
 		}
-		return fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 	req = req.WithContext(ctx) // 将上下文传递给 HTTP 请求，允许取消请求
 
@@ -562,15 +732,15 @@ func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg
 		producerErr := <-producerErrCh // 会阻塞直到 producer goroutine 发送错误并退出
 		if producerErr != nil && producerErr != context.Canceled && !strings.Contains(producerErr.Error(), "pipe closed") {
 			// 如果生产者错误不是因为取消或管道关闭，则包含它
-			return fmt.Errorf("HTTP request failed: %v, and producer also failed: %v", httpErr, producerErr)
+			return nil, &PackageError{Err: fmt.Errorf("HTTP request failed: %v, and producer also failed: %w", httpErr, producerErr)}
 		}
-		return fmt.Errorf("HTTP request failed: %w", httpErr)
+		return nil, fmt.Errorf("HTTP request failed: %w", httpErr)
 	}
 	defer resp.Body.Close()
 
 	log.Printf("INFO: Main: Received HTTP response: Status %s", resp.Status)
 
-	responseBody, readErr := io.ReadAll(resp.Body)
+	responseBody, readErr := readResponse(resp, cfg.OnEvent)
 	if readErr != nil {
 		log.Printf("ERROR: Main: Reading response body failed: %v", readErr)
 		// 即使读取响应体失败，也要检查生产者错误
@@ -579,24 +749,23 @@ func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg
 
 		producerErr := <-producerErrCh
 		if producerErr != nil && producerErr != context.Canceled && !strings.Contains(producerErr.Error(), "pipe closed") {
-			return fmt.Errorf("failed to read response body: %v, and producer also failed: %v", readErr, producerErr)
+			return nil, fmt.Errorf("failed to read response body: %v, and producer also failed: %v", readErr, producerErr)
 		}
-		return fmt.Errorf("failed to read response body: %w", readErr)
+		return nil, fmt.Errorf("failed to read response body: %w", readErr)
 	}
 
 	log.Printf("INFO: Main: Server response body: %s", string(responseBody))
 
-	if resp.StatusCode != http.StatusOK {
-		errMsg := fmt.Errorf("server returned non-OK status: %s, body: %s", resp.Status, string(responseBody))
+	if errMsg := responseError(resp, responseBody); errMsg != nil {
 		log.Printf("ERROR: Main: %s", errMsg.Error())
 		cancelProducer()
 		_ = pr.Close()
 
 		producerErr := <-producerErrCh
 		if producerErr != nil && producerErr != context.Canceled && !strings.Contains(producerErr.Error(), "pipe closed") {
-			return fmt.Errorf("%w (producer error: %v)", errMsg, producerErr)
+			return nil, fmt.Errorf("%w (producer error: %v)", errMsg, producerErr)
 		}
-		return errMsg
+		return nil, errMsg
 	}
 
 	// 等待生产者 goroutine 完成并检查其最终错误
@@ -608,12 +777,12 @@ func SendStreamingTarGz(parentCtx context.Context, httpClient *httpc.Client, cfg
 			log.Printf("INFO: Main: Producer finished with expected error after successful HTTP request: %v", producerErr)
 		} else {
 			log.Printf("ERROR: Main: HTTP request succeeded, but producer reported an error: %v", producerErr)
-			return fmt.Errorf("HTTP request successful, but producer failed: %w", producerErr)
+			return nil, &PackageError{Err: fmt.Errorf("HTTP request successful, but producer failed: %w", producerErr)}
 		}
 	}
 
-	log.Println("INFO: Main: Streaming tar.gz sent successfully, and received OK response.")
-	return nil
+	log.Println("INFO: Main: Streaming archive sent successfully, and received OK response.")
+	return &UploadResult{BytesSent: counter.n.Load(), Response: responseBody}, nil
 }
 
 // SimpleEncrypt 使用 ChaCha20-Poly1305 加密数据
@@ -0,0 +1,93 @@
+package encode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// 服务端事件流的 Content-Type, 每行一个 JSON 对象
+// 部署请求在 Accept 中携带它, 服务端便会实时推送解压, 钩子与激活的进度
+const eventStreamType = "application/x-ndjson"
+
+// 单个事件的长度上限
+const maxEventSize = 1 << 20
+
+// SendSource 将 cfg.SourcePath 下的站点源码上传到 /nemu/build, 由服务端构建并部署
+// 构建日志等事件通过 cfg.OnEvent 回调, 构建失败时返回 Stage 为 build 的 *StatusError
+func SendSource(ctx context.Context, client *httpc.Client, cfg *ClientConfig) (*UploadResult, error) {
+	buildCfg := *cfg
+	buildCfg.ServerURL = BuildURL(cfg)
+	return SendStreamingTarGz(ctx, client, &buildCfg)
+}
+
+// BuildURL 返回服务端构建接口的地址
+func BuildURL(cfg *ClientConfig) string {
+	return apiURL(cfg, "/nemu/build")
+}
+
+// readResponse 读取响应体
+// 服务端以事件流响应时逐行将事件交给 onEvent, 返回最后一个事件, 它表示最终结果
+func readResponse(resp *http.Response, onEvent func(map[string]any)) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != eventStreamType {
+		return io.ReadAll(resp.Body)
+	}
+
+	var last []byte
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxEventSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var event map[string]any
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("invalid event from server: %w", err)
+		}
+		last = bytes.Clone(line)
+		if onEvent != nil {
+			onEvent(event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("event stream ended without a result")
+	}
+	return last, nil
+}
+
+// responseError 检查响应状态码, 对事件流检查最后一个事件是否为 error
+func responseError(resp *http.Response, body []byte) *StatusError {
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: body}
+	}
+	var event struct {
+		Event   string `json:"event"`
+		Message string `json:"message"`
+		Status  int    `json:"status"`
+		Stage   string `json:"stage"`
+	}
+	if json.Unmarshal(body, &event) != nil || event.Event != "error" {
+		return nil
+	}
+	if event.Status == 0 {
+		event.Status = http.StatusInternalServerError
+	}
+	return &StatusError{
+		StatusCode: event.Status,
+		Status:     fmt.Sprintf("%d %s", event.Status, http.StatusText(event.Status)),
+		Body:       []byte(event.Message),
+		Stage:      event.Stage,
+	}
+}
@@ -0,0 +1,106 @@
+package encode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// ManifestEntry 清单中的一个文件, 与服务端 manifest.Entry 对应
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// FileChange 预览结果中的一个变化
+type FileChange struct {
+	Path    string `json:"path"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+// PreviewResult 服务端返回的差异预览
+type PreviewResult struct {
+	Release      string       `json:"release,omitempty"` // 比较时的线上版本 ID
+	Added        []FileChange `json:"added"`
+	Modified     []FileChange `json:"modified"`
+	Deleted      []FileChange `json:"deleted"`
+	Unchanged    int          `json:"unchanged"`
+	BytesAdded   int64        `json:"bytes_added"`
+	BytesRemoved int64        `json:"bytes_removed"`
+}
+
+// BuildManifest 生成将被上传文件的清单 (与打包使用相同的遍历与忽略规则)
+func BuildManifest(ctx context.Context, cfg *ClientConfig) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := walkSource(ctx, cfg, func(file, relPath string, info os.FileInfo) error {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink target for %s: %w", file, err)
+			}
+			entries = append(entries, ManifestEntry{Path: relPath, Link: link})
+		case info.Mode().IsRegular():
+			sum, err := fileSHA256(file)
+			if err != nil {
+				return fmt.Errorf("failed to hash %s: %w", file, err)
+			}
+			entries = append(entries, ManifestEntry{Path: relPath, Size: info.Size(), SHA256: sum})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Preview 将清单发送到服务端预览接口, 返回相对于线上版本的差异, 服务端不会修改任何内容
+func Preview(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) (*PreviewResult, error) {
+	entries, err := BuildManifest(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(map[string]any{"files": entries})
+	if err != nil {
+		return nil, err
+	}
+
+	rb := newRequest(ctx, httpClient, cfg, http.MethodPost, apiURL(cfg, "/nemu/diff"), bytes.NewReader(payload))
+	rb.SetHeader("Content-Type", "application/json")
+	body, err := execute(httpClient, rb)
+	if err != nil {
+		return nil, err
+	}
+
+	var result PreviewResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode preview response: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,130 @@
+package encode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// TargetResult 多目标上传中一个服务端的结果, Err 为 nil 时 Result 有效
+type TargetResult struct {
+	Result *UploadResult
+	Err    error
+}
+
+// SendStreamingMulti 只打包一次, 将同一个归档同时流式上传到多个服务端
+// 各目标使用自己的 ServerURL, 凭据, Meta 与 OnEvent; 打包参数 (SourcePath, Ignore, 压缩, 加密密钥) 取自 cfgs[0]
+// 某个目标失败后不再向它写入, 其余目标继续上传; 管道没有缓冲, 整体速度取决于最慢的目标
+// 返回的结果与 cfgs 一一对应
+func SendStreamingMulti(parentCtx context.Context, httpClient *httpc.Client, cfgs []*ClientConfig) []TargetResult {
+	ctx, cancelProducer := context.WithCancel(parentCtx)
+	defer cancelProducer()
+
+	tee := &teeWriter{pipes: make([]*io.PipeWriter, len(cfgs)), failed: make([]bool, len(cfgs))}
+	readers := make([]*io.PipeReader, len(cfgs))
+	for i := range cfgs {
+		readers[i], tee.pipes[i] = io.Pipe()
+	}
+
+	producerErrCh := make(chan error, 1)
+	go func() {
+		producerErrCh <- runProducer(ctx, tee, cfgs[0])
+	}()
+
+	results := make([]TargetResult, len(cfgs))
+	var wg sync.WaitGroup
+	for i, cfg := range cfgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := postArchive(ctx, httpClient, cfg, readers[i])
+			if err != nil {
+				log.Printf("ERROR: Main: Upload to %s failed: %v", cfg.ServerURL, err)
+				// 让生产者跳过这个目标
+				readers[i].CloseWithError(err)
+			} else {
+				readers[i].Close()
+			}
+			results[i] = TargetResult{Result: result, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	// 打包失败时各目标的错误只是管道被关闭, 以打包错误代替
+	producerErr := <-producerErrCh
+	if producerErr != nil && producerErr != context.Canceled && !strings.Contains(producerErr.Error(), "pipe closed") {
+		for i := range results {
+			if results[i].Err != nil {
+				results[i].Err = &PackageError{Err: producerErr}
+			}
+		}
+	}
+	return results
+}
+
+// postArchive 以 body 为请求体上传到 cfg.ServerURL 并读取响应
+func postArchive(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, body io.Reader) (*UploadResult, error) {
+	counter := &countingReader{r: body}
+	req, err := newUploadRequest(httpClient, cfg, counter).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := readResponse(resp, cfg.OnEvent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if errMsg := responseError(resp, responseBody); errMsg != nil {
+		return nil, errMsg
+	}
+	return &UploadResult{BytesSent: counter.n.Load(), Response: responseBody}, nil
+}
+
+// teeWriter 把生产者的输出依次写入每个目标的管道
+// 写入失败的目标 (请求已结束) 之后被跳过, 全部失败时返回 io.ErrClosedPipe 让生产者停止
+type teeWriter struct {
+	pipes  []*io.PipeWriter
+	failed []bool
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for i, pw := range t.pipes {
+		if t.failed[i] {
+			continue
+		}
+		if _, err := pw.Write(p); err != nil {
+			t.failed[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+func (t *teeWriter) Close() error {
+	for _, pw := range t.pipes {
+		pw.Close()
+	}
+	return nil
+}
+
+func (t *teeWriter) CloseWithError(err error) error {
+	for _, pw := range t.pipes {
+		pw.CloseWithError(err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package encode
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// PreviewOptions 预览部署的选项, ClientConfig.Preview 不为 nil 时上传成为预览, 不影响线上版本
+type PreviewOptions struct {
+	Name     string // 预览名称, 在 /_preview/<name>/ 访问
+	Expires  string // 有效期, 如 24h; 0 表示不过期; 为空时使用服务端的 preview.ttl
+	Password string // 访问密码, 以 sha512 发送
+}
+
+// setHeaders 以 Nemu-Preview* 头部发送预览选项
+func (p *PreviewOptions) setHeaders(rb *httpc.RequestBuilder) {
+	if p == nil {
+		return
+	}
+	rb.SetHeader("Nemu-Preview", p.Name)
+	if p.Expires != "" {
+		rb.SetHeader("Nemu-Preview-Expires", p.Expires)
+	}
+	if p.Password != "" {
+		rb.SetHeader("Nemu-Preview-Password", p.passwordHash())
+	}
+}
+
+// passwordHash 返回 Nemu-Preview-Password 的取值, 没有密码时为空
+func (p *PreviewOptions) passwordHash() string {
+	if p.Password == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha512.Sum512([]byte(p.Password)))
+}
+
+// PreviewInfo 服务端的一个预览
+type PreviewInfo struct {
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"` // 为 nil 时不过期
+	Entries   int        `json:"entries"`
+	Size      int64      `json:"size"`
+	Protected bool       `json:"protected"` // 是否需要密码
+	Path      string     `json:"path"`      // 访问路径, 如 /_preview/<name>/
+	Meta
+}
+
+// Previews 列出服务端未过期的预览, 按创建时间倒序
+func Previews(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) ([]PreviewInfo, error) {
+	var result struct {
+		Previews []PreviewInfo `json:"previews"`
+	}
+	if err := doJSON(ctx, httpClient, cfg, http.MethodGet, apiURL(cfg, "/nemu/previews"), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Previews, nil
+}
+
+// DeletePreview 删除预览
+func DeletePreview(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, name string) error {
+	return doJSON(ctx, httpClient, cfg, http.MethodDelete, apiURL(cfg, "/nemu/previews/"+url.PathEscape(name)), nil, nil)
+}
@@ -0,0 +1,150 @@
+package encode
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrIncomplete 表示下载的归档无法完整读取, 通常是传输中断或服务端在导出途中出错
+var ErrIncomplete = errors.New("archive is incomplete")
+
+// Export 从 /nemu/export 下载的归档, 调用方负责关闭 Body
+type Export struct {
+	Release     string // 归档对应的版本 ID
+	Compression string // gzip 或 zstd
+	Body        io.ReadCloser
+}
+
+// ExportRelease 请求服务端导出版本 id (为空时为线上版本), compression 为 gzip 或 zstd
+func ExportRelease(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, id, compression string) (*Export, error) {
+	query := url.Values{"compress": {compression}}
+	if id != "" {
+		query.Set("release", id)
+	}
+	req, err := newRequest(ctx, httpClient, cfg, http.MethodGet, apiURL(cfg, "/nemu/export?"+query.Encode()), nil).Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, responseError(resp, body)
+	}
+	return &Export{Release: resp.Header.Get("Nemu-Release"), Compression: compression, Body: resp.Body}, nil
+}
+
+// Extract 解压 compression 格式的 tar 归档到 dir, 返回条目数量
+// dir 为空时只读取整个归档, 校验其完整; 归档无法读取时返回包装 ErrIncomplete 的错误
+// 条目不能写出 dir, 也不能经由归档中的软链接写到 dir 之外
+func Extract(r io.Reader, compression, dir string) (int, error) {
+	var reader io.Reader
+	switch compression {
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrIncomplete, err)
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrIncomplete, err)
+		}
+		defer gr.Close()
+		reader = gr
+	}
+
+	tr := tar.NewReader(reader)
+	entries := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			// 读完归档之后的填充, 同时校验压缩流的结尾
+			if _, err := io.Copy(io.Discard, reader); err != nil {
+				return entries, fmt.Errorf("%w: %v", ErrIncomplete, err)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("%w: %v", ErrIncomplete, err)
+		}
+		if dir == "" {
+			if _, err := io.Copy(io.Discard, tr); err != nil {
+				return entries, fmt.Errorf("%w: %v", ErrIncomplete, err)
+			}
+			entries++
+			continue
+		}
+
+		target, err := extractPath(dir, header.Name)
+		if err != nil {
+			return entries, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return entries, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return entries, err
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return entries, err
+			}
+		case tar.TypeReg:
+			os.Remove(target) // 目标可能是软链接, 不能经由它写入
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return entries, err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return entries, fmt.Errorf("%w: %v", ErrIncomplete, err)
+			}
+			if !header.ModTime.IsZero() {
+				os.Chtimes(target, header.ModTime, header.ModTime)
+			}
+		default:
+			continue
+		}
+		entries++
+	}
+}
+
+// extractPath 返回条目 name 在 dir 中的路径
+// name 不能是绝对路径或离开 dir, 途经的目录也不能是软链接
+func extractPath(dir, name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	parent := dir
+	parts := strings.Split(cleaned, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		if info, err := os.Lstat(parent); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("unsafe path in archive: %q passes through a symlink", name)
+		}
+	}
+	return filepath.Join(dir, cleaned), nil
+}
@@ -0,0 +1,97 @@
+package encode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// Release 服务端的一个版本, 与服务端 release.Release 对应
+type Release struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Entries int       `json:"entries"`
+	Size    int64     `json:"size"`
+	Active  bool      `json:"active,omitempty"`
+	Meta
+}
+
+// Meta 随部署提交的说明信息, 与服务端 release.Meta 对应
+type Meta struct {
+	Commit  string `json:"commit,omitempty"`
+	Dirty   bool   `json:"dirty,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Author  string `json:"author,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// setHeaders 以 Nemu-Git-* 与 Nemu-Message 头部发送元数据, 值经过 URL 编码
+func (m *Meta) setHeaders(rb *httpc.RequestBuilder) {
+	if m == nil {
+		return
+	}
+	set := func(key, value string) {
+		if value != "" {
+			rb.SetHeader(key, url.QueryEscape(value))
+		}
+	}
+	set("Nemu-Git-Commit", m.Commit)
+	set("Nemu-Git-Branch", m.Branch)
+	set("Nemu-Git-Author", m.Author)
+	set("Nemu-Message", m.Message)
+	if m.Dirty {
+		rb.SetHeader("Nemu-Git-Dirty", "true")
+	}
+}
+
+// StatusResult 服务端当前状态
+type StatusResult struct {
+	Release  *Release `json:"release"` // 当前线上版本, 尚未部署过时为 nil
+	Releases int      `json:"releases"`
+}
+
+// Status 查询当前线上版本
+func Status(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) (*StatusResult, error) {
+	var result StatusResult
+	if err := doJSON(ctx, httpClient, cfg, http.MethodGet, apiURL(cfg, "/nemu/status"), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Releases 列出服务端保留的全部版本, 按时间倒序
+func Releases(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) ([]Release, error) {
+	var result struct {
+		Releases []Release `json:"releases"`
+	}
+	if err := doJSON(ctx, httpClient, cfg, http.MethodGet, apiURL(cfg, "/nemu/releases"), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Releases, nil
+}
+
+// Rollback 切换线上版本, id 为空时回滚到上一个版本, 返回激活的版本 ID
+func Rollback(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, id string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"release": id})
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Release string `json:"release"`
+	}
+	rb := newRequest(ctx, httpClient, cfg, http.MethodPost, apiURL(cfg, "/nemu/rollback"), bytes.NewReader(payload))
+	rb.SetHeader("Content-Type", "application/json")
+	body, err := execute(httpClient, rb)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", err
+	}
+	return result.Release, nil
+}
@@ -0,0 +1,45 @@
+package encode
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// UploadResult 一次上传的结果
+type UploadResult struct {
+	BytesSent int64  // 实际发送的 (压缩后) 字节数
+	Response  []byte // 服务端响应体
+}
+
+// StatusError 服务端返回了非 200 状态码, 或在事件流中以 error 事件报告失败
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+	Stage      string // error 事件中的失败阶段, 例如 build
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned non-OK status: %s, body: %s", e.Status, string(e.Body))
+}
+
+// countingReader 统计经过的字节数
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// PackageError 本地打包 (遍历, 读取文件, 压缩) 失败
+type PackageError struct {
+	Err error
+}
+
+func (e *PackageError) Error() string { return e.Err.Error() }
+func (e *PackageError) Unwrap() error { return e.Err }
@@ -0,0 +1,444 @@
+package encode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nemu-server/sign"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+const userAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/136.0.0.0 Safari/537.36 NemuClient/1.0"
+
+// 分块上传的默认参数
+const (
+	DefaultChunkSize = 8 << 20 // 8MB
+	DefaultRetries   = 5
+)
+
+// SessionState 本地保存的分块上传会话状态, 用于重启后断点续传
+type SessionState struct {
+	ID        string `json:"id"`
+	ServerURL string `json:"server_url"`
+	Archive   string `json:"archive"`          // 本地暂存的归档
+	Encoding  string `json:"encoding"`         // 归档的压缩格式
+	Prefix    string `json:"prefix,omitempty"` // 部分部署的子路径, 归档按它打包
+	// 归档的加密方案, 为空表示未加密; 暂存的归档已经加密, 恢复会话时不再需要密钥
+	Encryption string `json:"encryption,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+	ChunkSize  int64  `json:"chunk_size"`
+}
+
+// remoteChunk 服务端已接收的分块
+type remoteChunk struct {
+	Index  int    `json:"index"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// retryableError 标记可以重试的错误 (网络错误, 5xx, 校验失败等)
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// apiURL 由上传地址推导出其他接口地址
+func apiURL(cfg *ClientConfig, path string) string {
+	return strings.TrimSuffix(cfg.ServerURL, "/nemu/upload") + path
+}
+
+// tokenHash 对token进行sha512处理, 让服务端比对
+func tokenHash(cfg *ClientConfig) string {
+	if cfg.TokenHash != "" {
+		return cfg.TokenHash
+	}
+	if cfg.Token == "" {
+		// 只使用客户端证书认证
+		return ""
+	}
+	nemuTokenHash := sha512.Sum512([]byte(cfg.Token))
+	return fmt.Sprintf("%x", nemuTokenHash)
+}
+
+func (cfg *ClientConfig) stateDir() string {
+	if cfg.StateDir != "" {
+		return cfg.StateDir
+	}
+	return filepath.Join(".nemu", "sessions")
+}
+
+func (cfg *ClientConfig) statePath(id string) string {
+	return filepath.Join(cfg.stateDir(), id+".json")
+}
+
+// LoadSessionState 读取本地保存的会话状态
+func LoadSessionState(cfg *ClientConfig, id string) (*SessionState, error) {
+	data, err := os.ReadFile(cfg.statePath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session state for %s: %w", id, err)
+	}
+	var state SessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode session state for %s: %w", id, err)
+	}
+	return &state, nil
+}
+
+func saveSessionState(cfg *ClientConfig, state *SessionState) error {
+	if err := os.MkdirAll(cfg.stateDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cfg.statePath(state.ID), data, 0600)
+}
+
+func removeSessionState(cfg *ClientConfig, state *SessionState) {
+	if err := os.Remove(cfg.statePath(state.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: Removing session state %s failed: %v", state.ID, err)
+	}
+	if err := os.Remove(state.Archive); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: Removing archive %s failed: %v", state.Archive, err)
+	}
+}
+
+// SpoolTarGz 将压缩后的 tar 归档完整写入本地文件, 返回大小和 sha256
+// 流式管道无法重放, 分块上传需要先落盘
+func SpoolTarGz(ctx context.Context, cfg *ClientConfig, path string) (int64, string, error) {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer out.Close()
+
+	pr, pw := io.Pipe()
+	producerErrCh := make(chan error, 1)
+	go func() {
+		producerErrCh <- runProducer(ctx, pw, cfg)
+	}()
+
+	hasher := sha256.New()
+	size, copyErr := io.Copy(io.MultiWriter(out, hasher), pr)
+	_ = pr.Close()
+	producerErr := <-producerErrCh
+	if producerErr != nil {
+		return 0, "", fmt.Errorf("producer failed: %w", producerErr)
+	}
+	if copyErr != nil {
+		return 0, "", fmt.Errorf("failed to write archive file: %w", copyErr)
+	}
+	if err := out.Sync(); err != nil {
+		return 0, "", fmt.Errorf("failed to sync archive file: %w", err)
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// SendChunked 以分块会话的方式上传归档
+// 单个分块失败会按指数退避重试; 若 cfg.SessionID 不为空, 则恢复该会话, 只上传服务端缺失的分块
+func SendChunked(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) (*UploadResult, error) {
+	var (
+		state *SessionState
+		err   error
+	)
+
+	if cfg.SessionID != "" {
+		state, err = LoadSessionState(cfg, cfg.SessionID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(state.Archive); err != nil {
+			return nil, fmt.Errorf("archive for session %s is not available: %w", state.ID, err)
+		}
+		log.Printf("INFO: Resuming upload session %s (%d bytes)", state.ID, state.Size)
+	} else {
+		state, err = createSession(ctx, httpClient, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	received, done, err := sessionChunks(ctx, httpClient, cfg, state)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkCount := int((state.Size + state.ChunkSize - 1) / state.ChunkSize)
+	archive, err := os.Open(state.Archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer archive.Close()
+
+	var sent int64
+
+	// 会话已在服务端完成 (上次只是没有收到 finalize 的响应), 直接 finalize 取回结果
+	for index := 0; index < chunkCount && !done; index++ {
+		offset := int64(index) * state.ChunkSize
+		length := min(state.ChunkSize, state.Size-offset)
+
+		data := make([]byte, length)
+		if _, err := archive.ReadAt(data, offset); err != nil {
+			return nil, fmt.Errorf("failed to read chunk %d: %w", index, err)
+		}
+		sum := sha256.Sum256(data)
+		sumStr := hex.EncodeToString(sum[:])
+
+		if chunk, ok := received[index]; ok && chunk.SHA256 == sumStr {
+			continue // 服务端已有该分块
+		}
+
+		err := withRetry(ctx, cfg, fmt.Sprintf("chunk %d/%d", index+1, chunkCount), func() error {
+			return putChunk(ctx, httpClient, cfg, state, index, data, sumStr)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("upload session %s interrupted at chunk %d (resume with --resume %s): %w", state.ID, index, state.ID, err)
+		}
+		sent += length
+		log.Printf("INFO: Uploaded chunk %d/%d (%d bytes)", index+1, chunkCount, length)
+	}
+
+	var body []byte
+	err = withRetry(ctx, cfg, "finalize", func() error {
+		var err error
+		body, err = finalizeSession(ctx, httpClient, cfg, state, chunkCount)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to finalize session %s (resume with --resume %s): %w", state.ID, state.ID, err)
+	}
+
+	log.Printf("INFO: Main: Server response body: %s", string(body))
+	removeSessionState(cfg, state)
+	return &UploadResult{BytesSent: sent, Response: body}, nil
+}
+
+// createSession 打包归档并在服务端创建会话
+func createSession(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig) (*SessionState, error) {
+	if err := os.MkdirAll(cfg.stateDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmpArchive := filepath.Join(cfg.stateDir(), fmt.Sprintf("pending-%d%s", time.Now().UnixNano(), archiveExt(cfg)))
+	size, sum, err := SpoolTarGz(ctx, cfg, tmpArchive)
+	if err != nil {
+		os.Remove(tmpArchive)
+		return nil, &PackageError{Err: err}
+	}
+	log.Printf("INFO: Archive packed: %d bytes, sha256 %s", size, sum)
+
+	var created struct {
+		ID           string `json:"id"`
+		MaxChunkSize int64  `json:"max_chunk_size"`
+	}
+	err = withRetry(ctx, cfg, "create session", func() error {
+		return doJSON(ctx, httpClient, cfg, http.MethodPost, apiURL(cfg, "/nemu/session"), nil, &created)
+	})
+	if err != nil {
+		os.Remove(tmpArchive)
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	chunkSize := cfg.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if created.MaxChunkSize > 0 && chunkSize > created.MaxChunkSize {
+		chunkSize = created.MaxChunkSize
+	}
+
+	state := &SessionState{
+		ID:         created.ID,
+		ServerURL:  cfg.ServerURL,
+		Archive:    filepath.Join(cfg.stateDir(), created.ID+archiveExt(cfg)),
+		Encoding:   cfg.contentEncoding(),
+		Prefix:     cfg.Prefix,
+		Encryption: cfg.encryption(),
+		Size:       size,
+		SHA256:     sum,
+		ChunkSize:  chunkSize,
+	}
+	if err := os.Rename(tmpArchive, state.Archive); err != nil {
+		os.Remove(tmpArchive)
+		return nil, fmt.Errorf("failed to move archive: %w", err)
+	}
+	if err := saveSessionState(cfg, state); err != nil {
+		return nil, err
+	}
+	log.Printf("INFO: Upload session %s created (chunk size %d bytes)", state.ID, state.ChunkSize)
+	return state, nil
+}
+
+// sessionChunks 查询服务端已接收的分块
+func sessionChunks(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, state *SessionState) (map[int]remoteChunk, bool, error) {
+	var status struct {
+		Done   bool          `json:"done"`
+		Chunks []remoteChunk `json:"chunks"`
+	}
+	err := withRetry(ctx, cfg, "session status", func() error {
+		return doJSON(ctx, httpClient, cfg, http.MethodGet, apiURL(cfg, "/nemu/session/"+state.ID), nil, &status)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to query session %s: %w", state.ID, err)
+	}
+	received := make(map[int]remoteChunk, len(status.Chunks))
+	for _, chunk := range status.Chunks {
+		received[chunk.Index] = chunk
+	}
+	return received, status.Done, nil
+}
+
+func putChunk(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, state *SessionState, index int, data []byte, sum string) error {
+	url := apiURL(cfg, fmt.Sprintf("/nemu/session/%s/chunk/%d", state.ID, index))
+	rb := newRequest(ctx, httpClient, cfg, http.MethodPut, url, bytes.NewReader(data))
+	rb.SetHeader("Content-Type", "application/octet-stream")
+	rb.SetHeader("Nemu-Chunk-Sha256", sum)
+	_, err := execute(httpClient, rb)
+	// 分块校验失败 (传输中损坏) 时重新上传该分块; 其他请求的 422 (例如 pre-activate 钩子失败) 不应重试
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusUnprocessableEntity {
+		return &retryableError{err: err}
+	}
+	return err
+}
+
+func finalizeSession(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, state *SessionState, chunks int) ([]byte, error) {
+	request := map[string]any{"chunks": chunks, "sha256": state.SHA256, "encoding": state.Encoding}
+	if cfg.Meta != nil {
+		request["meta"] = cfg.Meta
+	}
+	if state.Prefix != "" {
+		request["prefix"] = state.Prefix
+	}
+	if state.Encryption != "" {
+		request["encryption"] = state.Encryption
+	}
+	if cfg.SigningKey != nil {
+		// 分块上传的归档摘要已知, 签名放在请求体中, 签名时间取 finalize 的时刻
+		// 恢复会话时压缩格式等参数以会话状态为准
+		st := cfg.statement()
+		st.Digest, st.Encoding, st.Encryption, st.Prefix, st.Base = state.SHA256, state.Encoding, state.Encryption, state.Prefix, ""
+		request["signature"] = sign.Detach(cfg.SigningKey, st)
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	rb := newRequest(ctx, httpClient, cfg, http.MethodPost, apiURL(cfg, "/nemu/session/"+state.ID+"/finalize"), bytes.NewReader(payload))
+	rb.SetHeader("Content-Type", "application/json")
+	rb.SetHeader("Accept", eventStreamType+", application/json")
+	return executeEvents(httpClient, rb, cfg.OnEvent)
+}
+
+// newRequest 构造带认证头部的请求
+func newRequest(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, method, url string, body io.Reader) *httpc.RequestBuilder {
+	rb := httpClient.NewRequestBuilder(method, url)
+	rb.WithContext(ctx)
+	if body != nil {
+		rb.SetBody(body)
+	}
+	rb.NoDefaultHeaders()
+	rb.SetHeader("User-Agent", userAgent)
+	rb.SetHeader("Nemu-Token", tokenHash(cfg))
+	return rb
+}
+
+// execute 发送请求并读取响应体, 根据状态码区分可重试与不可重试的错误
+func execute(httpClient *httpc.Client, rb *httpc.RequestBuilder) ([]byte, error) {
+	return executeEvents(httpClient, rb, nil)
+}
+
+// executeEvents 与 execute 相同, 服务端以事件流响应时将事件交给 onEvent
+// 事件流中的 error 事件表示部署本身失败, 不会重试
+func executeEvents(httpClient *httpc.Client, rb *httpc.RequestBuilder, onEvent func(map[string]any)) ([]byte, error) {
+	req, err := rb.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("HTTP request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponse(resp, onEvent)
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("failed to read response body: %w", err)}
+	}
+
+	if errMsg := responseError(resp, body); errMsg != nil {
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return nil, errMsg
+		case resp.StatusCode >= 500,
+			resp.StatusCode == http.StatusRequestTimeout,
+			resp.StatusCode == http.StatusTooManyRequests:
+			return nil, &retryableError{err: errMsg}
+		default:
+			return nil, errMsg
+		}
+	}
+	return body, nil
+}
+
+func doJSON(ctx context.Context, httpClient *httpc.Client, cfg *ClientConfig, method, url string, body io.Reader, out any) error {
+	data, err := execute(httpClient, newRequest(ctx, httpClient, cfg, method, url, body))
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// withRetry 以指数退避 (带抖动) 重试可重试的错误
+func withRetry(ctx context.Context, cfg *ClientConfig, what string, fn func() error) error {
+	retries := cfg.Retries
+	if retries < 0 {
+		retries = 0
+	}
+	delay := 500 * time.Millisecond
+	const maxDelay = 30 * time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || attempt >= retries {
+			return err
+		}
+
+		wait := delay/2 + rand.N(delay/2+1)
+		log.Printf("WARN: %s failed (attempt %d/%d): %v, retrying in %s", what, attempt+1, retries+1, err, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay = min(delay*2, maxDelay)
+	}
+}
@@ -0,0 +1,60 @@
+package gitinfo
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// ErrNotRepository 目录不在 git 仓库中, 或未安装 git
+var ErrNotRepository = errors.New("not a git repository")
+
+// Info 站点仓库的当前状态
+type Info struct {
+	Commit string // HEAD 的完整 commit
+	Dirty  bool   // 工作区或暂存区有未提交的修改
+	Branch string // 当前分支, HEAD 分离时为空
+	Author string // HEAD 的作者, 形如 name <email>
+}
+
+// Collect 读取 dir 所在 git 仓库的 commit, 分支, 作者与是否有未提交的修改
+// 仓库尚无任何 commit 时只返回 Dirty
+func Collect(dir string) (*Info, error) {
+	if _, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return nil, ErrNotRepository
+	}
+
+	info := &Info{}
+	status, err := git(dir, "status", "--porcelain")
+	if err != nil {
+		return nil, err
+	}
+	info.Dirty = status != ""
+
+	commit, err := git(dir, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		return info, nil // 尚无 commit
+	}
+	info.Commit = commit
+
+	// HEAD 分离时 (例如 CI 检出指定 commit) 输出 HEAD
+	if branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		info.Branch = branch
+	}
+	if author, err := git(dir, "log", "-1", "--format=%an <%ae>"); err == nil {
+		info.Author = author
+	}
+	return info, nil
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -1,10 +1,24 @@
 module nemu-client
 
-go 1.24.3
+go 1.24.4
 
 require (
 	github.com/WJQSERVER-STUDIO/httpc v0.5.1
+	github.com/fenthope/record v0.0.3
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/infinite-iroha/touka v0.1.0
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/pgzip v1.2.6
 	golang.org/x/crypto v0.38.0
+	golang.org/x/net v0.40.0
+	nemu-server v0.0.0
+)
+
+require (
+	github.com/fenthope/compress v0.0.3 // indirect
+	github.com/fenthope/reco v0.0.1 // indirect
+	github.com/go-json-experiment/json v0.0.0-20250517221953-25912455fbc8 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 )
 
 require (
@@ -12,3 +26,5 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 )
+
+replace nemu-server => ../server
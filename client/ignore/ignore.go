@@ -0,0 +1,178 @@
+package ignore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// FileName 忽略规则文件名, 语法与 .gitignore 相同
+const FileName = ".nemuignore"
+
+// rule 单条忽略规则
+type rule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool // 以 ! 开头, 重新包含之前被忽略的路径
+	dirOnly bool // 以 / 结尾, 只匹配目录
+}
+
+// Matcher 按 gitignore 语义匹配路径, 后出现的规则优先
+type Matcher struct {
+	rules []rule
+}
+
+func New() *Matcher {
+	return &Matcher{}
+}
+
+// AddFile 读取规则文件, 文件不存在时不视为错误
+func (m *Matcher) AddFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open ignore file %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if err := m.Add(scanner.Text()); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Add 添加一条规则, 空行和 # 开头的注释会被跳过
+func (m *Matcher) Add(line string) error {
+	line = strings.TrimRight(line, "\r")
+	// 尾部空格除非被转义, 否则忽略
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	r := rule{pattern: line}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	// 包含 / (不计结尾) 的规则相对于根目录锚定, 否则匹配任意层级
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr, err := globToRegexp(line)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", r.pattern, err)
+	}
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	r.re, err = regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", r.pattern, err)
+	}
+	m.rules = append(m.rules, r)
+	return nil
+}
+
+// Match 判断相对路径是否被忽略, rel 使用 / 分隔
+// 与 git 相同, 被忽略目录下的内容由调用者整体跳过, 不会被单独重新包含
+func (m *Matcher) Match(rel string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel = strings.TrimPrefix(path.Clean(rel), "./")
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// Len 返回规则数量
+func (m *Matcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.rules)
+}
+
+// globToRegexp 将 gitignore 的通配符转换为正则表达式
+// 支持 *, ?, [...] 以及 **
+func globToRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch ch {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				atStart := i == 0 || glob[i-1] == '/'
+				atEnd := i+2 == len(glob)
+				switch {
+				case atStart && !atEnd && glob[i+2] == '/':
+					// "**/" 匹配零或多级目录
+					b.WriteString("(?:.*/)?")
+					i += 2
+				case atStart && atEnd:
+					// 结尾的 "/**" 匹配目录下的全部内容
+					b.WriteString(".*")
+					i++
+				default:
+					b.WriteString("[^/]*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return b.String(), nil
+}
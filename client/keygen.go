@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"nemu-client/report"
+	"nemu-server/sign"
+	"os"
+	"path/filepath"
+)
+
+// signKeyEnv 未指定 --sign-key 时读取的环境变量, 值为私钥文件的路径
+const signKeyEnv = "NEMU_SIGN_KEY"
+
+// defaultKeyPath 返回 nemu keygen 默认的私钥路径, 与凭据文件在同一目录
+func defaultKeyPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate user config directory: %w", err)
+	}
+	return filepath.Join(dir, "nemu", "signing.key"), nil
+}
+
+// runKeygen nemu keygen
+// 生成签名部署归档的 Ed25519 密钥对, 私钥只保存在本地, 公钥填入服务端的 [[signing.keys]]
+func runKeygen(args []string) {
+	var (
+		out    string
+		force  bool
+		output string
+	)
+	fs := newFlagSet("keygen", "[选项]", "生成签名部署使用的 Ed25519 密钥对")
+	fs.StringVar(&out, "out", "", "私钥文件的路径, 公钥写入同名的 .pub 文件, 默认为用户配置目录下的 nemu/signing.key")
+	fs.BoolVar(&force, "force", false, "密钥文件已存在时覆盖")
+	fs.StringVar(&output, "output", report.FormatText, "输出格式 text / json")
+	fs.Parse(args)
+	remote := remoteOptions{output: output}
+	r = remote.reporter()
+
+	if out == "" {
+		path, err := defaultKeyPath()
+		if err != nil {
+			r.Fail(report.ExitLocal, "生成密钥失败", err)
+		}
+		out = path
+	}
+	if err := checkTarget(out, force); err != nil {
+		r.Fail(report.ExitLocal, "生成密钥失败", err)
+	}
+
+	pub, priv, err := sign.GenerateKey()
+	if err == nil {
+		err = writeKeyPair(out, pub, priv)
+	}
+	if err != nil {
+		r.Fail(report.ExitLocal, "生成密钥失败", err)
+	}
+
+	encoded := sign.EncodePublicKey(pub)
+	if r.JSON() {
+		r.Event("keygen", map[string]any{"path": out, "public_key": encoded})
+		return
+	}
+	r.Println("私钥已保存到 " + out + ", 部署时以 --sign-key 指定")
+	r.Println("在服务端配置中添加公钥:")
+	r.Println("")
+	r.Println("[[signing.keys]]")
+	r.Println(`name = "` + keyName() + `"`)
+	r.Println(`key = "` + encoded + `"`)
+}
+
+// writeKeyPair 以 0600 权限写入私钥, 公钥写入 path.pub
+func writeKeyPair(path string, pub ed25519.PublicKey, priv ed25519.PrivateKey) error {
+	data, err := sign.MarshalPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// 先删除已有的文件, 以免沿用其原有的权限
+	os.Remove(path)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".pub", []byte(sign.EncodePublicKey(pub)+"\n"), 0644)
+}
+
+// loadSigningKey 读取 nemu keygen 生成的私钥
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return sign.ParsePrivateKey(data)
+}
+
+// keyName 返回 [[signing.keys]] 中建议的名称
+func keyName() string {
+	name := os.Getenv("USER")
+	if host, err := os.Hostname(); err == nil {
+		if name == "" {
+			return host
+		}
+		name += "@" + host
+	}
+	if name == "" {
+		name = "deployer"
+	}
+	return name
+}
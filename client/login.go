@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"nemu-client/credential"
+	"nemu-client/encode"
+	"nemu-client/report"
+)
+
+// runLogin nemu login
+// 校验凭据后保存 sha512 处理后的 Token, 之后的命令可省略 --host 与 --password
+func runLogin(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("login", "-h <host> -p <password>", "校验并保存服务端凭据, 该服务端将成为默认服务端")
+	remote.register(fs)
+	fs.Parse(args)
+	r = remote.reporter()
+
+	host := remote.host()
+	if host == "" {
+		if !r.JSON() {
+			fs.Usage()
+		}
+		r.Fail(report.ExitUsage, "目标域名不能为空", nil)
+	}
+	if remote.password == "" {
+		r.Fail(report.ExitUsage, "密码不能为空", nil)
+	}
+
+	base := normalizeHost(host, remote.debug)
+	token := fmt.Sprintf("%x", sha512.Sum512([]byte(remote.password)))
+	cfg := &encode.ClientConfig{ServerURL: base + "/nemu/upload", TokenHash: token}
+	if _, err := encode.Status(context.Background(), remote.httpClient(), cfg); err != nil {
+		r.Fail(uploadExitCode(err), "登录失败", err)
+	}
+
+	store, err := credential.Load()
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取凭据失败", err)
+	}
+	store.Set(base, credential.Host{Token: token})
+	if err := store.Save(); err != nil {
+		r.Fail(report.ExitLocal, "保存凭据失败", err)
+	}
+	r.Event("login", map[string]any{"host": base, "path": store.Path()})
+	r.Println(fmt.Sprintf("已登录 %s, 凭据保存在 %s", base, store.Path()))
+}
+
+// runLogout nemu logout
+func runLogout(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("logout", "[-h <host>]", "删除保存的凭据, 未指定 --host 时删除默认服务端的凭据")
+	remote.register(fs)
+	fs.Parse(args)
+	r = remote.reporter()
+
+	store, err := credential.Load()
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取凭据失败", err)
+	}
+	base := store.Default
+	if host := remote.host(); host != "" {
+		base = normalizeHost(host, remote.debug)
+	}
+	if !store.Delete(base) {
+		r.Fail(report.ExitUsage, "没有保存该服务端的凭据", nil)
+	}
+	if err := store.Save(); err != nil {
+		r.Fail(report.ExitLocal, "保存凭据失败", err)
+	}
+	r.Event("logout", map[string]any{"host": base})
+	r.Println("已删除 " + base + " 的凭据")
+}
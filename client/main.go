@@ -1,146 +1,258 @@
 package main
 
 import (
-	"context"
-	"crypto/sha512"
 	"flag"
 	"fmt"
+	"nemu-client/credential"
 	"nemu-client/encode"
-	"nemu-client/render"
+	"nemu-client/report"
 	"os"
 	"strings"
-)
 
-var (
-	password string
-	host     string
-	help     bool
-	hash     bool
-	debug    bool
-	delete   bool
-	norender bool
+	"github.com/WJQSERVER-STUDIO/httpc"
 )
 
-func parseFlag() {
-	// --password / -p 密码
-	// --host / -h 目标域名
-	// --help 帮助信息
-	// --hash 把输入的密码转换为sha512
-	// --debug 允许跳过host检查
-	// --delete / -d 删除public目录
-	// --norender 不进行渲染
-
-	flag.StringVar(&password, "password", "", "密码")
-	flag.StringVar(&password, "p", "", "密码")
-	flag.StringVar(&host, "host", "", "目标域名")
-	flag.StringVar(&host, "h", "", "目标域名")
-	flag.BoolVar(&help, "help", false, "帮助信息")
-	flag.BoolVar(&hash, "hash", false, "把输入的密码转换为sha512")
-	flag.BoolVar(&debug, "debug", false, "允许跳过host检查")
-	flag.BoolVar(&delete, "delete", false, "删除public目录")
-	flag.BoolVar(&norender, "norender", false, "不进行渲染")
-
-	flag.Parse()
-
-	if help {
-		flag.Usage()
-		return
-	}
-}
+var r *report.Reporter
 
-func main() {
+// command 一个子命令
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
 
-	parseFlag()
+var commands = []command{
+	{"deploy", "渲染站点并上传, 成为新的线上版本", runDeploy},
+	{"status", "查看当前线上版本", runStatus},
+	{"releases", "列出服务端保留的版本", runReleases},
+	{"rollback", "回滚到上一个或指定版本", runRollback},
+	{"pull", "下载版本, 用于备份与恢复", runPull},
+	{"previews", "列出或删除预览部署", runPreviews},
+	{"login", "保存服务端地址与凭据", runLogin},
+	{"logout", "删除保存的凭据", runLogout},
+	{"profile", "管理同时部署的目标组", runProfile},
+	{"validate", "检查失效链接, 缺失资源与过大的文件", runValidate},
+	{"hash", "把输入的密码转换为sha512, 用于服务端配置", runHash},
+	{"keygen", "生成签名部署使用的密钥对", runKeygen},
+	{"serve", "在本地预览 public 目录", runServe},
+}
 
-	// 生成hash
-	if hash {
-		if password != "" {
+func usage() {
+	fmt.Fprintln(os.Stderr, "用法: nemu <命令> [选项]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "命令:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "使用 nemu <命令> --help 查看各命令的选项")
+	fmt.Fprintln(os.Stderr, "兼容旧版用法: nemu -h example.com -p <password> 等同于 nemu deploy -h example.com -p <password>")
+}
 
-			nemuTokenHash := sha512.Sum512([]byte(password))
-			nemuTokenHashStr := fmt.Sprintf("%x", nemuTokenHash)
-			fmt.Println(nemuTokenHashStr)
-			os.Exit(0)
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
+		os.Exit(report.ExitUsage)
+	}
 
-		} else {
-			fmt.Println("密码不能为空")
-			os.Exit(1)
+	// 第一个参数是选项时按旧版的平铺参数处理, 即 deploy
+	if strings.HasPrefix(args[0], "-") {
+		if args[0] == "--help" || args[0] == "-help" {
+			usage()
+			os.Exit(report.ExitOK)
 		}
+		runDeploy(args)
+		return
 	}
 
-	// 处理host (example.com https://example.com http://example.com 转换为 https://example.com/nemu/upload)
-	if host != "" && !debug {
-		if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
-			host = "https://" + host
+	if args[0] == "help" {
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				cmd.run([]string{"--help"})
+				return
+			}
 		}
-		if !strings.HasSuffix(host, "/nemu/upload") {
-			host += "/nemu/upload"
+		usage()
+		os.Exit(report.ExitOK)
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "未知命令: %s\n\n", args[0])
+		usage()
+		os.Exit(report.ExitUsage)
+	}
+	cmd.run(args[1:])
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
 		}
-	} else if host != "" && debug {
-		host = host + "/nemu/upload"
+	}
+	return nil
+}
 
-	} else {
-		flag.Usage()
-		return
+// newFlagSet 创建子命令的参数集, 参数错误时以 ExitUsage 退出
+func newFlagSet(name, synopsis, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "用法: nemu %s %s\n\n%s\n\n选项:\n", name, synopsis, summary)
+		fs.PrintDefaults()
 	}
+	return fs
+}
 
-	// 处理密码
-	if password == "" {
-		println("密码不能为空")
-		return
+// remoteOptions 访问服务端的公共参数
+type remoteOptions struct {
+	hosts    stringSlice
+	password string
+	debug    bool
+	output   string
+	tls      encode.TLSOptions
+}
+
+func (o *remoteOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.password, "password", "", "密码")
+	fs.StringVar(&o.password, "p", "", "密码")
+	fs.Var(&o.hosts, "host", "目标域名, 默认使用 nemu login 保存的服务端")
+	fs.Var(&o.hosts, "h", "目标域名")
+	fs.BoolVar(&o.debug, "debug", false, "允许跳过host检查")
+	fs.StringVar(&o.output, "output", report.FormatText, "输出格式 text / json (json 每行一个事件)")
+	fs.StringVar(&o.tls.Cert, "cert", "", "客户端证书 (PEM), 服务端要求客户端证书时使用")
+	fs.StringVar(&o.tls.Key, "key", "", "客户端证书的私钥 (PEM)")
+	fs.StringVar(&o.tls.CA, "ca", "", "校验服务端证书的 CA (PEM), 默认使用系统的根证书")
+}
+
+// httpClient 按 --cert / --key / --ca 创建 HTTP 客户端
+func (o *remoteOptions) httpClient() *httpc.Client {
+	client, err := encode.SetupHttpClient(o.tls)
+	if err != nil {
+		r.Fail(report.ExitUsage, "客户端证书无效", err)
 	}
+	return client
+}
 
-	// 处理当前目录
-	dir, err := os.Getwd()
-	pubdir := dir + "/public"
+// reporter 按 --output 创建 Reporter
+func (o *remoteOptions) reporter() *report.Reporter {
+	reporter, err := report.New(o.output)
 	if err != nil {
-		println("获取当前目录失败")
-		return
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(report.ExitUsage)
+	}
+	return reporter
+}
+
+// host 返回 --host 指定的服务端, 未指定时返回空字符串
+// 只有 deploy 支持多个目标, 其他命令指定多个 --host 时以 ExitUsage 退出
+func (o *remoteOptions) host() string {
+	switch len(o.hosts) {
+	case 0:
+		return ""
+	case 1:
+		return o.hosts[0]
+	default:
+		r.Fail(report.ExitUsage, "只能指定一个 --host", nil)
+		return ""
 	}
+}
 
-	if !norender {
-		if err := render.HugoRender(dir); err != nil {
-			println("渲染失败")
-			println(err.Error())
-			return
+// config 解析服务端地址与凭据
+// 未指定 --host 时使用默认服务端; 未指定 --password 时使用该服务端保存的 Token
+func (o *remoteOptions) config(fs *flag.FlagSet) *encode.ClientConfig {
+	host := o.host()
+	store := o.store(host != "")
+
+	base := ""
+	if host != "" {
+		base = normalizeHost(host, o.debug)
+	} else if store != nil {
+		base = store.Default
+	}
+	if base == "" {
+		if !r.JSON() {
+			fs.Usage()
 		}
+		r.Fail(report.ExitUsage, "目标域名不能为空", nil)
 	}
+	return o.target(store, base)
+}
 
-	// 检测目录是否存在
-	if _, err := os.Stat(pubdir); os.IsNotExist(err) {
-		println("public目录不存在")
-		return
+// targets 解析部署的全部目标: 重复指定的 --host, 或 --profile 保存的服务端列表
+// 两者都未指定时与 config 相同, 使用默认服务端
+func (o *remoteOptions) targets(fs *flag.FlagSet, profile string) []*encode.ClientConfig {
+	if profile == "" && len(o.hosts) <= 1 {
+		return []*encode.ClientConfig{o.config(fs)}
+	}
+	if profile != "" && len(o.hosts) > 0 {
+		r.Fail(report.ExitUsage, "--profile 不能与 --host 同时使用", nil)
 	}
 
-	// 构造客户端配置
-	cfg := encode.ClientConfig{
-		ServerURL:  host,
-		Token:      password,
-		SourcePath: pubdir,
+	var bases []string
+	store := o.store(profile == "")
+	if profile != "" {
+		hosts, ok := store.Profiles[profile]
+		if !ok {
+			r.Fail(report.ExitUsage, "没有名为 "+profile+" 的目标组, 使用 nemu profile set 创建", nil)
+		}
+		bases = hosts
+	} else {
+		for _, host := range o.hosts {
+			bases = append(bases, normalizeHost(host, o.debug))
+		}
 	}
 
-	// 创建 HTTP 客户端
-	client := encode.SetupHttpClient()
+	seen := make(map[string]bool, len(bases))
+	cfgs := make([]*encode.ClientConfig, 0, len(bases))
+	for _, base := range bases {
+		if seen[base] {
+			r.Fail(report.ExitUsage, "重复的目标: "+base, nil)
+		}
+		seen[base] = true
+		cfgs = append(cfgs, o.target(store, base))
+	}
+	return cfgs
+}
 
-	// 发送数据
-	err = encode.SendStreamingTarGz(context.Background(), client, &cfg)
+// store 读取保存的凭据
+// 凭据文件损坏时, optional 为 true 且指定了 --password 则忽略, 否则以 ExitLocal 退出
+func (o *remoteOptions) store(optional bool) *credential.Store {
+	store, err := credential.Load()
 	if err != nil {
-		println("发送数据失败")
-		println(err.Error())
-		return
+		// 凭据文件损坏时仍允许通过参数指定
+		if !optional || o.password == "" {
+			r.Fail(report.ExitLocal, "读取凭据失败", err)
+		}
+		return nil
 	}
+	return store
+}
 
-	fmt.Printf("发送数据成功\n")
-
-	// 删除public目录
-	if delete {
-		err = os.RemoveAll(pubdir)
-		if err != nil {
-			println("删除public目录失败")
-			println(err.Error())
-			return
+// target 返回 base 的客户端配置, 未指定 --password 时使用该服务端保存的 Token
+func (o *remoteOptions) target(store *credential.Store, base string) *encode.ClientConfig {
+	cfg := &encode.ClientConfig{ServerURL: base + "/nemu/upload", Token: o.password}
+	if o.password == "" {
+		if store != nil {
+			if _, cred, ok := store.Get(base); ok {
+				cfg.TokenHash = cred.Token
+			}
+		}
+		// 使用客户端证书时可以不提供 Token, 由服务端按证书认证
+		if cfg.TokenHash == "" && o.tls.Cert == "" {
+			r.Fail(report.ExitUsage, "密码不能为空", fmt.Errorf("no saved credential for %s", base))
 		}
 	}
+	return cfg
+}
 
-	os.Exit(0)
-
+// normalizeHost 处理host (example.com https://example.com http://example.com 转换为 https://example.com)
+// debug 模式下不补全协议, 便于使用 http://127.0.0.1:8168 等地址
+func normalizeHost(host string, debug bool) string {
+	host = strings.TrimSuffix(strings.TrimSuffix(host, "/nemu/upload"), "/")
+	if !debug && !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+		host = "https://" + host
+	}
+	return host
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"nemu-client/encode"
+	"nemu-client/report"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// targetResult 多目标部署中一个服务端的结果
+type targetResult struct {
+	Target    string `json:"target"`
+	Status    string `json:"status"` // ok / failed / rolled_back
+	Release   string `json:"release,omitempty"`
+	URL       string `json:"url,omitempty"`      // 预览部署的访问地址
+	Previous  string `json:"previous,omitempty"` // 部署前的线上版本, 仅 --all-or-nothing
+	BytesSent int64  `json:"bytes_sent"`
+	Error     string `json:"error,omitempty"`
+
+	err error
+}
+
+// multiConflicts 返回不支持多目标部署的参数
+func multiConflicts() string {
+	var conflicts []string
+	if watchMode {
+		conflicts = append(conflicts, "--watch")
+	}
+	if chunked {
+		conflicts = append(conflicts, "--chunked")
+	}
+	if resume != "" {
+		conflicts = append(conflicts, "--resume")
+	}
+	if dryRun {
+		conflicts = append(conflicts, "--dry-run")
+	}
+	if serverBuild {
+		conflicts = append(conflicts, "--server-build")
+	}
+	return strings.Join(conflicts, ", ")
+}
+
+// runMultiDeploy 只打包一次, 同时上传到全部目标, 最后输出每个目标的结果
+// --all-or-nothing 时先记录各目标的线上版本, 有目标失败则把成功的目标回滚到该版本
+func runMultiDeploy(cfgs []*encode.ClientConfig, client *httpc.Client, pubdir string) {
+	ctx := context.Background()
+	results := make([]targetResult, len(cfgs))
+	hosts := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		hosts[i] = strings.TrimSuffix(cfg.ServerURL, "/nemu/upload")
+		results[i].Target = hosts[i]
+		cfg.OnEvent = serverEvents("server_", hosts[i])
+	}
+
+	// 任一目标无法查询时不开始部署, 以免之后无法回滚
+	if allOrNothing {
+		for i, cfg := range cfgs {
+			status, err := encode.Status(ctx, client, cfg)
+			if err != nil {
+				r.Fail(uploadExitCode(err), "获取 "+hosts[i]+" 的线上版本失败", err)
+			}
+			if status.Release != nil {
+				results[i].Previous = status.Release.ID
+			}
+		}
+	}
+
+	r.Event("upload_started", map[string]any{
+		"targets":        hosts,
+		"mode":           "stream",
+		"compression":    cfgs[0].Compression,
+		"meta":           cfgs[0].Meta,
+		"all_or_nothing": allOrNothing,
+	})
+	r.Println(fmt.Sprintf("同时部署到 %d 个目标", len(cfgs)))
+	start := time.Now()
+	failed := 0
+	for i, sent := range encode.SendStreamingMulti(ctx, client, cfgs) {
+		result := &results[i]
+		if sent.Err != nil {
+			failed++
+			result.Status, result.Error, result.err = "failed", sent.Err.Error(), sent.Err
+			continue
+		}
+		result.Status, result.BytesSent = "ok", sent.Result.BytesSent
+		var response struct {
+			Release string `json:"release"`
+		}
+		if json.Unmarshal(sent.Result.Response, &response) == nil {
+			result.Release = response.Release
+		}
+		result.URL = previewURL(cfgs[i], sent.Result.Response)
+	}
+	r.Event("upload_finished", map[string]any{
+		"targets":     len(cfgs),
+		"failed":      failed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+
+	if failed > 0 && allOrNothing {
+		rollbackTargets(ctx, client, cfgs, results)
+	}
+
+	printSummary(results)
+	if failed > 0 {
+		var err error
+		for _, result := range results {
+			if result.err != nil {
+				err = result.err
+				break
+			}
+		}
+		r.Fail(uploadExitCode(err), fmt.Sprintf("%d/%d 个目标部署失败", failed, len(cfgs)), nil)
+	}
+
+	r.Println("发送数据成功")
+	if delete {
+		if err := os.RemoveAll(pubdir); err != nil {
+			r.Fail(report.ExitLocal, "删除public目录失败", err)
+		}
+	}
+	r.Event("done", map[string]any{"exit": report.ExitOK})
+	os.Exit(report.ExitOK)
+}
+
+// rollbackTargets 把部署成功的目标回滚到部署前的版本
+// 部署前没有线上版本的目标无法回滚, 保留新版本并记录错误
+func rollbackTargets(ctx context.Context, client *httpc.Client, cfgs []*encode.ClientConfig, results []targetResult) {
+	for i, cfg := range cfgs {
+		result := &results[i]
+		if result.Status != "ok" {
+			continue
+		}
+		if result.Previous == "" {
+			result.Error = "no previous release to roll back to"
+			r.Event("target_rollback", map[string]any{"target": result.Target, "status": "failed", "error": result.Error})
+			fmt.Fprintf(os.Stderr, "[%s] 部署前没有线上版本, 无法回滚\n", result.Target)
+			continue
+		}
+		if _, err := encode.Rollback(ctx, client, cfg, result.Previous); err != nil {
+			result.Error = "rollback failed: " + err.Error()
+			r.Event("target_rollback", map[string]any{"target": result.Target, "status": "failed", "error": err.Error()})
+			fmt.Fprintf(os.Stderr, "[%s] 回滚失败: %v\n", result.Target, err)
+			continue
+		}
+		result.Status = "rolled_back"
+		r.Event("target_rollback", map[string]any{"target": result.Target, "status": "ok", "release": result.Previous})
+		r.Println(fmt.Sprintf("[%s] 已回滚到版本 %s", result.Target, result.Previous))
+	}
+}
+
+// printSummary 输出每个目标的结果
+func printSummary(results []targetResult) {
+	if r.JSON() {
+		r.Event("summary", map[string]any{"targets": results})
+		return
+	}
+	r.Println("部署结果:")
+	for _, result := range results {
+		switch result.Status {
+		case "ok":
+			line := fmt.Sprintf("  成功    %s  版本 %s, 发送 %s", result.Target, result.Release, formatBytes(result.BytesSent))
+			if result.URL != "" {
+				line = fmt.Sprintf("  成功    %s  预览 %s, 发送 %s", result.Target, result.URL, formatBytes(result.BytesSent))
+			}
+			if result.Error != "" {
+				line += " (" + result.Error + ")"
+			}
+			r.Println(line)
+		case "rolled_back":
+			r.Println(fmt.Sprintf("  已回滚  %s  版本 %s 已撤销, 恢复到 %s", result.Target, result.Release, result.Previous))
+		default:
+			r.Println(fmt.Sprintf("  失败    %s  %s", result.Target, result.Error))
+		}
+	}
+}
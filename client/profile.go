@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"nemu-client/credential"
+	"nemu-client/report"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runProfile nemu profile
+// 管理目标组, deploy --profile <名称> 会同时部署到组内的全部服务端
+func runProfile(args []string) {
+	var remote remoteOptions
+	fs := newFlagSet("profile", "set <名称> -h <host> [-h <host>...] | list | delete <名称>",
+		"管理目标组, nemu deploy --profile <名称> 同时部署到组内的全部服务端\n组内服务端的凭据使用 nemu login 保存的 Token")
+	remote.register(fs)
+
+	action, name := "", ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	r = remote.reporter()
+
+	store, err := credential.Load()
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取凭据失败", err)
+	}
+
+	switch action {
+	case "list", "":
+		names := make([]string, 0, len(store.Profiles))
+		for name := range store.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if r.JSON() {
+			r.Event("profiles", map[string]any{"profiles": store.Profiles})
+			return
+		}
+		if len(names) == 0 {
+			r.Println("没有保存的目标组")
+			return
+		}
+		for _, name := range names {
+			fmt.Printf("%s\t%s\n", name, strings.Join(store.Profiles[name], " "))
+		}
+		return
+	case "set", "delete":
+	default:
+		if !r.JSON() {
+			fs.Usage()
+		}
+		r.Fail(report.ExitUsage, "未知操作: "+action, nil)
+	}
+
+	if name == "" {
+		if !r.JSON() {
+			fs.Usage()
+		}
+		r.Fail(report.ExitUsage, "目标组名称不能为空", nil)
+	}
+
+	if action == "delete" {
+		if !store.DeleteProfile(name) {
+			r.Fail(report.ExitUsage, "没有名为 "+name+" 的目标组", nil)
+		}
+		if err := store.Save(); err != nil {
+			r.Fail(report.ExitLocal, "保存凭据失败", err)
+		}
+		r.Event("profile_deleted", map[string]any{"name": name})
+		r.Println("已删除目标组 " + name)
+		return
+	}
+
+	if len(remote.hosts) == 0 {
+		r.Fail(report.ExitUsage, "目标组至少需要一个 --host", nil)
+	}
+	var hosts []string
+	for _, host := range remote.hosts {
+		base := normalizeHost(host, remote.debug)
+		if _, _, ok := store.Get(base); !ok && !r.JSON() {
+			fmt.Fprintf(os.Stderr, "警告: 没有保存 %s 的凭据, 部署时需要 --password 或先执行 nemu login\n", base)
+		}
+		hosts = append(hosts, base)
+	}
+	store.Profiles[name] = hosts
+	if err := store.Save(); err != nil {
+		r.Fail(report.ExitLocal, "保存凭据失败", err)
+	}
+	r.Event("profile_saved", map[string]any{"name": name, "hosts": hosts})
+	r.Println(fmt.Sprintf("已保存目标组 %s: %s", name, strings.Join(hosts, " ")))
+}
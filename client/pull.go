@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-client/encode"
+	"nemu-client/report"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runPull nemu pull
+// 下载服务端的版本并还原到本地目录, 或原样保存归档, 用于备份与灾难恢复
+func runPull(args []string) {
+	var (
+		remote      remoteOptions
+		id          string
+		dir         string
+		archive     string
+		compression string
+		force       bool
+	)
+	fs := newFlagSet("pull", "[选项]", "下载服务端的版本, 还原到本地目录或保存为归档")
+	remote.register(fs)
+	fs.StringVar(&id, "release", "", "下载指定版本, 默认为线上版本")
+	fs.StringVar(&dir, "dir", "", "还原到该目录, 默认为版本 ID")
+	fs.StringVar(&archive, "archive", "", "不解压, 把归档保存到该文件")
+	fs.StringVar(&compression, "compress", "gzip", "归档的压缩格式 gzip / zstd")
+	fs.BoolVar(&force, "force", false, "目标目录或文件已存在时替换它")
+	fs.Parse(args)
+	r = remote.reporter()
+
+	if dir != "" && archive != "" {
+		r.Fail(report.ExitUsage, "--dir 不能与 --archive 同时使用", nil)
+	}
+	encoding, err := encode.NormalizeCompression(compression)
+	if err == nil && encoding == encode.CompressionNone {
+		err = fmt.Errorf("unsupported compression: %s (gzip, zstd)", compression)
+	}
+	if err != nil {
+		r.Fail(report.ExitUsage, "压缩参数无效", err)
+	}
+	cfg := remote.config(fs)
+	// 目标已知时在下载前检查
+	for _, target := range []string{dir, archive} {
+		if target == "" {
+			continue
+		}
+		if err := checkTarget(target, force); err != nil {
+			r.Fail(report.ExitLocal, "下载版本失败", err)
+		}
+	}
+
+	start := time.Now()
+	export, err := encode.ExportRelease(context.Background(), remote.httpClient(), cfg, id, encoding)
+	if err != nil {
+		r.Fail(uploadExitCode(err), "下载版本失败", err)
+	}
+	defer export.Body.Close()
+	r.Event("pull_started", map[string]any{"release": export.Release, "compression": encoding})
+
+	var (
+		entries int
+		target  string
+	)
+	if archive != "" {
+		target = archive
+		entries, err = saveArchive(export, archive, force)
+	} else {
+		target = dir
+		if target == "" {
+			target, err = releaseDir(export.Release)
+		}
+		if err == nil {
+			entries, err = restoreRelease(export, target, force)
+		}
+	}
+	if err != nil {
+		code := report.ExitLocal
+		if errors.Is(err, encode.ErrIncomplete) {
+			code = report.ExitNetwork
+		}
+		r.Fail(code, "下载版本失败", err)
+	}
+
+	r.Event("pull_finished", map[string]any{
+		"release":     export.Release,
+		"path":        target,
+		"entries":     entries,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	if archive != "" {
+		r.Println(fmt.Sprintf("已将版本 %s 保存到 %s (%d 个条目)", export.Release, target, entries))
+	} else {
+		r.Println(fmt.Sprintf("已将版本 %s 还原到 %s (%d 个条目)", export.Release, target, entries))
+	}
+}
+
+// releaseDir 返回未指定 --dir 时的还原目录, 即当前目录下以版本 ID 命名的目录
+// 版本 ID 来自服务端的 Nemu-Release 头部, 不能为空, 也不能包含路径分隔符或 "..", 以免 --force 替换当前目录之外的内容
+func releaseDir(id string) (string, error) {
+	if id == "" || id == "." || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") || filepath.Base(id) != id {
+		return "", fmt.Errorf("server returned an invalid release ID %q, use --dir to choose the target", id)
+	}
+	return id, nil
+}
+
+// checkTarget 目标已存在且未指定 --force 时返回错误
+func checkTarget(target string, force bool) error {
+	if _, err := os.Lstat(target); err == nil && !force {
+		return fmt.Errorf("%s already exists, use --force to replace it", target)
+	}
+	return nil
+}
+
+// saveArchive 把归档写入 path 旁的临时文件, 读完整个归档确认完整后再改名为 path
+func saveArchive(export *encode.Export, path string, force bool) (int, error) {
+	if err := checkTarget(path, force); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".pull-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	body := io.TeeReader(export.Body, tmp)
+	entries, err := encode.Extract(body, export.Compression, "")
+	if err == nil {
+		// 压缩流之后的剩余数据也原样保存
+		_, err = io.Copy(io.Discard, body)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return entries, err
+	}
+	return entries, os.Rename(tmp.Name(), path)
+}
+
+// restoreRelease 把归档解压到 dir 旁的临时目录, 完整解压后再替换 dir
+func restoreRelease(export *encode.Export, dir string, force bool) (int, error) {
+	if err := checkTarget(dir, force); err != nil {
+		return 0, err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dir)), "."+filepath.Base(dir)+".pull-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	entries, err := encode.Extract(export.Body, export.Compression, tmp)
+	if err != nil {
+		return entries, err
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return entries, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return entries, err
+	}
+	return entries, os.Rename(tmp, dir)
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestReleaseDir(t *testing.T) {
+	tests := []struct {
+		id string
+		ok bool
+	}{
+		{id: "20250101-000000-abcdef", ok: true},
+		{id: "", ok: false},
+		{id: ".", ok: false},
+		{id: "..", ok: false},
+		{id: "../site", ok: false},
+		{id: "a..b", ok: false},
+		{id: "/etc", ok: false},
+		{id: "nested/dir", ok: false},
+		{id: `..\site`, ok: false},
+	}
+	for _, tt := range tests {
+		dir, err := releaseDir(tt.id)
+		if (err == nil) != tt.ok {
+			t.Errorf("releaseDir(%q) = %q, %v", tt.id, dir, err)
+		}
+	}
+}
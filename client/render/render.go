@@ -1,16 +1,23 @@
 package render
 
 import (
+	"io"
 	"os"
 	"os/exec"
 )
 
 func HugoRender(dir string) error {
+	return HugoRenderTo(dir, os.Stdout)
+}
+
+// HugoRenderTo 与 HugoRender 相同, 但 hugo 的标准输出写入 stdout
+// JSON 输出模式下使用, 避免 hugo 的日志混入事件流
+func HugoRenderTo(dir string, stdout io.Writer) error {
 	// 调用 "hugo"命令生成public
 	// 将hugo执行后的输出回传到当前shell输出
 	cmd := exec.Command("hugo")
 	cmd.Dir = dir
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = stdout
 	cmd.Stderr = os.Stderr
 	err := cmd.Run()
 	if err != nil {
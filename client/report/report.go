@@ -0,0 +1,142 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 退出码, 供 CI 区分失败类型
+const (
+	ExitOK      = 0 // 成功
+	ExitUnknown = 1 // 未分类的错误
+	ExitUsage   = 2 // 参数错误 (缺少 host / 密码, 参数取值无效)
+	ExitLocal   = 3 // 本地环境错误 (工作目录, public 目录, 忽略规则)
+	ExitRender  = 4 // 渲染或服务端构建失败
+	ExitPackage = 5 // 打包失败
+	ExitNetwork = 6 // 网络错误 (连接失败, 超时, 重试耗尽)
+	ExitAuth    = 7 // 认证失败 (服务端返回 401)
+	ExitServer  = 8 // 服务端拒绝 (其他非 200 状态码)
+
+	ExitValidation = 9 // 站点校验未通过 (--validate error)
+)
+
+// 输出格式
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Reporter 输出进度与结果
+// text 模式输出给人看的中文提示; json 模式向 stdout 每行输出一个 JSON 事件 (NDJSON)
+type Reporter struct {
+	json bool
+	out  io.Writer
+	mu   sync.Mutex
+}
+
+// New 按输出格式创建 Reporter
+func New(format string) (*Reporter, error) {
+	switch format {
+	case "", FormatText:
+		return &Reporter{out: os.Stdout}, nil
+	case FormatJSON:
+		return &Reporter{json: true, out: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s (text, json)", format)
+	}
+}
+
+// JSON 是否为 json 输出模式
+func (r *Reporter) JSON() bool {
+	return r.json
+}
+
+// Stdout 返回子进程 (如 hugo) 应使用的标准输出
+// json 模式下重定向到 stderr, 保证 stdout 只有事件
+func (r *Reporter) Stdout() io.Writer {
+	if r.json {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Event 输出一个事件, text 模式下忽略
+func (r *Reporter) Event(name string, fields map[string]any) {
+	if !r.json {
+		return
+	}
+	event := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["event"] = name
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		data, _ = json.Marshal(map[string]any{"event": name, "marshal_error": err.Error()})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out.Write(append(data, '\n'))
+}
+
+// Println 输出给人看的提示, json 模式下忽略
+func (r *Reporter) Println(a ...any) {
+	if r.json {
+		return
+	}
+	fmt.Fprintln(r.out, a...)
+}
+
+// Fail 报告错误并以 code 退出
+// text 模式向 stderr 输出 msg 与 err; json 模式输出 error 事件
+func (r *Reporter) Fail(code int, msg string, err error) {
+	if r.json {
+		fields := map[string]any{
+			"code":    codeName(code),
+			"exit":    code,
+			"message": msg,
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		r.Event("error", fields)
+	} else {
+		fmt.Fprintln(os.Stderr, msg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}
+	os.Exit(code)
+}
+
+// codeName 返回退出码对应的稳定名称
+func codeName(code int) string {
+	switch code {
+	case ExitOK:
+		return "ok"
+	case ExitUsage:
+		return "usage"
+	case ExitLocal:
+		return "local"
+	case ExitRender:
+		return "render"
+	case ExitPackage:
+		return "package"
+	case ExitNetwork:
+		return "network"
+	case ExitAuth:
+		return "auth"
+	case ExitServer:
+		return "server"
+	case ExitValidation:
+		return "validation"
+	default:
+		return "unknown"
+	}
+}
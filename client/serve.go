@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"nemu-client/report"
+	"os"
+	"path/filepath"
+
+	"nemu-server/serve"
+
+	"github.com/fenthope/record"
+	"github.com/infinite-iroha/touka"
+)
+
+// runServe nemu serve
+// 使用与 nemu-server 相同的缓存头, 压缩与错误页面在本地预览渲染结果
+func runServe(args []string) {
+	var (
+		addr  string
+		dir   string
+		build bool
+	)
+	fs := newFlagSet("serve", "[选项]", "在本地预览 public 目录, 缓存头, 压缩与错误页面与 nemu-server 一致")
+	fs.StringVar(&addr, "addr", "127.0.0.1:8168", "监听地址")
+	fs.StringVar(&dir, "dir", "public", "站点目录")
+	fs.BoolVar(&build, "render", false, "启动前先执行 hugo 渲染")
+	fs.Parse(args)
+
+	remote := remoteOptions{}
+	r = remote.reporter()
+
+	if build {
+		cwd, err := os.Getwd()
+		if err != nil {
+			r.Fail(report.ExitLocal, "获取当前目录失败", err)
+		}
+		renderSite(cwd)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		r.Fail(report.ExitLocal, "获取站点目录失败", err)
+	}
+	if _, err := os.Stat(abs); err != nil {
+		r.Fail(report.ExitLocal, "站点目录不存在", err)
+	}
+
+	engine := touka.New()
+	engine.Use(touka.Recovery())
+	engine.Use(record.Middleware())
+	serve.Use(engine)
+	serve.Static(engine, abs)
+
+	fmt.Printf("预览 %s: http://%s/\n", abs, addr)
+	if err := engine.RunShutdown(addr); err != nil {
+		r.Fail(report.ExitLocal, "启动预览服务失败", err)
+	}
+}
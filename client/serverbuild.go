@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"nemu-client/encode"
+	"nemu-client/ignore"
+	"nemu-client/report"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// 上传源码时总是排除的路径: 版本库, 本地状态与本地渲染结果
+var sourceExcludes = []string{".git/", ".nemu/", "/public/"}
+
+// runServerBuild nemu deploy --server-build
+// 上传站点源码, 由服务端执行 build.command 构建并部署, 构建日志实时输出
+func runServerBuild(dir string, cfg *encode.ClientConfig, client *httpc.Client) {
+	matcher, err := loadSourceIgnore(dir)
+	if err != nil {
+		r.Fail(report.ExitLocal, "读取忽略规则失败", err)
+	}
+	cfg.SourcePath = dir
+	cfg.Ignore = matcher
+	cfg.OnEvent = serverEvents("build_", "")
+
+	r.Event("upload_started", map[string]any{
+		"url":         encode.BuildURL(cfg),
+		"mode":        "source",
+		"compression": cfg.Compression,
+		"meta":        cfg.Meta,
+	})
+	start := time.Now()
+	result, err := encode.SendSource(context.Background(), client, cfg)
+	if err != nil {
+		var statusErr *encode.StatusError
+		if errors.As(err, &statusErr) {
+			reportResponse(statusErr.StatusCode, statusErr.Body)
+			if statusErr.Stage == "build" {
+				r.Fail(report.ExitRender, "服务端构建失败", err)
+			}
+		}
+		r.Fail(uploadExitCode(err), "发送数据失败", err)
+	}
+	r.Event("upload_finished", map[string]any{
+		"bytes_sent":  result.BytesSent,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	reportResponse(http.StatusOK, result.Response)
+
+	r.Println("服务端构建并部署成功")
+	r.Event("done", map[string]any{"exit": report.ExitOK})
+	os.Exit(report.ExitOK)
+}
+
+// loadSourceIgnore 上传源码时的忽略规则: sourceExcludes, .gitignore, --exclude 与 --include
+// .nemuignore 针对渲染结果编写, 不用于源码
+func loadSourceIgnore(dir string) (*ignore.Matcher, error) {
+	matcher := ignore.New()
+	for _, pattern := range sourceExcludes {
+		if err := matcher.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	if err := matcher.AddFile(filepath.Join(dir, ".gitignore")); err != nil {
+		return nil, err
+	}
+	for _, pattern := range excludes {
+		if err := matcher.Add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range includes {
+		if err := matcher.Add("!" + pattern); err != nil {
+			return nil, err
+		}
+	}
+	return matcher, nil
+}
+
+// serverBuildConflicts 返回与 --server-build 冲突的参数
+func serverBuildConflicts() string {
+	var conflicts []string
+	if watchMode {
+		conflicts = append(conflicts, "--watch")
+	}
+	if chunked {
+		conflicts = append(conflicts, "--chunked")
+	}
+	if resume != "" {
+		conflicts = append(conflicts, "--resume")
+	}
+	if dryRun {
+		conflicts = append(conflicts, "--dry-run")
+	}
+	if list {
+		conflicts = append(conflicts, "--list")
+	}
+	if delete {
+		conflicts = append(conflicts, "--delete")
+	}
+	return strings.Join(conflicts, ", ")
+}
@@ -0,0 +1,381 @@
+package validate
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"nemu-client/ignore"
+
+	"golang.org/x/net/html"
+)
+
+// 问题类型
+const (
+	KindBrokenLink   = "broken-link"   // <a>/<iframe> 指向不存在的页面
+	KindMissingAsset = "missing-asset" // 图片, 脚本, 样式等资源不存在
+	KindOversized    = "oversized"     // 文件超过大小限制
+)
+
+// Options 校验选项
+type Options struct {
+	Root        string          // 站点目录, 即 public
+	Ignore      *ignore.Matcher // 不会上传的路径, 指向它们的链接同样视为失效
+	MaxFileSize int64           // 单个文件的大小上限, 单位字节, 0 表示不检查
+	BaseURL     string          // 站点地址, 指向该地址的绝对链接按站内链接检查, 可为空
+}
+
+// Issue 一个问题
+type Issue struct {
+	File   string `json:"file"`             // 相对 Root 的路径
+	Line   int    `json:"line,omitempty"`   // 所在行, 从 1 开始
+	Kind   string `json:"kind"`             // 问题类型
+	Target string `json:"target,omitempty"` // 链接目标
+	Size   int64  `json:"size,omitempty"`   // oversized 时的文件大小
+}
+
+func (i Issue) String() string {
+	location := i.File
+	if i.Line > 0 {
+		location = fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	switch i.Kind {
+	case KindBrokenLink:
+		return fmt.Sprintf("%s: 链接失效 %s", location, i.Target)
+	case KindMissingAsset:
+		return fmt.Sprintf("%s: 资源不存在 %s", location, i.Target)
+	case KindOversized:
+		return fmt.Sprintf("%s: 文件过大 (%d 字节)", location, i.Size)
+	default:
+		return fmt.Sprintf("%s: %s %s", location, i.Kind, i.Target)
+	}
+}
+
+// Report 校验结果
+type Report struct {
+	Files  int     `json:"files"`  // 检查的文件数量
+	Links  int     `json:"links"`  // 检查的站内链接数量
+	Issues []Issue `json:"issues"` // 按文件与行排序
+}
+
+// OK 是否没有任何问题
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// 资源类属性, 其余 (a, iframe, area) 为页面链接
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"iframe": {"src"},
+	"link":   {"href"},
+	"script": {"src"},
+	"img":    {"src", "srcset"},
+	"source": {"src", "srcset"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"track":  {"src"},
+	"embed":  {"src"},
+	"object": {"data"},
+	"input":  {"src"},
+	"image":  {"href", "xlink:href"},
+	"use":    {"href", "xlink:href"},
+}
+
+var pageTags = map[string]bool{"a": true, "area": true, "iframe": true}
+
+// CSS 中的 url(...) 与 @import "..."
+var cssURLPattern = regexp.MustCompile(`url\(\s*(?:'([^']*)'|"([^"]*)"|([^'")\s]*))\s*\)|@import\s+(?:'([^']*)'|"([^"]*)")`)
+
+type checker struct {
+	opts   Options
+	files  map[string]int64 // 将被上传的文件及其大小
+	dirs   map[string]bool
+	base   *url.URL
+	report *Report
+}
+
+// Run 校验 opts.Root 中的全部文件
+func Run(opts Options) (*Report, error) {
+	c := &checker{
+		opts:   opts,
+		files:  make(map[string]int64),
+		dirs:   map[string]bool{"": true},
+		report: &Report{Issues: []Issue{}},
+	}
+	if opts.BaseURL != "" {
+		base, err := url.Parse(opts.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base url %s: %w", opts.BaseURL, err)
+		}
+		c.base = base
+	}
+
+	// 先收集文件列表, 链接检查只需查表
+	err := filepath.WalkDir(opts.Root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(opts.Root, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if opts.Ignore.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			c.dirs[rel] = true
+			return nil
+		}
+		info, err := os.Stat(file) // 跟随软链接
+		if err != nil {
+			return nil // 失效的软链接不计入
+		}
+		c.files[rel] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.report.Files++
+		size := c.files[name]
+		if opts.MaxFileSize > 0 && size > opts.MaxFileSize {
+			c.report.Issues = append(c.report.Issues, Issue{File: name, Kind: KindOversized, Size: size})
+		}
+		switch strings.ToLower(path.Ext(name)) {
+		case ".html", ".htm":
+			if err := c.checkHTML(name); err != nil {
+				return nil, err
+			}
+		case ".css":
+			if err := c.checkCSS(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c.report, nil
+}
+
+func (c *checker) read(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(c.opts.Root, filepath.FromSlash(name)))
+}
+
+// checkHTML 检查页面中的链接, 资源与内联样式
+func (c *checker) checkHTML(name string) error {
+	data, err := c.read(name)
+	if err != nil {
+		return err
+	}
+	baseDir := path.Dir(name)
+	line := 1
+	z := html.NewTokenizer(bytes.NewReader(data))
+	inStyle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return nil // 到达末尾; 格式错误的 HTML 按已解析的部分检查
+		}
+		tokenLine := line
+		line += bytes.Count(z.Raw(), []byte("\n"))
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			tag := token.Data
+			if tag == "style" {
+				inStyle = tt == html.StartTagToken
+			}
+			if tag == "base" {
+				// <base href> 改变相对链接的基准, 只支持站内路径
+				for _, attr := range token.Attr {
+					if attr.Key == "href" {
+						if target, ok := c.internal(attr.Val, baseDir); ok {
+							baseDir = strings.TrimSuffix(target, "/")
+						}
+					}
+				}
+			}
+			kind := KindMissingAsset
+			if pageTags[tag] {
+				kind = KindBrokenLink
+			}
+			for _, attr := range token.Attr {
+				if attr.Key == "style" {
+					c.checkCSSText(name, baseDir, attr.Val, tokenLine)
+					continue
+				}
+				if !containsAttr(linkAttrs[tag], attr.Key) {
+					continue
+				}
+				// link 只检查样式表与图标等资源, 忽略 canonical/alternate 等指向页面的关系
+				if tag == "link" && !assetRel(token.Attr) {
+					continue
+				}
+				for _, ref := range refs(attr.Key, attr.Val) {
+					c.check(name, baseDir, ref, kind, tokenLine)
+				}
+			}
+		case html.EndTagToken:
+			if tagName, _ := z.TagName(); string(tagName) == "style" {
+				inStyle = false
+			}
+		case html.TextToken:
+			if inStyle {
+				c.checkCSSText(name, baseDir, string(z.Text()), tokenLine)
+			}
+		}
+	}
+}
+
+// checkCSS 检查样式表中的 url() 与 @import, 相对路径以样式表所在目录为基准
+func (c *checker) checkCSS(name string) error {
+	data, err := c.read(name)
+	if err != nil {
+		return err
+	}
+	c.checkCSSText(name, path.Dir(name), string(data), 1)
+	return nil
+}
+
+func (c *checker) checkCSSText(name, baseDir, text string, startLine int) {
+	for _, m := range cssURLPattern.FindAllStringSubmatchIndex(text, -1) {
+		ref := ""
+		for g := 1; g < len(m)/2; g++ {
+			if m[2*g] >= 0 && m[2*g+1] > m[2*g] {
+				ref = text[m[2*g]:m[2*g+1]]
+				break
+			}
+		}
+		line := startLine + strings.Count(text[:m[0]], "\n")
+		c.check(name, baseDir, ref, KindMissingAsset, line)
+	}
+}
+
+// check 检查一个引用, 站外链接直接跳过
+func (c *checker) check(name, baseDir, ref, kind string, line int) {
+	target, ok := c.internal(ref, baseDir)
+	if !ok {
+		return
+	}
+	c.report.Links++
+	if c.exists(target) {
+		return
+	}
+	c.report.Issues = append(c.report.Issues, Issue{File: name, Line: line, Kind: kind, Target: ref})
+}
+
+// internal 将站内引用解析为相对 Root 的路径, 站外链接, 锚点与特殊协议返回 false
+func (c *checker) internal(ref, baseDir string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.Contains(ref, "{{") {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme != "" || u.Host != "" {
+		// 指向本站的绝对链接按站内路径检查
+		if c.base == nil || !strings.EqualFold(u.Host, c.base.Host) || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+			return "", false
+		}
+	}
+	p := u.Path
+	if p == "" {
+		return "", false // 只有查询参数, 指向当前页面
+	}
+
+	var target string
+	if strings.HasPrefix(p, "/") {
+		// 站点部署在子路径下时, 去掉 BaseURL 中的路径前缀
+		if c.base != nil {
+			prefix := strings.TrimSuffix(c.base.Path, "/")
+			if prefix != "" && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+				p = strings.TrimPrefix(p, prefix)
+			}
+		}
+		target = path.Clean(p)
+	} else {
+		target = path.Clean(path.Join("/", baseDir, p))
+	}
+	target = strings.TrimPrefix(target, "/")
+	if strings.HasSuffix(p, "/") && target != "" {
+		target += "/"
+	}
+	return target, true
+}
+
+// exists 判断站内路径是否存在, 目录需要包含 index.html
+func (c *checker) exists(target string) bool {
+	clean := strings.TrimSuffix(target, "/")
+	if !strings.HasSuffix(target, "/") {
+		if _, ok := c.files[clean]; ok {
+			return true
+		}
+	}
+	if c.dirs[clean] {
+		_, ok := c.files[path.Join(clean, "index.html")]
+		return ok
+	}
+	return false
+}
+
+// refs 拆分 srcset 中的多个地址
+func refs(key, val string) []string {
+	if key != "srcset" {
+		return []string{val}
+	}
+	var list []string
+	for _, candidate := range strings.Split(val, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			list = append(list, fields[0])
+		}
+	}
+	return list
+}
+
+func containsAttr(attrs []string, key string) bool {
+	for _, attr := range attrs {
+		if attr == key {
+			return true
+		}
+	}
+	return false
+}
+
+// assetRel 判断 <link> 是否引用站点资源
+func assetRel(attrs []html.Attribute) bool {
+	for _, attr := range attrs {
+		if attr.Key != "rel" {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.ToLower(attr.Val)) {
+			switch rel {
+			case "stylesheet", "icon", "shortcut", "apple-touch-icon", "manifest", "preload", "modulepreload", "prefetch", "mask-icon":
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-client/encode"
+	"nemu-client/render"
+	"nemu-client/report"
+	"nemu-client/watch"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// runWatch nemu deploy --watch
+// 监视 Hugo 项目, 变化稳定后重新渲染并增量上传, 每轮输出一行状态
+func runWatch(dir string, cfg *encode.ClientConfig, client *httpc.Client) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	paths := watch.HugoPaths
+	if norender {
+		// 不渲染时由外部负责构建, 只监视输出目录
+		paths = []string{"public"}
+	}
+	w := &watch.Watcher{Root: dir, Paths: paths, Debounce: debounce}
+
+	r.Println(fmt.Sprintf("监视 %s, 按 Ctrl+C 退出", dir))
+	// 启动时先同步一次, 此时 public 已经渲染过
+	deployCycle(ctx, dir, cfg, client, nil)
+	err := w.Run(ctx, func(changed []string) {
+		deployCycle(ctx, dir, cfg, client, changed)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		r.Fail(report.ExitLocal, "监视失败", err)
+	}
+	r.Event("done", map[string]any{"exit": report.ExitOK})
+}
+
+// cycleResult 一轮 watch 的结果
+type cycleResult struct {
+	Changed   []string `json:"changed"`
+	Release   string   `json:"release,omitempty"`
+	Mode      string   `json:"mode,omitempty"` // incremental 或 full
+	Added     int      `json:"added"`
+	Modified  int      `json:"modified"`
+	Deleted   int      `json:"deleted"`
+	BytesSent int64    `json:"bytes_sent"`
+	Duration  int64    `json:"duration_ms"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// deployCycle 渲染, 比较差异并上传, 失败时只输出错误, 继续监视
+func deployCycle(ctx context.Context, dir string, cfg *encode.ClientConfig, client *httpc.Client, changed []string) {
+	start := time.Now()
+	result := cycleResult{Changed: changed}
+	stage, err := runCycle(ctx, dir, cfg, client, changed, &result)
+	result.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if r.JSON() {
+		fields := map[string]any{}
+		data, _ := json.Marshal(result)
+		json.Unmarshal(data, &fields)
+		r.Event("watch_cycle", fields)
+		return
+	}
+
+	stamp := time.Now().Format(time.TimeOnly)
+	switch {
+	case err != nil:
+		fmt.Printf("[%s] %s: %v\n", stamp, stage, err)
+	case result.Mode == "":
+		fmt.Printf("[%s] 无变化 (%s)\n", stamp, time.Duration(result.Duration)*time.Millisecond)
+	default:
+		fmt.Printf("[%s] 已部署 %s: +%d ~%d -%d, 发送 %s, %s%s\n", stamp, result.Release,
+			result.Added, result.Modified, result.Deleted, formatBytes(result.BytesSent),
+			time.Duration(result.Duration)*time.Millisecond, modeSuffix(result.Mode))
+	}
+}
+
+// runCycle 执行一轮部署, 出错时返回出错的阶段
+func runCycle(ctx context.Context, dir string, cfg *encode.ClientConfig, client *httpc.Client, changed []string, result *cycleResult) (string, error) {
+	if changed != nil {
+		cfg.Meta = deployMeta(dir)
+	}
+	if changed != nil && !norender {
+		// hugo 的输出每轮都相同, 只保留 stderr 上的错误信息
+		if err := render.HugoRenderTo(dir, io.Discard); err != nil {
+			return "渲染失败", err
+		}
+	}
+
+	if checks.enabled() {
+		result, err := checks.run(cfg.SourcePath, cfg.Ignore)
+		if err != nil {
+			return "校验失败", err
+		}
+		if !result.OK() && checks.mode == validateError {
+			return "校验未通过", fmt.Errorf("%d 个问题", len(result.Issues))
+		}
+	}
+
+	preview, err := encode.Preview(ctx, client, cfg)
+	if err != nil {
+		return "获取差异失败", err
+	}
+	delta := encode.NewDelta(preview)
+	if delta.Empty() {
+		return "", nil
+	}
+	result.Added, result.Modified, result.Deleted = len(preview.Added), len(preview.Modified), len(preview.Deleted)
+
+	var upload *encode.UploadResult
+	result.Mode = "incremental"
+	if delta.Base != "" {
+		upload, err = encode.SendIncremental(ctx, client, cfg, delta)
+	}
+	if delta.Base == "" || errors.Is(err, encode.ErrBaseChanged) {
+		// 服务端尚无版本, 或比较后线上版本已变化, 改为完整上传
+		result.Mode = "full"
+		upload, err = encode.SendStreamingTarGz(ctx, client, cfg)
+	}
+	if err != nil {
+		return "上传失败", err
+	}
+
+	result.BytesSent = upload.BytesSent
+	var response struct {
+		Release string `json:"release"`
+	}
+	json.Unmarshal(upload.Response, &response)
+	result.Release = response.Release
+	return "", nil
+}
+
+func modeSuffix(mode string) string {
+	if mode == "full" {
+		return " (完整上传)"
+	}
+	return ""
+}
+
+// watchConflicts 返回与 --watch 不能同时使用的参数
+func watchConflicts() string {
+	var conflicts []string
+	if chunked {
+		conflicts = append(conflicts, "--chunked")
+	}
+	if resume != "" {
+		conflicts = append(conflicts, "--resume")
+	}
+	if dryRun {
+		conflicts = append(conflicts, "--dry-run")
+	}
+	if list {
+		conflicts = append(conflicts, "--list")
+	}
+	if delete {
+		conflicts = append(conflicts, "--delete")
+	}
+	return strings.Join(conflicts, ", ")
+}
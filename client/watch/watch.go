@@ -0,0 +1,149 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultDebounce 最后一次变化后等待的时间, 编辑器保存时往往连续触发多个事件
+const DefaultDebounce = 500 * time.Millisecond
+
+// HugoPaths Hugo 项目中会影响渲染结果的路径, 不存在的路径会被忽略
+var HugoPaths = []string{
+	"content", "layouts", "static", "assets", "data", "i18n", "archetypes", "themes", "config",
+	"hugo.toml", "hugo.yaml", "hugo.json", "config.toml", "config.yaml", "config.json",
+}
+
+// Watcher 递归监视目录与文件, 合并短时间内的连续变化
+type Watcher struct {
+	Root     string        // 项目根目录, Paths 相对于它
+	Paths    []string      // 需要监视的目录或文件
+	Debounce time.Duration // 为 0 时使用 DefaultDebounce
+
+	fsw *fsnotify.Watcher
+}
+
+// Run 开始监视, 每当一批变化稳定后以变化的相对路径调用 fn, 直到 ctx 结束
+// fn 执行期间发生的变化会在 fn 返回后触发下一次调用
+func (w *Watcher) Run(ctx context.Context, fn func(changed []string)) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	defer fsw.Close()
+	w.fsw = fsw
+
+	watched := 0
+	for _, p := range w.Paths {
+		full := filepath.Join(w.Root, p)
+		info, err := os.Stat(full)
+		if err != nil {
+			continue
+		}
+		if info.IsDir() {
+			err = w.addTree(full)
+		} else {
+			// 直接监视文件时, 编辑器以 rename 方式保存会使监视失效, 因此监视其所在目录
+			err = fsw.Add(filepath.Dir(full))
+		}
+		if err != nil {
+			return err
+		}
+		watched++
+	}
+	if watched == 0 {
+		return fmt.Errorf("nothing to watch in %s", w.Root)
+	}
+
+	debounce := w.Debounce
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	pending := make(map[string]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			rel, relevant := w.relevant(event.Name)
+			if !relevant {
+				continue
+			}
+			// 新建的目录需要加入监视
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					w.addTree(event.Name)
+				}
+			}
+			pending[rel] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			return fmt.Errorf("watch error: %w", err)
+
+		case <-timer.C:
+			changed := make([]string, 0, len(pending))
+			for rel := range pending {
+				changed = append(changed, rel)
+			}
+			sort.Strings(changed)
+			clear(pending)
+			fn(changed)
+		}
+	}
+}
+
+// addTree 监视目录及其全部子目录
+func (w *Watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // 遍历时被删除的目录直接跳过
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if err := w.fsw.Add(file); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", file, err)
+		}
+		return nil
+	})
+}
+
+// relevant 判断变化是否位于监视的路径内, 返回相对 Root 的路径
+// 编辑器的临时文件 (.swp, ~ 结尾, .# 开头, vim 写入前创建的 4913) 不会触发重新部署
+func (w *Watcher) relevant(name string) (string, bool) {
+	rel, err := filepath.Rel(w.Root, name)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(name)
+	if strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".swp") || strings.HasSuffix(base, ".swx") ||
+		strings.HasPrefix(base, ".#") || base == "4913" {
+		return "", false
+	}
+	for _, p := range w.Paths {
+		p = filepath.ToSlash(filepath.Clean(p))
+		if rel == p || strings.HasPrefix(rel, p+"/") {
+			return rel, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"nemu-server/config"
+	"net/http"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// DefaultName server.token 的名称
+const DefaultName = "default"
+
+// 请求上下文中保存 Token 名称与是否为节点 Token 的键
+const (
+	tokenKey = "nemu.token"
+	peerKey  = "nemu.peer"
+)
+
+// Middleware 校验 Nemu-Token 头部, 用于保护 /nemu/* 下的管理接口
+// 除 server.token 外也接受 [[tokens]] 中的具名 Token, 通过 TokenName 获取使用的 Token 名称
+// 携带 [[tls.clients]] 中的客户端证书时以证书认证, 名称为对应的部署身份; 开启 tls.requireClientCert 时不再接受 Token
+func Middleware(cfg *config.Config) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		name, subject, verified := certIdentity(cfg, c.Request)
+		if name != "" {
+			c.Set(tokenKey, name)
+			c.Next()
+			return
+		}
+		if cfg.TLS.RequireClientCert {
+			message := "Client certificate required"
+			if verified {
+				message = "Client certificate is not mapped to a deploy identity"
+				c.Errorf("Client certificate %s is not in [[tls.clients]]", subject)
+			} else {
+				c.Errorf("Client certificate required")
+			}
+			c.JSON(http.StatusForbidden, touka.H{"message": message})
+			c.Abort()
+			return
+		}
+
+		inputToken := c.GetReqHeader("Nemu-Token")
+		name, peer, ok := lookup(cfg, inputToken)
+		if !ok {
+			c.Errorf("Invalid token")
+			c.JSON(http.StatusUnauthorized, touka.H{
+				"message": "Unauthorized",
+			})
+			c.Abort()
+			return
+		}
+		c.Set(tokenKey, name)
+		if peer {
+			c.Set(peerKey, true)
+		}
+		c.Next()
+	}
+}
+
+// TokenName 返回请求使用的 Token 名称, 未经过 Middleware 时为空
+func TokenName(c *touka.Context) string {
+	if name, ok := c.Get(tokenKey); ok {
+		if s, ok := name.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// IsPeer 返回请求是否以 [[tokens]] 中 peer = true 的 Token 认证, 只有这样的上传可以携带 Nemu-Origin
+func IsPeer(c *touka.Context) bool {
+	peer, _ := c.Get(peerKey)
+	return peer == true
+}
+
+func lookup(cfg *config.Config, inputToken string) (name string, peer bool, ok bool) {
+	if inputToken == cfg.Server.Token {
+		return DefaultName, false, true
+	}
+	for _, token := range cfg.Tokens {
+		if token.Token != "" && inputToken == token.Token {
+			return token.Name, token.Peer, true
+		}
+	}
+	return "", false, false
+}
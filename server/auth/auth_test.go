@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"encoding/json"
+	"nemu-server/config"
+	"net/http"
+	"testing"
+
+	"github.com/infinite-iroha/touka"
+)
+
+func TestMiddlewarePeerTokens(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Token = "default-token"
+	cfg.Tokens = []config.TokenConfig{
+		{Name: "ci", Token: "ci-token"},
+		{Name: "primary", Token: "peer-token", Peer: true},
+	}
+	r := touka.New()
+	r.GET("/nemu/status", Middleware(cfg), func(c *touka.Context) {
+		c.JSON(http.StatusOK, touka.H{"name": TokenName(c), "peer": IsPeer(c)})
+	})
+
+	tests := []struct {
+		token  string
+		status int
+		name   string
+		peer   bool
+	}{
+		{token: "default-token", status: http.StatusOK, name: DefaultName},
+		{token: "ci-token", status: http.StatusOK, name: "ci"},
+		{token: "peer-token", status: http.StatusOK, name: "primary", peer: true},
+		{token: "wrong", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			w := touka.PerformRequest(r, http.MethodGet, "/nemu/status", nil, http.Header{"Nemu-Token": {tt.token}})
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				Name string `json:"name"`
+				Peer bool   `json:"peer"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != tt.name || got.Peer != tt.peer {
+				t.Fatalf("identity = %+v, want name %s peer %v", got, tt.name, tt.peer)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"nemu-server/config"
+	"net/http"
+	"os"
+)
+
+// ServerTLS 按 [tls] 创建 HTTPS 配置, 未配置证书时返回 nil
+// 配置了 clientCA 时请求可以携带该 CA 签发的客户端证书, 不携带证书的请求仍可访问站点
+func ServerTLS(cfg *config.Config) (*tls.Config, error) {
+	t := cfg.TLS
+	if t.Cert == "" {
+		if t.ClientCA != "" || t.RequireClientCert {
+			return nil, errors.New("tls.clientCA and tls.requireClientCert need tls.cert and tls.key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls.cert/tls.key: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.ClientCA == "" {
+		if t.RequireClientCert {
+			return nil, errors.New("tls.requireClientCert needs tls.clientCA")
+		}
+		return tlsCfg, nil
+	}
+	pem, err := os.ReadFile(t.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls.clientCA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in tls.clientCA %s", t.ClientCA)
+	}
+	for _, client := range t.Clients {
+		if client.Subject == "" || client.Name == "" {
+			return nil, errors.New("[[tls.clients]] needs both subject and name")
+		}
+	}
+	tlsCfg.ClientCAs = pool
+	// 证书在握手时校验, 是否需要证书由 Middleware 按路由决定
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsCfg, nil
+}
+
+// certIdentity 返回请求的客户端证书在 [[tls.clients]] 中的名称
+// 没有经过校验的客户端证书时 verified 为 false
+func certIdentity(cfg *config.Config, r *http.Request) (name string, subject string, verified bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", "", false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	subject = leaf.Subject.String()
+	for _, client := range cfg.TLS.Clients {
+		if client.Subject == subject || client.Subject == "CN="+leaf.Subject.CommonName {
+			return client.Name, subject, true
+		}
+	}
+	return "", subject, true
+}
@@ -0,0 +1,172 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// 替换文件时使用的临时文件后缀
+const tmpSuffix = ".nemu-blob"
+
+// ErrUnsupported 平台无法读取文件的硬链接数量, 不能判断对象是否仍被引用, 因此不去重也不回收
+var ErrUnsupported = errors.New("deduplication needs hard link counts, which are not available on this platform; set release.dedupe = false")
+
+// Store 内容寻址的文件存储, 对象按内容的 sha256 保存在 <dir>/<前两位>/<其余部分>
+// 版本目录中的文件是对象的硬链接, 内容相同的文件在所有版本中只占用一份磁盘空间
+//
+// 对象与版本中的文件共享 inode, 因此任何一方都不能原地修改, 只能删除后重新创建;
+// 修改时间同样保存在 inode 中, 复用对象时取两者中较晚的时间, Last-Modified 不会早于文件实际的修改时间;
+// 对象的链接数为 1 时说明已没有版本引用它, 由 GC 删除
+type Store struct {
+	dir string
+}
+
+// Stats Link 的结果
+type Stats struct {
+	Files  int   // 检查的新文件数量
+	Reused int   // 替换为已有对象的文件数量
+	Saved  int64 // 因此节省的字节数
+}
+
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) path(sum string) string {
+	return filepath.Join(s.dir, sum[:2], sum[2:])
+}
+
+// Link 将 root 下新写入的普通文件 (链接数为 1) 加入存储
+// 已有相同内容与权限的对象时, 文件被替换为该对象的硬链接; 否则文件本身成为新的对象
+// 链接数大于 1 的文件已与其他版本共享 (例如增量部署从基准版本复制而来), 不再处理
+func (s *Store) Link(root string) (Stats, error) {
+	var stats Stats
+	if !Supported {
+		return stats, ErrUnsupported
+	}
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if links(info) != 1 {
+			return nil
+		}
+		stats.Files++
+		reused, err := s.link(file, info)
+		if err != nil {
+			return err
+		}
+		if reused {
+			stats.Reused++
+			stats.Saved += info.Size()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// link 处理一个文件, 返回是否复用了已有对象
+func (s *Store) link(file string, info fs.FileInfo) (bool, error) {
+	sum, err := hashFile(file)
+	if err != nil {
+		return false, err
+	}
+	object := s.path(sum)
+
+	existing, err := os.Lstat(object)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Link(file, object); err != nil && !errors.Is(err, fs.ErrExist) {
+			return false, err
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// 权限保存在 inode 中, 权限不同的文件不能共享对象
+	if existing.Mode() != info.Mode() {
+		return false, nil
+	}
+
+	tmp := file + tmpSuffix
+	os.Remove(tmp)
+	if err := os.Link(object, tmp); err != nil {
+		// 例如超出文件系统的链接数上限, 保留原文件
+		return false, nil
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	// 内容回到旧版本时对象的修改时间早于新文件, 沿用旧时间会使缓存按 If-Modified-Since 继续使用中间版本的内容
+	if mtime := info.ModTime(); mtime.After(existing.ModTime()) {
+		if err := os.Chtimes(object, mtime, mtime); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// GC 删除不再被任何版本引用的对象, 返回删除的数量与字节数
+func (s *Store) GC() (int, int64, error) {
+	var (
+		removed int
+		freed   int64
+	)
+	if !Supported {
+		return 0, 0, ErrUnsupported
+	}
+	err := filepath.WalkDir(s.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // 已被删除
+		}
+		if links(info) != 1 {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
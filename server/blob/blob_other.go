@@ -0,0 +1,13 @@
+//go:build !unix
+
+package blob
+
+import "io/fs"
+
+// Supported 当前平台是否支持去重与回收
+const Supported = false
+
+// links 无法获取硬链接数量, Link 与 GC 在调用前已返回 ErrUnsupported
+func links(info fs.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,67 @@
+package blob
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// release 创建版本目录 root/<id>, 其中 index.html 的内容与修改时间为 body 与 mtime
+func release(t *testing.T, root, id, body string, mtime time.Time) string {
+	t.Helper()
+	file := filepath.Join(root, id, "index.html")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func modTime(t *testing.T, file string) time.Time {
+	t.Helper()
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.ModTime()
+}
+
+func TestLinkKeepsLatestModTime(t *testing.T) {
+	root := t.TempDir()
+	s := New(filepath.Join(root, "objects"))
+	t1 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2, t3 := t1.Add(time.Hour), t1.Add(2*time.Hour)
+
+	// A -> B -> A: 第三个版本复用第一个版本的对象
+	a := release(t, root, "1", "A", t1)
+	release(t, root, "2", "B", t2)
+	a2 := release(t, root, "3", "A", t3)
+	for _, id := range []string{"1", "2", "3"} {
+		if _, err := s.Link(filepath.Join(root, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := modTime(t, a2); !got.Equal(t3) {
+		t.Fatalf("mtime of reused file = %v, want %v", got, t3)
+	}
+	a1, _ := os.Stat(a)
+	reused, _ := os.Stat(a2)
+	if !os.SameFile(a1, reused) {
+		t.Fatal("identical content was not shared")
+	}
+
+	// 修改时间更早的相同内容不会把共享文件的时间改回去
+	older := release(t, root, "4", "A", t1)
+	if _, err := s.Link(filepath.Join(root, "4")); err != nil {
+		t.Fatal(err)
+	}
+	if got := modTime(t, older); !got.Equal(t3) {
+		t.Fatalf("mtime moved back to %v, want %v", got, t3)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package blob
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Supported 当前平台是否支持去重与回收
+const Supported = true
+
+// links 返回文件的硬链接数量, 无法获取时返回 0, 此时既不去重也不回收
+func links(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 0
+}
@@ -0,0 +1,447 @@
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/auth"
+	"nemu-server/config"
+	"nemu-server/decode"
+	"nemu-server/hooks"
+	"nemu-server/notify"
+	"nemu-server/progress"
+	"nemu-server/release"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenthope/reco"
+	"github.com/infinite-iroha/touka"
+)
+
+// 构建状态
+const (
+	StateIdle      = "idle"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// 构建日志最多保留的字节数
+const maxLog = 16 << 10
+
+var (
+	// ErrNoOutput 构建命令没有生成结果目录
+	ErrNoOutput = errors.New("build produced no output")
+	// ErrBuildFailed 构建命令失败或超时
+	ErrBuildFailed = errors.New("build failed")
+	// ErrSourceTooLarge 上传的源码超过 build.maxSourceSize
+	ErrSourceTooLarge = errors.New("source tree too large")
+	// ErrNoRepo 未配置 build.repo, 无法从仓库构建
+	ErrNoRepo = errors.New("build.repo is not configured")
+	// ErrNoSandbox 未配置 build.sandbox 时拒绝上传源码构建, 除非开启 build.allowUnsandboxed
+	ErrNoSandbox = errors.New("source builds require build.sandbox, or build.allowUnsandboxed to run them without one")
+	// ErrSigningRequired signing.require 开启时拒绝服务端构建, 构建结果没有部署者的签名
+	ErrSigningRequired = errors.New("server builds are refused while signing.require is set, deploy a signed archive instead")
+)
+
+// 传给构建命令的环境变量, 其余变量 (例如服务端的凭据) 不会传递
+var passEnv = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_ALL", "TZ", "TMPDIR",
+	"HUGO_CACHEDIR", "GOPATH", "GOMODCACHE", "GOPROXY", "NODE_PATH",
+}
+
+// Status 最近一次构建的状态
+type Status struct {
+	State    string    `json:"state"`
+	Trigger  string    `json:"trigger,omitempty"` // 触发来源, 例如 webhook:github 或 token 名称
+	Commit   string    `json:"commit,omitempty"`  // 构建的 commit
+	Started  time.Time `json:"started,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+	Release  string    `json:"release,omitempty"` // 成功时部署的版本
+	Error    string    `json:"error,omitempty"`   // 失败原因
+	Log      string    `json:"log,omitempty"`     // git 与构建命令输出的末尾部分
+	Pending  bool      `json:"pending,omitempty"` // 构建期间收到新的触发, 完成后会再构建一次
+}
+
+// Builder 拉取站点仓库或接收上传的源码, 执行构建命令, 并通过 release.Manager 部署构建结果
+// 同一时间只执行一个构建命令; 仓库构建期间的多次触发合并为一次后续构建
+type Builder struct {
+	cfg      *config.Config
+	releases *release.Manager
+	notifier *notify.Notifier
+	log      *reco.Logger
+
+	buildMu sync.Mutex // 构建命令的执行权, 仓库构建与上传源码构建共用
+
+	mu      sync.Mutex
+	running bool
+	pending string // 等待中的触发来源, 为空表示没有
+	status  Status
+}
+
+func NewBuilder(cfg *config.Config, releases *release.Manager, notifier *notify.Notifier, log *reco.Logger) *Builder {
+	return &Builder{
+		cfg:      cfg,
+		releases: releases,
+		notifier: notifier,
+		log:      log,
+		status:   Status{State: StateIdle},
+	}
+}
+
+// Trigger 请求一次仓库构建, 已有构建在进行时排队, 返回是否排队
+func (b *Builder) Trigger(trigger string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		b.pending = trigger
+		b.status.Pending = true
+		return true
+	}
+	b.running = true
+	go b.loop(trigger)
+	return false
+}
+
+// Status 返回最近一次构建的状态
+func (b *Builder) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+func (b *Builder) loop(trigger string) {
+	for {
+		b.run(trigger)
+
+		b.mu.Lock()
+		if b.pending == "" {
+			b.running = false
+			b.mu.Unlock()
+			return
+		}
+		trigger = b.pending
+		b.pending = ""
+		b.mu.Unlock()
+	}
+}
+
+// run 执行一次构建并部署, 结果记录在 status 中并发送通知
+func (b *Builder) run(trigger string) {
+	start := time.Now()
+	out := hooks.NewTailBuffer(maxLog)
+	b.setStatus(Status{State: StateRunning, Trigger: trigger, Started: start})
+	b.log.Infof("Build triggered by %s", trigger)
+
+	rel, meta, err := b.build(out)
+
+	status := Status{State: StateSucceeded, Trigger: trigger, Commit: meta.Commit, Started: start, Finished: time.Now(), Log: out.String()}
+	if err != nil {
+		status.State = StateFailed
+		status.Error = err.Error()
+		b.log.Errorf("Build triggered by %s failed: %v", trigger, err)
+	} else {
+		status.Release = rel.ID
+		b.log.Infof("Build of %s activated release %s", meta.Commit, rel.ID)
+	}
+	b.setStatus(status)
+
+	payload := notify.DeployPayload(rel, err)
+	payload.Token = trigger
+	payload.Duration = time.Since(start).Milliseconds()
+	payload.SetMeta(meta)
+	b.notifier.Send(payload)
+}
+
+func (b *Builder) setStatus(status Status) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status.Pending = b.pending != ""
+	b.status = status
+}
+
+// build 更新工作目录, 执行构建命令, 部署结果目录
+func (b *Builder) build(out io.Writer) (*release.Release, release.Meta, error) {
+	cfg := b.cfg.Build
+	ctx, cancel := b.context()
+	defer cancel()
+
+	b.buildMu.Lock()
+	defer b.buildMu.Unlock()
+
+	if err := b.checkout(ctx, out); err != nil {
+		return nil, release.Meta{}, fmt.Errorf("checkout failed: %w", err)
+	}
+	meta := b.meta(ctx)
+
+	output, err := b.runCommand(ctx, cfg.Dir, meta, out)
+	if err != nil {
+		return nil, meta, err
+	}
+	rel, err := b.releases.Deploy("", meta, nil, func(dir string) (int, error) {
+		return copyTree(output, dir)
+	})
+	return rel, meta, err
+}
+
+// BuildSource 解压上传的源码到临时目录, 执行构建命令并部署结果, 构建日志写入 stream
+// 源码与构建结果在返回前删除
+func (b *Builder) BuildSource(c *touka.Context, body io.Reader, encoding string, meta release.Meta, stream *progress.Stream) (*release.Release, error) {
+	start := time.Now()
+	rel, err := b.buildSource(c, body, encoding, meta, stream)
+
+	payload := notify.DeployPayload(rel, err)
+	payload.Token = auth.TokenName(c)
+	payload.Duration = time.Since(start).Milliseconds()
+	payload.SetMeta(meta.Clean())
+	b.notifier.Send(payload)
+	return rel, err
+}
+
+func (b *Builder) buildSource(c *touka.Context, body io.Reader, encoding string, meta release.Meta, stream *progress.Stream) (*release.Release, error) {
+	dir, err := os.MkdirTemp("", "nemu-build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// 读完请求体之前无法开始响应, 解压期间的警告缓存到解压完成后发送
+	stream.Hold()
+	reader, err := decode.NewDecompressor(encoding, body)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	limit := int64(b.cfg.Build.MaxSourceSize) << 20
+	if limit > 0 {
+		reader = &limitedReader{ReadCloser: reader, remaining: limit}
+	}
+	entries, err := decode.ExtractTar(c, tar.NewReader(reader), dir)
+	if err == nil && entries == 0 {
+		err = release.ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 读完归档之后的填充, 之后才能开始响应
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
+	}
+	stream.Resume()
+	stream.Event("received", map[string]any{"entries": entries})
+
+	if !b.buildMu.TryLock() {
+		stream.Event("waiting", map[string]any{"message": "another build is running"})
+		b.buildMu.Lock()
+	}
+	defer b.buildMu.Unlock()
+
+	ctx, cancel := b.context()
+	defer cancel()
+	log := stream.LogWriter(nil)
+	defer log.Close()
+	output, err := b.runCommand(ctx, dir, meta, log)
+	if err != nil {
+		return nil, err
+	}
+	log.Close()
+
+	return b.releases.Deploy("", meta, stream, func(dst string) (int, error) {
+		stream.Event("deploying", nil)
+		return copyTree(output, dst)
+	})
+}
+
+// context 返回带 build.timeout 超时的 context
+func (b *Builder) context() (context.Context, context.CancelFunc) {
+	if b.cfg.Build.Timeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(b.cfg.Build.Timeout)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// runCommand 在 dir 中执行构建命令, 返回结果目录
+// 命令只能读取 passEnv 与 build.env 中的环境变量; 配置 build.sandbox 时由沙箱程序启动
+func (b *Builder) runCommand(ctx context.Context, dir string, meta release.Meta, out io.Writer) (string, error) {
+	cfg := b.cfg.Build
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	// 删除上次的结果, 避免已删除的页面残留在新版本中
+	output := filepath.Join(abs, cfg.Output)
+	if err := os.RemoveAll(output); err != nil {
+		return "", err
+	}
+
+	args := make([]string, 0, len(cfg.Sandbox)+3)
+	for _, arg := range cfg.Sandbox {
+		args = append(args, strings.ReplaceAll(arg, "{dir}", abs))
+	}
+	args = append(args, "sh", "-c", cfg.Command)
+
+	fmt.Fprintf(out, "$ %s\n", cfg.Command)
+	cmd := hooks.Command(ctx, args[0], args[1:]...)
+	cmd.Dir = abs
+	cmd.Env = buildEnv(cfg.Env, meta)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%w: timed out after %ds", ErrBuildFailed, cfg.Timeout)
+		}
+		return "", fmt.Errorf("%w: %v", ErrBuildFailed, err)
+	}
+	if info, err := os.Stat(output); err != nil || !info.IsDir() {
+		return "", ErrNoOutput
+	}
+	return output, nil
+}
+
+func buildEnv(extra []string, meta release.Meta) []string {
+	var env []string
+	for _, key := range passEnv {
+		if v, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	env = append(env, extra...)
+	return append(env, "NEMU_GIT_COMMIT="+meta.Commit, "NEMU_GIT_BRANCH="+meta.Branch)
+}
+
+// limitedReader 读取超过 remaining 字节时返回 ErrSourceTooLarge
+type limitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, ErrSourceTooLarge
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// checkout 首次构建时克隆仓库, 之后拉取并强制切换到远程分支的最新 commit
+func (b *Builder) checkout(ctx context.Context, out io.Writer) error {
+	cfg := b.cfg.Build
+	if _, err := os.Stat(filepath.Join(cfg.Dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Clean(cfg.Dir)), 0755); err != nil {
+			return err
+		}
+		return b.git(ctx, out, "", "clone", "--recurse-submodules", "--branch", cfg.Branch, cfg.Repo, cfg.Dir)
+	}
+
+	steps := [][]string{
+		{"remote", "set-url", "origin", cfg.Repo},
+		{"fetch", "--prune", "origin", cfg.Branch},
+		{"checkout", "--force", "-B", cfg.Branch, "FETCH_HEAD"},
+		{"clean", "-fd"},
+		{"submodule", "update", "--init", "--recursive", "--force"},
+	}
+	for _, args := range steps {
+		if err := b.git(ctx, out, cfg.Dir, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// meta 读取当前 commit 作为版本信息, commit 说明的第一行作为部署说明
+func (b *Builder) meta(ctx context.Context) release.Meta {
+	var meta release.Meta
+	if out, err := b.output(ctx, "log", "-1", "--format=%H%n%an <%ae>%n%s"); err == nil {
+		lines := strings.SplitN(out, "\n", 3)
+		for len(lines) < 3 {
+			lines = append(lines, "")
+		}
+		meta.Commit, meta.Author, meta.Message = lines[0], lines[1], lines[2]
+	}
+	meta.Branch = b.cfg.Build.Branch
+	return meta.Clean()
+}
+
+func (b *Builder) git(ctx context.Context, out io.Writer, dir string, args ...string) error {
+	fmt.Fprintf(out, "$ git %s\n", strings.Join(args, " "))
+	cmd := hooks.Command(ctx, "git", args...)
+	cmd.Dir = dir
+	// 不从终端读取凭据, 私有仓库需预先配置 SSH key 或凭据助手
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+func (b *Builder) output(ctx context.Context, args ...string) (string, error) {
+	cmd := hooks.Command(ctx, "git", args...)
+	cmd.Dir = b.cfg.Build.Dir
+	data, err := cmd.Output()
+	return strings.TrimSpace(string(data)), err
+}
+
+// copyTree 将构建结果复制到版本目录, 返回复制的条目数量
+// 构建命令不受信任, 结果中的软链接与解压上传的归档一样检查, 不能指向版本目录之外
+func copyTree(src, dst string) (int, error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return 0, err
+	}
+	entries := 0
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(file); err == nil {
+				if err = decode.CheckLinkname(dst, target, link); err == nil {
+					err = os.Symlink(link, target)
+				}
+			}
+		case info.Mode().IsRegular():
+			err = copyFile(file, target, info.Mode().Perm())
+		default:
+			return nil
+		}
+		if err == nil {
+			entries++
+		}
+		return err
+	})
+	return entries, err
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
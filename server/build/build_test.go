@@ -0,0 +1,61 @@
+package build
+
+import (
+	"errors"
+	"nemu-server/decode"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTreeRejectsEscapingSymlinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		link   string // public/ 中的路径
+		target string
+		ok     bool
+	}{
+		{name: "absolute", link: "x", target: "/etc/shadow"},
+		{name: "parent", link: "x", target: "../../.."},
+		{name: "parent from subdirectory", link: "docs/x", target: "../../config.toml"},
+		{name: "dot dot after name", link: "x", target: "docs/../../config.toml"},
+		{name: "sibling", link: "latest", target: "docs", ok: true},
+		{name: "up within output", link: "docs/home.html", target: "../index.html", ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			src := filepath.Join(root, "public")
+			if err := os.MkdirAll(filepath.Join(src, "docs"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(src, "index.html"), []byte("home"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(tt.target, filepath.Join(src, tt.link)); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(root, "release")
+			if err := os.Mkdir(dst, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := copyTree(src, dst)
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err := os.Readlink(filepath.Join(dst, tt.link)); err != nil || got != tt.target {
+					t.Fatalf("copied link = %q, %v", got, err)
+				}
+				return
+			}
+			if !errors.Is(err, decode.ErrPathTraversal) {
+				t.Fatalf("copyTree error = %v, want ErrPathTraversal", err)
+			}
+			if _, err := os.Lstat(filepath.Join(dst, tt.link)); err == nil {
+				t.Fatal("escaping symlink was copied")
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package build
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"nemu-server/auth"
+	"nemu-server/config"
+	"nemu-server/decode"
+	"nemu-server/progress"
+	"nemu-server/release"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// webhook 请求体的大小上限
+const maxPayload = 25 << 20
+
+// PushEvent GitHub 与 Gitea/Gogs push 事件中用到的字段
+type PushEvent struct {
+	Ref   string `json:"ref"`   // refs/heads/<branch>
+	After string `json:"after"` // 推送后的 commit
+}
+
+// MakeWebhookHandler 接收 GitHub 与 Gitea/Gogs 的 push webhook, 推送到配置的分支时触发构建
+// 以 build.secret 校验 X-Hub-Signature-256 (GitHub, Gitea) 或 X-Gitea-Signature / X-Gogs-Signature
+// POST /nemu/hook/git
+func MakeWebhookHandler(cfg *config.Config, b *Builder) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		if cfg.Build.Secret == "" || cfg.Build.Repo == "" {
+			c.JSON(http.StatusForbidden, touka.H{"message": "Webhook is disabled, set build.repo and build.secret to enable it"})
+			return
+		}
+		if cfg.Signing.Require {
+			c.JSON(http.StatusForbidden, touka.H{"message": ErrSigningRequired.Error()})
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxPayload))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": "Failed to read request body"})
+			return
+		}
+
+		source, ok := verify(c.Request.Header, body, cfg.Build.Secret)
+		if !ok {
+			c.Warnf("Invalid webhook signature from %s", c.ClientIP())
+			c.JSON(http.StatusUnauthorized, touka.H{"message": "Invalid signature"})
+			return
+		}
+
+		event := firstHeader(c.Request.Header, "X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event")
+		switch event {
+		case "ping":
+			c.JSON(http.StatusOK, touka.H{"message": "pong"})
+			return
+		case "push":
+		default:
+			c.JSON(http.StatusOK, touka.H{"message": "ignored", "reason": "event " + event})
+			return
+		}
+
+		push, err := parsePush(c.Request.Header.Get("Content-Type"), body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": "Invalid push payload: " + err.Error()})
+			return
+		}
+		if push.Ref != "refs/heads/"+cfg.Build.Branch {
+			c.JSON(http.StatusOK, touka.H{"message": "ignored", "reason": "ref " + push.Ref})
+			return
+		}
+
+		c.Infof("Push to %s (%s) received from %s", cfg.Build.Branch, push.After, source)
+		queued := b.Trigger("webhook:" + source)
+		c.JSON(http.StatusAccepted, touka.H{"message": "accepted", "queued": queued})
+	}
+}
+
+// MakeBuildHandler 在服务端构建并部署
+// 请求体为空时触发仓库构建, 例如由本地仓库的 post-receive 钩子调用, 立即返回 202;
+// 请求体为源码的 tar 归档 (压缩格式与 /nemu/upload 相同) 时构建上传的源码,
+// 以 NDJSON 事件流返回构建日志, 最后一个事件为 done 或 error; 开始构建之前的错误仍以 JSON 响应
+// signing.require 开启时拒绝仓库构建与源码构建, 构建结果不是部署者签名的归档
+// POST /nemu/build
+func MakeBuildHandler(cfg *config.Config, b *Builder) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		if cfg.Signing.Require {
+			c.Warnf("Rejected server build by %s: %v", auth.TokenName(c), ErrSigningRequired)
+			c.JSON(ErrorStatus(ErrSigningRequired), touka.H{"message": ErrSigningRequired.Error()})
+			return
+		}
+		if c.Request.ContentLength == 0 {
+			if cfg.Build.Repo == "" {
+				c.JSON(http.StatusBadRequest, touka.H{"message": ErrNoRepo.Error()})
+				return
+			}
+			queued := b.Trigger(auth.TokenName(c))
+			c.JSON(http.StatusAccepted, touka.H{"message": "accepted", "queued": queued})
+			return
+		}
+		defer c.Request.Body.Close()
+		// 上传的源码不受信任, 构建命令只在沙箱中执行
+		if len(cfg.Build.Sandbox) == 0 && !cfg.Build.AllowUnsandboxed {
+			c.Warnf("Rejected source build by %s: %v", auth.TokenName(c), ErrNoSandbox)
+			c.JSON(ErrorStatus(ErrNoSandbox), touka.H{"message": ErrNoSandbox.Error()})
+			return
+		}
+
+		stream := progress.NewStream(c)
+		progress.Attach(c, stream)
+		// 构建结果总是本节点的新版本, 不接受 Nemu-Origin
+		meta := release.MetaFromHeader(c.Request.Header)
+		meta.Origin = ""
+		rel, err := b.BuildSource(c, c.Request.Body, c.GetReqHeader("Content-Encoding"), meta, stream)
+		if err != nil {
+			c.Errorf("Source build failed: %v", err)
+			obj := touka.H{"message": err.Error()}
+			if errors.Is(err, ErrBuildFailed) || errors.Is(err, ErrNoOutput) {
+				obj["stage"] = "build"
+			}
+			progress.JSON(c, ErrorStatus(err), obj)
+			return
+		}
+		c.Infof("Source build by %s activated release %s", auth.TokenName(c), rel.ID)
+		obj := touka.H{"message": "success", "release": rel.ID, "entries": rel.Entries, "size": rel.Size}
+		if len(rel.Replicas) > 0 {
+			obj["replicas"] = rel.Replicas
+		}
+		progress.JSON(c, http.StatusOK, obj)
+	}
+}
+
+// ErrorStatus 将构建错误映射为 HTTP 状态码, 在事件流中作为 error 事件的 status 字段
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrBuildFailed), errors.Is(err, ErrNoOutput):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrSourceTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrSigningRequired), errors.Is(err, ErrNoSandbox):
+		return http.StatusForbidden
+	default:
+		return decode.ErrorStatus(err)
+	}
+}
+
+// MakeStatusHandler 返回最近一次仓库构建的状态与日志
+// GET /nemu/build
+func MakeStatusHandler(b *Builder) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		c.JSON(http.StatusOK, b.Status())
+	}
+}
+
+// verify 校验签名, 返回 webhook 来源
+func verify(h http.Header, body []byte, secret string) (string, bool) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	source := "github"
+	if h.Get("X-Gitea-Event") != "" {
+		source = "gitea"
+	} else if h.Get("X-Gogs-Event") != "" {
+		source = "gogs"
+	}
+
+	signature, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		signature = firstHeader(h, "X-Gitea-Signature", "X-Gogs-Signature")
+	}
+	actual, err := hex.DecodeString(signature)
+	if err != nil || len(actual) == 0 {
+		return source, false
+	}
+	return source, hmac.Equal(actual, expected)
+}
+
+// parsePush 解析 push 事件, GitHub 的 application/x-www-form-urlencoded 格式放在 payload 字段中
+func parsePush(contentType string, body []byte) (*PushEvent, error) {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Has("payload") {
+			body = []byte(form.Get("payload"))
+		}
+	}
+	var push PushEvent
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+	return &push, nil
+}
+
+func firstHeader(h http.Header, keys ...string) string {
+	for _, key := range keys {
+		if v := h.Get(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
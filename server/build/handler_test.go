@@ -0,0 +1,64 @@
+package build
+
+import (
+	"nemu-server/config"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/infinite-iroha/touka"
+)
+
+func TestSigningRequireRefusesBuilds(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Build.Enabled = true
+	cfg.Build.Repo = "https://example.com/site.git"
+	cfg.Build.Secret = "secret"
+	cfg.Signing.Require = true
+	b := NewBuilder(cfg, nil, nil, nil)
+
+	r := touka.New()
+	r.POST("/nemu/hook/git", MakeWebhookHandler(cfg, b))
+	r.POST("/nemu/build", MakeBuildHandler(cfg, b))
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{name: "webhook", path: "/nemu/hook/git", body: `{"ref":"refs/heads/main"}`},
+		{name: "repository build", path: "/nemu/build"},
+		{name: "source build", path: "/nemu/build", body: "source archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := touka.PerformRequest(r, http.MethodPost, tt.path, strings.NewReader(tt.body), nil)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want 403: %s", w.Code, w.Body)
+			}
+			if b.Status().State != StateIdle {
+				t.Fatalf("build was triggered: %+v", b.Status())
+			}
+		})
+	}
+}
+
+func TestSourceBuildRequiresSandbox(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Build.Enabled = true
+	b := NewBuilder(cfg, nil, nil, nil)
+	r := touka.New()
+	r.POST("/nemu/build", MakeBuildHandler(cfg, b))
+
+	w := touka.PerformRequest(r, http.MethodPost, "/nemu/build", strings.NewReader("source archive"), nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "build.sandbox") {
+		t.Fatalf("status = %d, want 403: %s", w.Code, w.Body)
+	}
+
+	// 明确放行后进入构建, 这里因归档无效而失败
+	cfg.Build.AllowUnsandboxed = true
+	w = touka.PerformRequest(r, http.MethodPost, "/nemu/build", strings.NewReader("source archive"), nil)
+	if w.Code == http.StatusForbidden {
+		t.Fatalf("allowUnsandboxed build was refused: %s", w.Body)
+	}
+}
@@ -8,8 +8,20 @@ import (
 )
 
 type Config struct {
-	Server ServerConfig
-	Log    LogConfig
+	Server      ServerConfig
+	Log         LogConfig
+	Session     SessionConfig
+	Release     ReleaseConfig
+	Hooks       HooksConfig
+	Tokens      []TokenConfig
+	Notify      NotifyConfig
+	Build       BuildConfig
+	Storage     StorageConfig
+	Replication ReplicationConfig
+	Preview     PreviewConfig
+	Encryption  EncryptionConfig
+	Signing     SigningConfig
+	TLS         TLSConfig
 }
 
 /*
@@ -38,6 +50,245 @@ type LogConfig struct {
 	Level       string `toml:"level"`
 }
 
+/*
+[session]
+dir = "sessions"
+maxChunkSize = 64
+ttl = 24
+*/
+type SessionConfig struct {
+	Dir          string `toml:"dir"`          // 分块上传会话的暂存目录
+	MaxChunkSize int    `toml:"maxChunkSize"` // 单个分块的最大大小, 单位MB
+	TTL          int    `toml:"ttl"`          // 会话过期时间, 单位小时
+}
+
+/*
+[release]
+dir = "releases"
+keep = 5
+dedupe = true
+*/
+type ReleaseConfig struct {
+	Dir    string `toml:"dir"`    // 版本目录, server.dir 将成为指向当前版本的软链接
+	Keep   int    `toml:"keep"`   // 保留的版本数量, 0 表示不清理
+	Dedupe bool   `toml:"dedupe"` // 按内容去重, 版本中的文件是 <dir>/objects 中对象的硬链接
+}
+
+/*
+[hooks]
+timeout = 60
+preActivate = []
+postActivate = []
+*/
+type HooksConfig struct {
+	Timeout      int      `toml:"timeout"`      // 单个命令的超时时间, 单位秒
+	PreActivate  []string `toml:"preActivate"`  // 激活版本前执行, 任一命令失败则放弃该版本
+	PostActivate []string `toml:"postActivate"` // 激活版本后执行, 失败只记录日志
+}
+
+/*
+[[tokens]]
+name = "ci"
+token = ""
+peer = false
+*/
+// TokenConfig 额外的具名 Token, 与 server.token 同样可以访问全部接口
+// 名称会出现在日志与部署通知中, 便于区分由谁部署; server.token 的名称为 default
+type TokenConfig struct {
+	Name  string `toml:"name"`
+	Token string `toml:"token"` // sha512 后的 Token, 由 nemu hash 生成
+	Peer  bool   `toml:"peer"`  // 供其他节点复制版本使用, 只有以这样的 Token 上传的版本才按 Nemu-Origin 视为复制而来
+}
+
+/*
+[notify]
+site = "example.com"
+retries = 3
+timeout = 10
+
+[[notify.webhooks]]
+url = "https://chat.example.com/hook"
+secret = ""
+events = []
+template = ""
+contentType = ""
+*/
+type NotifyConfig struct {
+	Site     string          `toml:"site"`     // 通知中的站点名称, 默认为主机名
+	Retries  int             `toml:"retries"`  // 发送失败后的最大重试次数
+	Timeout  int             `toml:"timeout"`  // 单次请求的超时时间, 单位秒
+	Webhooks []WebhookConfig `toml:"webhooks"` // 通知目标
+}
+
+type WebhookConfig struct {
+	URL         string   `toml:"url"`
+	Secret      string   `toml:"secret"`      // 不为空时以 HMAC-SHA256 签名请求体, 放在 Nemu-Signature 头部
+	Events      []string `toml:"events"`      // 订阅的事件, 为空表示全部
+	Template    string   `toml:"template"`    // text/template 模板, 为空时发送 JSON 格式的通知
+	ContentType string   `toml:"contentType"` // 默认为 application/json
+}
+
+/*
+[build]
+enabled = false
+repo = "https://github.com/user/blog.git"
+branch = "main"
+dir = "build"
+command = "hugo --minify"
+output = "public"
+secret = ""
+timeout = 600
+maxSourceSize = 200
+env = []
+sandbox = []
+allowUnsandboxed = false
+*/
+type BuildConfig struct {
+	Enabled       bool     `toml:"enabled"`       // 是否启用服务端构建
+	Repo          string   `toml:"repo"`          // 站点仓库, 可以是远程地址或本地路径, 为空时只接受上传源码构建
+	Branch        string   `toml:"branch"`        // 构建的分支
+	Dir           string   `toml:"dir"`           // 仓库的本地工作目录
+	Command       string   `toml:"command"`       // 在工作目录中以 sh -c 执行的构建命令
+	Output        string   `toml:"output"`        // 构建结果目录, 相对于工作目录
+	Secret        string   `toml:"secret"`        // webhook 签名密钥, 为空时不接受 webhook
+	Timeout       int      `toml:"timeout"`       // 一次构建 (拉取与构建命令) 的超时时间, 单位秒
+	MaxSourceSize int      `toml:"maxSourceSize"` // 上传源码解压后的大小上限, 单位MB
+	Env           []string `toml:"env"`           // 传给构建命令的额外环境变量, 形如 KEY=VALUE
+	Sandbox       []string `toml:"sandbox"`       // 包装构建命令的沙箱程序及参数, {dir} 替换为构建目录
+	// 未配置 sandbox 时仍接受上传源码构建; 持有 Token 的人因此可以以服务端的用户执行任意命令
+	AllowUnsandboxed bool `toml:"allowUnsandboxed"`
+}
+
+/*
+[storage]
+type = "local"
+
+[storage.s3]
+endpoint = "https://s3.example.com"
+region = "us-east-1"
+bucket = "site"
+prefix = ""
+accessKey = ""
+secretKey = ""
+pathStyle = true
+cacheTTL = 5
+*/
+type StorageConfig struct {
+	Type string   `toml:"type"` // 版本的存储位置, local 或 s3
+	S3   S3Config `toml:"s3"`
+}
+
+type S3Config struct {
+	Endpoint  string `toml:"endpoint"`  // S3 兼容服务的地址, 例如 https://s3.amazonaws.com 或 http://127.0.0.1:9000
+	Region    string `toml:"region"`    // 签名使用的区域, MinIO 等通常为 us-east-1, Cloudflare R2 为 auto
+	Bucket    string `toml:"bucket"`    // 存储桶, 需预先创建
+	Prefix    string `toml:"prefix"`    // 对象键的前缀, 多个站点可以共用一个存储桶
+	AccessKey string `toml:"accessKey"` // 访问密钥 ID
+	SecretKey string `toml:"secretKey"` // 访问密钥
+	PathStyle bool   `toml:"pathStyle"` // 使用 <endpoint>/<bucket>/<key> 形式的地址, 否则使用 <bucket>.<endpoint>
+	CacheTTL  int    `toml:"cacheTTL"`  // 提供站点时缓存线上版本清单的时间, 单位秒
+}
+
+/*
+[replication]
+quorum = 0
+timeout = 300
+
+[[replication.peers]]
+name = "hk"
+url = "https://hk.example.com"
+token = ""
+secret = ""
+*/
+// ReplicationConfig 将本节点部署的版本复制到其他 nemu-server
+type ReplicationConfig struct {
+	Quorum  int          `toml:"quorum"`  // 至少需要激活新版本的节点数量, 不足时部署失败; 0 表示复制失败不影响部署
+	Timeout int          `toml:"timeout"` // 复制到单个节点的超时时间, 单位秒
+	Peers   []PeerConfig `toml:"peers"`   // 复制目标
+}
+
+type PeerConfig struct {
+	Name   string `toml:"name"`   // 日志与进度中的节点名称, 默认为 url
+	URL    string `toml:"url"`    // 节点地址, 例如 https://hk.example.com
+	Token  string `toml:"token"`  // 节点的 Token, 与客户端登录后保存的相同 (nemu hash 的结果)
+	Secret string `toml:"secret"` // 节点的 encryption.secret, 设置后复制的归档以它加密, 节点开启 encryption.require 时必须设置
+}
+
+/*
+[preview]
+ttl = 72
+subdomain = false
+domain = ""
+*/
+// PreviewConfig 预览部署, 上传时指定 Nemu-Preview 的版本不影响线上站点, 在 /_preview/<name>/ 提供
+type PreviewConfig struct {
+	TTL       int    `toml:"ttl"`       // 未指定有效期时的默认有效期, 单位小时, 0 表示不过期
+	Subdomain bool   `toml:"subdomain"` // 同时以 <name>.preview.<domain> 提供预览, 需要相应的泛域名解析与证书
+	Domain    string `toml:"domain"`    // 站点的域名, 例如 example.com; 开启 subdomain 时必须设置
+}
+
+/*
+[encryption]
+secret = ""
+require = false
+*/
+// EncryptionConfig 上传数据的端到端加密, 客户端以 --secret 指定相同的密钥
+// 用于经由明文 HTTP 或不受信任的代理上传; 密钥不在请求中传输, 与 server.token 分开配置
+type EncryptionConfig struct {
+	Secret  string `toml:"secret"`  // 共享的部署密钥, 每次上传由它经 HKDF 派生密钥; 为空时不接受加密上传
+	Require bool   `toml:"require"` // 拒绝未加密的部署上传 (/nemu/upload 与分块上传)
+}
+
+/*
+[signing]
+require = false
+maxAge = 600
+key = ""
+
+[[signing.keys]]
+name = "alice"
+key = "ed25519:..."
+*/
+// SigningConfig 部署归档的 Ed25519 签名, 部署者以 nemu keygen 生成密钥对, 公钥配置在 [[signing.keys]] 中
+type SigningConfig struct {
+	Require bool               `toml:"require"` // 拒绝没有签名的部署上传, 包括其他节点复制来的版本; 同时拒绝服务端构建
+	MaxAge  int                `toml:"maxAge"`  // 签名时间与服务端时间相差的上限, 单位秒, 限制签名被重放的时间
+	Key     string             `toml:"key"`     // 本节点的私钥文件, 复制版本到其他节点时用它签名, 为空时不签名
+	Keys    []SigningKeyConfig `toml:"keys"`    // 允许部署的公钥
+}
+
+// SigningKeyConfig 允许部署的公钥, 名称会出现在日志与部署通知中
+type SigningKeyConfig struct {
+	Name string `toml:"name"`
+	Key  string `toml:"key"` // nemu keygen 输出的公钥, 形如 ed25519:<base64>
+}
+
+/*
+[tls]
+cert = ""
+key = ""
+clientCA = ""
+requireClientCert = false
+
+[[tls.clients]]
+subject = "CN=ci.internal,O=Infra"
+name = "ci"
+*/
+// TLSConfig 以 HTTPS 提供服务, 可选地以客户端证书代替 Token 认证 /nemu/* 接口
+type TLSConfig struct {
+	Cert              string            `toml:"cert"`              // 服务端证书 (PEM), 为空时以 HTTP 提供服务
+	Key               string            `toml:"key"`               // 服务端私钥 (PEM)
+	ClientCA          string            `toml:"clientCA"`          // 签发客户端证书的 CA (PEM), 为空时不接受客户端证书
+	RequireClientCert bool              `toml:"requireClientCert"` // /nemu/* 只接受 [[tls.clients]] 中的客户端证书, 不再接受 Token
+	Clients           []TLSClientConfig `toml:"clients"`           // 客户端证书的主题与部署身份的对应关系
+}
+
+// TLSClientConfig 客户端证书对应的部署身份, 名称与具名 Token 一样出现在日志与部署通知中
+type TLSClientConfig struct {
+	Subject string `toml:"subject"` // 证书主题, 如 CN=ci.internal,O=Infra; 只写 CN=<名称> 时只匹配通用名称
+	Name    string `toml:"name"`
+}
+
 // LoadConfig 从 TOML 配置文件加载配置
 func LoadConfig(filePath string) (*Config, error) {
 	if !FileExists(filePath) {
@@ -54,7 +305,7 @@ func LoadConfig(filePath string) (*Config, error) {
 		return DefaultConfig(), nil
 	}
 
-	var config Config
+	config := *DefaultConfig()
 	if _, err := toml.DecodeFile(filePath, &config); err != nil {
 		return nil, err
 	}
@@ -110,5 +361,60 @@ func DefaultConfig() *Config {
 			MaxLogSize:  5,
 			Level:       "info",
 		},
+		Session: SessionConfig{
+			Dir:          "sessions",
+			MaxChunkSize: 64,
+			TTL:          24,
+		},
+		Release: ReleaseConfig{
+			Dir:    "releases",
+			Keep:   5,
+			Dedupe: true,
+		},
+		Hooks: HooksConfig{
+			Timeout:      60,
+			PreActivate:  []string{},
+			PostActivate: []string{},
+		},
+		Tokens: []TokenConfig{},
+		Notify: NotifyConfig{
+			Retries:  3,
+			Timeout:  10,
+			Webhooks: []WebhookConfig{},
+		},
+		Build: BuildConfig{
+			Enabled: false,
+			Branch:  "main",
+			Dir:     "build",
+			Command: "hugo --minify",
+			Output:  "public",
+			Timeout: 600,
+
+			MaxSourceSize: 200,
+			Env:           []string{},
+			Sandbox:       []string{},
+		},
+		Storage: StorageConfig{
+			Type: "local",
+			S3: S3Config{
+				Region:    "us-east-1",
+				PathStyle: true,
+				CacheTTL:  5,
+			},
+		},
+		Replication: ReplicationConfig{
+			Timeout: 300,
+			Peers:   []PeerConfig{},
+		},
+		Preview: PreviewConfig{
+			TTL: 72,
+		},
+		Signing: SigningConfig{
+			MaxAge: 600,
+			Keys:   []SigningKeyConfig{},
+		},
+		TLS: TLSConfig{
+			Clients: []TLSClientConfig{},
+		},
 	}
 }
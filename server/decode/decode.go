@@ -3,16 +3,54 @@ package decode
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"nemu-server/auth"
 	"nemu-server/config"
+	"nemu-server/notify"
+	"nemu-server/preview"
+	"nemu-server/progress"
+	"nemu-server/release"
+	"nemu-server/seal"
+	"nemu-server/sign"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/WJQSERVER-STUDIO/go-utils/copyb"
 	"github.com/infinite-iroha/touka"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// ErrPathTraversal 表示归档条目试图写出目标目录
+	ErrPathTraversal = errors.New("path traversal detected")
+	// ErrUnsupportedEncoding 表示上传数据使用了不支持的 Content-Encoding
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	// ErrPreviewBase 表示预览上传指定了 Nemu-Base 或 Nemu-Prefix, 预览只接受完整上传
+	ErrPreviewBase = errors.New("incremental upload is not supported for previews")
+	// ErrPrefixBase 表示部分部署同时指定了 Nemu-Base, 部分部署总是以线上版本为基准
+	ErrPrefixBase = errors.New("incremental upload is not supported for partial deploys")
+	// ErrEncryptionRequired 表示 encryption.require 开启时收到了未加密的上传
+	ErrEncryptionRequired = errors.New("encrypted upload is required")
+	// ErrEncryptionDisabled 表示收到了加密的上传, 但没有配置 encryption.secret
+	ErrEncryptionDisabled = errors.New("encrypted upload is not enabled on this server")
+	// ErrUnsupportedEncryption 表示 Nemu-Encryption 的取值不受支持
+	ErrUnsupportedEncryption = errors.New("unsupported encryption scheme")
+)
+
+// WhiteoutPrefix 增量部署中表示删除的条目前缀, 与 OCI 镜像层的约定相同
+const WhiteoutPrefix = ".wh."
+
+// 上传数据支持的 Content-Encoding
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
 )
 
 func SafeTarExtractPath(baseDir string, tarEntryName string) (string, error) {
@@ -41,215 +79,519 @@ func SafeTarExtractPath(baseDir string, tarEntryName string) (string, error) {
 
 	// 如果相对路径以 ".." 开头，则说明发生了路径遍历
 	if strings.HasPrefix(rel, "..") {
-		return "", fmt.Errorf("path traversal detected: '%s' resolves outside base directory '%s'", tarEntryName, baseDir)
+		return "", fmt.Errorf("%w: '%s' resolves outside base directory '%s'", ErrPathTraversal, tarEntryName, baseDir)
 	}
 
 	// 如果所有检查都通过，则 finalPath 是安全的，返回该路径
 	return finalPath, nil
 }
 
+// safeEntryPath 在 SafeTarExtractPath 的基础上检查条目在 baseDir 内途经的上层路径
+// 上层路径中有软链接时返回 ErrPathTraversal, MkdirAll, OpenFile 与 RemoveAll 会跟随软链接写出 baseDir
+// 软链接可能来自同一归档中先前的条目, 也可能来自增量部署的基准版本
+func safeEntryPath(baseDir string, tarEntryName string) (string, error) {
+	targetPath, err := SafeTarExtractPath(baseDir, tarEntryName)
+	if err != nil {
+		return "", err
+	}
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absBase, targetPath)
+	if err != nil {
+		return "", err
+	}
+	parent := absBase
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if err != nil {
+			break // 不存在的目录由 MkdirAll 创建, 其下也不会有软链接
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: '%s' passes through symlink '%s'", ErrPathTraversal, tarEntryName, parent)
+		}
+	}
+	return targetPath, nil
+}
+
+// CheckLinkname 检查位于 targetPath 的软链接指向 linkname 时是否仍在 baseDir 之内
+// 不接受绝对路径; .. 只能出现在开头, 否则 a/.. 经由软链接 a 解析的结果与按文本清理的结果不同
+func CheckLinkname(baseDir, targetPath, linkname string) error {
+	if linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("%w: symlink '%s' points to absolute path '%s'", ErrPathTraversal, targetPath, linkname)
+	}
+	leading := true
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		switch part {
+		case "..":
+			if !leading {
+				return fmt.Errorf("%w: symlink target '%s' climbs out of a subdirectory", ErrPathTraversal, linkname)
+			}
+		case "", ".":
+		default:
+			leading = false
+		}
+	}
+	absBase, err := filepath.Abs(baseDir)
+	if err != nil {
+		return err
+	}
+	resolved := filepath.Join(filepath.Dir(targetPath), filepath.FromSlash(linkname))
+	rel, err := filepath.Rel(absBase, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: symlink '%s' -> '%s' resolves outside base directory '%s'", ErrPathTraversal, targetPath, linkname, baseDir)
+	}
+	return nil
+}
+
 // MakeDecodeHandler 创建一个标准的 http.HandlerFunc，通过闭包访问配置。
-func MakeDecodeHandler(cfg *config.Config) touka.HandlerFunc {
+// Token 校验由 auth.Middleware 完成; 带有 Nemu-Preview 头部的上传成为预览, 不影响线上版本
+func MakeDecodeHandler(cfg *config.Config, releases *release.Manager, previews *preview.Manager, notifier *notify.Notifier) touka.HandlerFunc {
 	// 返回符合 http.HandlerFunc 签名的函数
 	return func(c *touka.Context) {
 		r := c.Request
 
-		// 获取头部信息
-		inputToken := r.Header.Get("Nemu-Token")
-		if inputToken != cfg.Server.Token {
-			//c.Errorf("Invalid token")
-			c.Errorf("Invalid token")
-			c.JSON(401, touka.H{
-				"message": "Unauthorized",
-			})
-			return // 提前返回
-		}
-
 		// 获取请求体
 		reqBody := r.Body
-		defer reqBody.Close() // 延迟关闭请求体
-		// 标准库的 http server 通常会负责关闭请求体，此处不再手动 defer Close()
-
 		if reqBody == nil {
 			c.Errorf("Request body is nil")
 			c.JSON(http.StatusBadRequest, touka.H{"message": "Request body is nil"})
 			return
 		}
+		defer reqBody.Close() // 延迟关闭请求体
 
-		// 使用 gzip.NewReader 读取请求体
-		gzReader, err := gzip.NewReader(reqBody)
+		// 客户端请求事件流时实时推送解压, 钩子与激活的进度
+		if progress.Accepts(c) {
+			progress.Attach(c, progress.NewStream(c))
+		}
+
+		// Nemu-Signing-Key 表示请求体末尾附有签名, 签名覆盖加密与压缩后的归档
+		// Nemu-Encryption 表示请求体经过端到端加密, 先解密再解压
+		body, err := VerifyUpload(c, cfg, r.Header, reqBody)
+		if err == nil {
+			body, err = Decrypt(cfg, r.Header.Get(seal.Header), body)
+		}
 		if err != nil {
-			c.Errorf("Failed to create gzip reader: %v", err)
-			c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to process gzip data: %v", err)})
+			c.Warnf("Rejected upload: %v", err)
+			progress.JSON(c, ErrorStatus(err), touka.H{"message": err.Error()})
 			return
 		}
-		defer gzReader.Close() // 延迟关闭 gzip reader
 
-		// 使用 tar.NewReader 读取 tar 数据
-		tarReader := tar.NewReader(gzReader)
+		if name := r.Header.Get(preview.HeaderName); name != "" {
+			p, err := DeployPreview(c, previews, body, r.Header.Get("Content-Encoding"), name, r.Header, release.MetaFromHeader(r.Header))
+			if err != nil {
+				progress.JSON(c, ErrorStatus(err), touka.H{"message": err.Error()})
+				return
+			}
+			progress.JSON(c, http.StatusOK, preview.Response(p))
+			return
+		}
 
-		// 清理目录
-		err = os.RemoveAll(cfg.Server.Dir)
+		// Nemu-Base 为增量上传的基准版本, 不是线上版本时返回 409, 客户端应改为完整上传
+		// Nemu-Prefix 为部分部署的子路径, 其余内容复制自线上版本
+		// Nemu-Git-* 与 Nemu-Message 为随版本保存的元数据, Nemu-Origin 表示由其他节点复制而来, 只接受节点 Token
+		rel, err := Deploy(c, releases, notifier, body, r.Header.Get("Content-Encoding"), r.Header.Get("Nemu-Base"), r.Header.Get(release.HeaderPrefix), release.MetaFromHeader(r.Header))
 		if err != nil {
-			c.Errorf("Failed to clean directory: %v", err)
-			c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to clean directory: %v", err)})
+			progress.JSON(c, ErrorStatus(err), touka.H{"message": err.Error()})
 			return
 		}
-		err = os.MkdirAll(cfg.Server.Dir, 0755)
+
+		// 成功处理所有条目后发送成功响应
+		progress.JSON(c, http.StatusOK, Response(rel))
+
+	}
+}
+
+// Response 部署成功后的响应
+func Response(rel *release.Release) touka.H {
+	obj := touka.H{"message": "success", "release": rel.ID, "entries": rel.Entries}
+	if rel.Prefix != "" {
+		obj["prefix"] = rel.Prefix
+	}
+	if len(rel.Replicas) > 0 {
+		obj["replicas"] = rel.Replicas
+	}
+	return obj
+}
+
+// ErrorStatus 将 Deploy/ExtractTar 返回的错误映射为 HTTP 状态码
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPathTraversal):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrPreviewBase), errors.Is(err, ErrPrefixBase), errors.Is(err, preview.ErrInvalidName), errors.Is(err, preview.ErrInvalidExpires):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrEncryptionRequired), errors.Is(err, ErrEncryptionDisabled), errors.Is(err, ErrUnsupportedEncryption),
+		errors.Is(err, seal.ErrFormat), errors.Is(err, seal.ErrAuth), errors.Is(err, seal.ErrTruncated):
+		return http.StatusBadRequest
+	case errors.Is(err, sign.ErrFormat), errors.Is(err, sign.ErrTruncated):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrSignatureRequired), errors.Is(err, ErrUnknownKey), errors.Is(err, ErrSignatureExpired), errors.Is(err, sign.ErrInvalid):
+		return http.StatusForbidden
+	default:
+		return release.ErrorStatus(err)
+	}
+}
+
+// Decrypt 按 Nemu-Encryption 的取值 scheme 返回解密后的请求体, 未加密时原样返回 body
+// 密钥错误或数据被篡改时, 读取返回的 reader 会得到 seal.ErrAuth
+func Decrypt(cfg *config.Config, scheme string, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(scheme)) {
+	case "":
+		if cfg.Encryption.Require {
+			return nil, ErrEncryptionRequired
+		}
+		return body, nil
+	case seal.Scheme:
+		if cfg.Encryption.Secret == "" {
+			return nil, ErrEncryptionDisabled
+		}
+		return seal.NewReader(body, cfg.Encryption.Secret)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncryption, scheme)
+	}
+}
+
+// NewDecompressor 按 Content-Encoding 创建解压 reader
+// 未指定编码时按 gzip 处理, 以兼容旧版客户端
+func NewDecompressor(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", EncodingGzip, "x-gzip":
+		gzReader, err := gzip.NewReader(body)
 		if err != nil {
-			c.Errorf("Failed to create directory: %v", err)
-			c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create directory: %v", err)})
-			return
+			return nil, fmt.Errorf("Failed to process gzip data: %w", err)
 		}
+		return gzReader, nil
+	case EncodingZstd:
+		zstdReader, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to process zstd data: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+	case EncodingIdentity, "none":
+		return io.NopCloser(body), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+}
+
+// Deploy 按 encoding 解压 tar 数据流到新版本目录, 成功后原子切换线上版本
+// 解压失败时线上版本保持不变; base 不为空时为增量部署, 数据流只包含相对 base 的变化
+// prefix 不为空时为部分部署, 数据流只解压到该子路径内, 其余内容复制自线上版本
+// 部署结果通过 notifier 发送通知; 基准版本已变化时客户端会改为完整上传, 不发送失败通知
+func Deploy(c *touka.Context, releases *release.Manager, notifier *notify.Notifier, body io.Reader, encoding, base, prefix string, meta release.Meta) (*release.Release, error) {
+	start := time.Now()
+	meta = trustedMeta(c, meta)
+	rel, err := deploy(c, releases, body, encoding, base, prefix, meta)
 
-		// 解压到 cfg.Server.Dir 文件夹内
-		processedEntries := 0 // 跟踪是否成功处理了至少一个条目
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				c.Infof("All entries processed successfully")
-				break // 文件结束
+	if !errors.Is(err, release.ErrBaseChanged) {
+		payload := notify.DeployPayload(rel, err)
+		payload.Base = base
+		payload.Prefix = prefix
+		payload.Token = auth.TokenName(c)
+		payload.Signer = SignerName(c)
+		payload.Duration = time.Since(start).Milliseconds()
+		payload.SetMeta(meta.Clean())
+		notifier.Send(payload)
+	}
+	return rel, err
+}
+
+func deploy(c *touka.Context, releases *release.Manager, body io.Reader, encoding, base, prefix string, meta release.Meta) (*release.Release, error) {
+	if prefix != "" && base != "" {
+		return nil, ErrPrefixBase
+	}
+	reader, err := NewDecompressor(encoding, body)
+	if err != nil {
+		c.Errorf("Failed to create decompressor: %v", err)
+		return nil, err
+	}
+	defer reader.Close() // 延迟关闭解压 reader
+
+	var rel *release.Release
+	if prefix != "" {
+		// 解压的目标目录就是新版本中的子路径, safeEntryPath 与 CheckLinkname 将写入限制在其中
+		rel, err = releases.DeployPrefix(prefix, meta, progress.From(c), extract(c, reader))
+	} else {
+		rel, err = releases.Deploy(base, meta, progress.From(c), extract(c, reader))
+	}
+	if err != nil {
+		c.Errorf("Deploy failed: %v", err)
+		return nil, err
+	}
+	c.Infof("Release %s activated by %s (%d entries, %d bytes)", rel.ID, auth.TokenName(c), rel.Entries, rel.Size)
+	return rel, nil
+}
+
+// trustedMeta 去掉不是由节点 Token 上传的 Origin
+// Origin 决定版本是否复制到其他节点, 普通部署者不能借它跳过复制与法定数量
+func trustedMeta(c *touka.Context, meta release.Meta) release.Meta {
+	if meta.Origin != "" && !auth.IsPeer(c) {
+		c.Warnf("Ignoring %s from %s, only peer tokens may replicate releases", release.HeaderOrigin, auth.TokenName(c))
+		meta.Origin = ""
+	}
+	return meta
+}
+
+// extract 返回把 reader 中的 tar 解压到版本目录的 fill 函数
+// 读完请求体之前无法开始响应, 解压期间的事件 (警告) 缓存到解压完成后发送
+func extract(c *touka.Context, reader io.Reader) func(dir string) (int, error) {
+	stream := progress.From(c)
+	stream.Hold()
+	start := time.Now()
+	return func(dir string) (int, error) {
+		entries, err := ExtractTar(c, tar.NewReader(reader), dir)
+		if err != nil {
+			return entries, err
+		}
+		// 读完归档之后的填充
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return entries, err
+		}
+		// 流式上传的签名在请求体末尾, 读完后校验, 校验失败时放弃该版本
+		if err := checkSignature(c); err != nil {
+			return entries, err
+		}
+		stream.Resume()
+		stream.Event("received", map[string]any{"entries": entries, "duration_ms": time.Since(start).Milliseconds()})
+		return entries, nil
+	}
+}
+
+// DeployPreview 按 encoding 解压 tar 数据流为名为 name 的预览, 有效期与密码来自请求头
+// 预览不执行钩子, 不复制到其他节点, 也不发送部署通知
+func DeployPreview(c *touka.Context, previews *preview.Manager, body io.Reader, encoding, name string, header http.Header, meta release.Meta) (*preview.Preview, error) {
+	if header.Get("Nemu-Base") != "" || header.Get(release.HeaderPrefix) != "" {
+		return nil, ErrPreviewBase
+	}
+	opts, err := previews.Options(header)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewDecompressor(encoding, body)
+	if err != nil {
+		c.Errorf("Failed to create decompressor: %v", err)
+		return nil, err
+	}
+	defer reader.Close()
+
+	p, err := previews.Deploy(name, opts, trustedMeta(c, meta), extract(c, reader))
+	if err != nil {
+		c.Errorf("Preview %s failed: %v", name, err)
+		return nil, err
+	}
+	c.Infof("Preview %s deployed by %s (%d entries, %d bytes)", p.Name, auth.TokenName(c), p.Entries, p.Size)
+	return p, nil
+}
+
+// ExtractTar 将 tar 数据流中的条目解压到 baseDir 内
+// 返回成功处理的条目数量
+func ExtractTar(c *touka.Context, tarReader *tar.Reader, baseDir string) (int, error) {
+	processedEntries := 0 // 跟踪是否成功处理了至少一个条目
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			c.Infof("All entries processed successfully")
+			return processedEntries, nil // 文件结束
+		}
+		if err != nil {
+			c.Errorf("Failed to read tar header: %v", err)
+			return processedEntries, fmt.Errorf("Failed to read tar header: %w", err)
+		}
+
+		// 增量部署的删除标记: a/.wh.b.html 表示删除 a/b.html
+		if dir, name := path.Split(header.Name); strings.HasPrefix(name, WhiteoutPrefix) {
+			// 上层路径经由软链接时 RemoveAll 会删除 baseDir 之外的内容; 目标本身是软链接时只删除链接
+			targetPath, err := safeEntryPath(baseDir, dir+strings.TrimPrefix(name, WhiteoutPrefix))
+			if err == nil && filepath.Clean(targetPath) == filepath.Clean(baseDir) {
+				err = fmt.Errorf("%w: whiteout %s removes the whole site", ErrPathTraversal, header.Name)
 			}
 			if err != nil {
-				c.Errorf("Failed to read tar header: %v", err)
-				c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to read tar header: %v", err)})
-				return
+				c.Errorf("Path traversal detected for whiteout %s: %v", header.Name, err)
+				return processedEntries, err
+			}
+			if err := os.RemoveAll(targetPath); err != nil {
+				c.Errorf("Failed to remove %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to remove file: %w", err)
 			}
+			removeEmptyParents(filepath.Dir(targetPath), baseDir)
+			processedEntries++
+			continue
+		}
 
-			// 安全路径检查和文件操作
-			switch header.Typeflag {
-			case tar.TypeReg: // 普通文件
-				targetPath, err := SafeTarExtractPath(cfg.Server.Dir, header.Name)
-				if err != nil {
-					c.Errorf("Path traversal detected for file %s: %v", header.Name, err)
-					c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Path traversal detected: %v", err)})
-					return
-				}
+		// 安全路径检查和文件操作
+		switch header.Typeflag {
+		case tar.TypeReg: // 普通文件
+			targetPath, err := safeEntryPath(baseDir, header.Name)
+			if err != nil {
+				c.Errorf("Path traversal detected for file %s: %v", header.Name, err)
+				return processedEntries, err
+			}
 
-				// 确保目标目录存在
-				targetDir := filepath.Dir(targetPath)
-				if err := os.MkdirAll(targetDir, 0755); err != nil {
-					c.Errorf("Failed to create directory %s for file %s: %v", targetDir, header.Name, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create directory: %v", err)})
-					return
-				}
+			// 确保目标目录存在
+			targetDir := filepath.Dir(targetPath)
+			if err := os.MkdirAll(targetDir, 0755); err != nil {
+				c.Errorf("Failed to create directory %s for file %s: %v", targetDir, header.Name, err)
+				return processedEntries, fmt.Errorf("Failed to create directory: %w", err)
+			}
 
-				// 使用 O_TRUNC 标志覆盖现有文件
-				outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
-				if err != nil {
-					c.Errorf("Failed to create file %s: %v", targetPath, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create file: %v", err)})
-					return
-				}
+			// 增量部署时目标可能是与基准版本共享的硬链接, 先删除再创建, 不能原地截断
+			if err := removeExisting(targetPath); err != nil {
+				c.Errorf("Failed to replace file %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to replace file: %w", err)
+			}
 
-				_, err = copyb.Copy(outFile, tarReader)
-				outFile.Close() // 在复制完成后立即关闭文件
-				if err != nil {
-					c.Errorf("Failed to copy file %s: %v", targetPath, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to copy file: %v", err)})
-					return
-				}
+			// 使用 O_TRUNC 标志覆盖现有文件
+			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				c.Errorf("Failed to create file %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to create file: %w", err)
+			}
 
-				// 权限和时间戳
-				err = os.Chmod(targetPath, os.FileMode(header.Mode))
-				if err != nil {
-					c.Warnf("Failed to change file permissions for %s: %v", targetPath, err)
-				}
-				if !header.ModTime.IsZero() {
-					err := os.Chtimes(targetPath, header.ModTime, header.ModTime)
-					if err != nil {
-						c.Warnf("Failed to change file modification time for %s: %v", targetPath, err)
-					}
-				}
-				processedEntries++ // 成功处理一个文件
+			_, err = copyb.Copy(outFile, tarReader)
+			outFile.Close() // 在复制完成后立即关闭文件
+			if err != nil {
+				c.Errorf("Failed to copy file %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to copy file: %w", err)
+			}
 
-			case tar.TypeDir: // 目录
-				targetPath, err := SafeTarExtractPath(cfg.Server.Dir, header.Name)
-				if err != nil {
-					c.Errorf("Path traversal detected for directory %s: %v", header.Name, err)
-					c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Path traversal detected: %v", err)})
-					return
-				}
-				// 使用 MkdirAll 确保父目录也创建
-				err = os.MkdirAll(targetPath, os.FileMode(header.Mode))
+			// 权限和时间戳
+			err = os.Chmod(targetPath, os.FileMode(header.Mode))
+			if err != nil {
+				progress.Warnf(c, "Failed to change file permissions for %s: %v", targetPath, err)
+			}
+			if !header.ModTime.IsZero() {
+				err := os.Chtimes(targetPath, header.ModTime, header.ModTime)
 				if err != nil {
-					c.Errorf("Failed to create directory %s: %v", targetPath, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create directory: %v", err)})
-					return
+					progress.Warnf(c, "Failed to change file modification time for %s: %v", targetPath, err)
 				}
+			}
+			processedEntries++ // 成功处理一个文件
 
-				// 权限和时间戳
-				err = os.Chmod(targetPath, os.FileMode(header.Mode))
-				if err != nil {
-					c.Warnf("Failed to change directory permissions for %s: %v", targetPath, err)
-				}
-				if !header.ModTime.IsZero() {
-					err = os.Chtimes(targetPath, header.ModTime, header.ModTime)
-					if err != nil {
-						c.Warnf("Failed to change directory modification time for %s: %v", targetPath, err)
-					}
-				}
-				processedEntries++ // 成功处理一个目录
+		case tar.TypeDir: // 目录
+			targetPath, err := safeEntryPath(baseDir, header.Name)
+			if err != nil {
+				c.Errorf("Path traversal detected for directory %s: %v", header.Name, err)
+				return processedEntries, err
+			}
+			// 增量部署时同名路径可能原本是文件
+			if info, err := os.Lstat(targetPath); err == nil && !info.IsDir() {
+				os.Remove(targetPath)
+			}
+			// 使用 MkdirAll 确保父目录也创建
+			err = os.MkdirAll(targetPath, os.FileMode(header.Mode))
+			if err != nil {
+				c.Errorf("Failed to create directory %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to create directory: %w", err)
+			}
 
-			case tar.TypeSymlink: // 软链接
-				targetPath, err := SafeTarExtractPath(cfg.Server.Dir, header.Name)
-				if err != nil {
-					c.Errorf("Path traversal detected for symlink %s: %v", header.Name, err)
-					c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Path traversal detected: %v", err)})
-					return
-				}
-				// 确保目标目录存在
-				targetDir := filepath.Dir(targetPath)
-				if err := os.MkdirAll(targetDir, 0755); err != nil {
-					c.Errorf("Failed to create directory for symlink %s: %v", targetDir, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create directory: %v", err)})
-					return
-				}
-				// Linkname 是目标路径
-				err = os.Symlink(header.Linkname, targetPath)
+			// 权限和时间戳
+			err = os.Chmod(targetPath, os.FileMode(header.Mode))
+			if err != nil {
+				progress.Warnf(c, "Failed to change directory permissions for %s: %v", targetPath, err)
+			}
+			if !header.ModTime.IsZero() {
+				err = os.Chtimes(targetPath, header.ModTime, header.ModTime)
 				if err != nil {
-					c.Errorf("Failed to create symlink %s -> %s: %v", targetPath, header.Linkname, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create symlink: %v", err)})
-					return
+					progress.Warnf(c, "Failed to change directory modification time for %s: %v", targetPath, err)
 				}
-				processedEntries++ // 成功处理一个软链接
+			}
+			processedEntries++ // 成功处理一个目录
 
-			case tar.TypeLink: // 硬链接
-				targetPath, err := SafeTarExtractPath(cfg.Server.Dir, header.Name)
-				if err != nil {
-					c.Errorf("Path traversal detected for hard link %s: %v", header.Name, err)
-					c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Path traversal detected: %v", err)})
-					return
-				}
-				// 确保目标目录存在
-				targetDir := filepath.Dir(targetPath)
-				if err := os.MkdirAll(targetDir, 0755); err != nil {
-					c.Errorf("Failed to create directory for hard link %s: %v", targetDir, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create directory: %v", err)})
-					return
-				}
-				// Hard links require the old path relative to the filesystem root or the baseDir.
-				// Assuming Linkname is relative to baseDir as original code implies.
-				oldPath := filepath.Join(cfg.Server.Dir, header.Linkname)
-				err = os.Link(oldPath, targetPath)
-				if err != nil {
-					c.Errorf("Failed to create hard link %s -> %s: %v", targetPath, oldPath, err)
-					c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to create hard link: %v", err)})
-					return
-				}
-				processedEntries++ // 成功处理一个硬链接
+		case tar.TypeSymlink: // 软链接
+			targetPath, err := safeEntryPath(baseDir, header.Name)
+			if err != nil {
+				c.Errorf("Path traversal detected for symlink %s: %v", header.Name, err)
+				return processedEntries, err
+			}
+			// 软链接只能指向 baseDir 之内, 之后的条目也不会经由它写出 baseDir
+			if err := CheckLinkname(baseDir, targetPath, header.Linkname); err != nil {
+				c.Errorf("Path traversal detected for symlink %s: %v", header.Name, err)
+				return processedEntries, err
+			}
+			// 确保目标目录存在
+			targetDir := filepath.Dir(targetPath)
+			if err := os.MkdirAll(targetDir, 0755); err != nil {
+				c.Errorf("Failed to create directory for symlink %s: %v", targetDir, err)
+				return processedEntries, fmt.Errorf("Failed to create directory: %w", err)
+			}
+			if err := removeExisting(targetPath); err != nil {
+				c.Errorf("Failed to replace symlink %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to replace symlink: %w", err)
+			}
+			// Linkname 是目标路径
+			err = os.Symlink(header.Linkname, targetPath)
+			if err != nil {
+				c.Errorf("Failed to create symlink %s -> %s: %v", targetPath, header.Linkname, err)
+				return processedEntries, fmt.Errorf("Failed to create symlink: %w", err)
+			}
+			processedEntries++ // 成功处理一个软链接
 
-			default:
-				c.Warnf("Unhandled tar entry type for %s: %v", header.Name, header.Typeflag)
+		case tar.TypeLink: // 硬链接
+			targetPath, err := safeEntryPath(baseDir, header.Name)
+			if err != nil {
+				c.Errorf("Path traversal detected for hard link %s: %v", header.Name, err)
+				return processedEntries, err
+			}
+			// 确保目标目录存在
+			targetDir := filepath.Dir(targetPath)
+			if err := os.MkdirAll(targetDir, 0755); err != nil {
+				c.Errorf("Failed to create directory for hard link %s: %v", targetDir, err)
+				return processedEntries, fmt.Errorf("Failed to create directory: %w", err)
 			}
+			// 硬链接的源路径相对 baseDir, 同样不能指向 baseDir 之外
+			oldPath, err := safeEntryPath(baseDir, header.Linkname)
+			if err != nil {
+				c.Errorf("Path traversal detected for hard link source %s: %v", header.Linkname, err)
+				return processedEntries, err
+			}
+			if err := removeExisting(targetPath); err != nil {
+				c.Errorf("Failed to replace hard link %s: %v", targetPath, err)
+				return processedEntries, fmt.Errorf("Failed to replace hard link: %w", err)
+			}
+			err = os.Link(oldPath, targetPath)
+			if err != nil {
+				c.Errorf("Failed to create hard link %s -> %s: %v", targetPath, oldPath, err)
+				return processedEntries, fmt.Errorf("Failed to create hard link: %w", err)
+			}
+			processedEntries++ // 成功处理一个硬链接
+
+		default:
+			progress.Warnf(c, "Unhandled tar entry type for %s: %v", header.Name, header.Typeflag)
 		}
+	}
+}
 
-		// 成功处理所有条目后发送成功响应
-		if processedEntries > 0 { // 检查是否处理了至少一个有效条目
-			c.JSON(http.StatusOK, touka.H{"message": "success"})
-		} else {
-			c.JSON(http.StatusBadRequest, touka.H{"message": "No valid entries processed in tar file"})
+// removeExisting 删除 path 处已存在的文件, 目录或软链接
+func removeExisting(target string) error {
+	if _, err := os.Lstat(target); err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
+	}
+	return os.RemoveAll(target)
+}
 
+// removeEmptyParents 删除 dir 及其上层的空目录, 直到 baseDir 为止
+func removeEmptyParents(dir, baseDir string) {
+	// SafeTarExtractPath 返回绝对路径, baseDir 可能是相对路径
+	baseDir, err := filepath.Abs(baseDir)
+	if err != nil {
+		return
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	for ; dir != baseDir && strings.HasPrefix(dir, baseDir+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return // 非空或无法删除
+		}
 	}
 }
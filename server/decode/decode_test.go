@@ -0,0 +1,212 @@
+package decode
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"nemu-server/auth"
+	"nemu-server/config"
+	"nemu-server/release"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// entry 测试归档中的一个条目
+type entry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func file(name, body string) entry { return entry{name: name, typeflag: tar.TypeReg, body: body} }
+func symlink(name, target string) entry {
+	return entry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+
+func makeTar(t *testing.T, entries ...entry) *tar.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+// setup 创建 root/site 作为解压目录, root/outside 作为不应被写入的目录
+func setup(t *testing.T) (site, outside string) {
+	t.Helper()
+	root := t.TempDir()
+	site = filepath.Join(root, "site")
+	outside = filepath.Join(root, "outside")
+	for _, dir := range []string{site, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "victim.html"), []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return site, outside
+}
+
+func testContext() *touka.Context {
+	c, _ := touka.CreateTestContext(nil)
+	return c
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string // 解压前 site 中已有的软链接, 模拟增量部署的基准版本
+		entries  []entry
+	}{
+		{name: "dot dot entry", entries: []entry{file("../outside/index.html", "x")}},
+		{name: "symlink to parent then write", entries: []entry{symlink("x", ".."), file("x/outside/index.html", "x")}},
+		{name: "symlink to absolute path", entries: []entry{symlink("x", "/tmp")}},
+		{name: "symlink climbing out of subdirectory", entries: []entry{symlink("a/b", "../../outside")}},
+		{name: "dot dot after symlink", entries: []entry{symlink("s", "."), symlink("a", "s/..")}},
+		{name: "write through base symlink", existing: map[string]string{"x": "../outside"}, entries: []entry{file("x/index.html", "x")}},
+		{name: "directory through base symlink", existing: map[string]string{"x": "../outside"}, entries: []entry{{name: "x/sub/", typeflag: tar.TypeDir}}},
+		{name: "hard link through base symlink", existing: map[string]string{"x": "../outside"}, entries: []entry{{name: "copy.html", typeflag: tar.TypeLink, linkname: "x/victim.html"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site, outside := setup(t)
+			for name, target := range tt.existing {
+				if err := os.Symlink(target, filepath.Join(site, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := ExtractTar(testContext(), makeTar(t, tt.entries...), site)
+			if !errors.Is(err, ErrPathTraversal) {
+				t.Fatalf("ExtractTar error = %v, want ErrPathTraversal", err)
+			}
+			names, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 || names[0].Name() != "victim.html" {
+				t.Fatalf("outside directory was modified: %v", names)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(site), "index.html")); err == nil {
+				t.Fatal("file written to the parent of the site")
+			}
+		})
+	}
+}
+
+func TestExtractTarWhiteoutRejectsSymlinkParents(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing map[string]string // 解压前 site 中已有的软链接, 模拟增量部署的基准版本
+		entries  []entry
+	}{
+		{name: "whiteout through base symlink", existing: map[string]string{"x": "../outside"}, entries: []entry{file("x/.wh.victim.html", "")}},
+		{name: "whiteout through uploaded symlink", entries: []entry{symlink("x", "."), file("x/.wh.index.html", "")}},
+		{name: "whiteout of the site root", entries: []entry{file(".wh.", "")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site, outside := setup(t)
+			for name, target := range tt.existing {
+				if err := os.Symlink(target, filepath.Join(site, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := ExtractTar(testContext(), makeTar(t, tt.entries...), site)
+			if !errors.Is(err, ErrPathTraversal) {
+				t.Fatalf("ExtractTar error = %v, want ErrPathTraversal", err)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "victim.html")); err != nil {
+				t.Fatalf("whiteout removed a file outside the site: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractTarAllowsInternalSymlinks(t *testing.T) {
+	site, _ := setup(t)
+	entries := []entry{
+		file("docs/v1/index.html", "v1"),
+		symlink("docs/latest", "v1"),
+		symlink("docs/v1/home.html", "../../index.html"),
+		file("index.html", "home"),
+		file("docs/.wh.old.html", ""),
+	}
+	n, err := ExtractTar(testContext(), makeTar(t, entries...), site)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(entries) {
+		t.Fatalf("processed %d entries, want %d", n, len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(site, "docs", "latest", "index.html"))
+	if err != nil || string(data) != "v1" {
+		t.Fatalf("docs/latest/index.html = %q, %v", data, err)
+	}
+	data, err = os.ReadFile(filepath.Join(site, "docs", "v1", "home.html"))
+	if err != nil || string(data) != "home" {
+		t.Fatalf("docs/v1/home.html = %q, %v", data, err)
+	}
+}
+
+func TestExtractTarWhiteoutRemovesSymlinkOnly(t *testing.T) {
+	site, outside := setup(t)
+	if err := os.Symlink("../outside", filepath.Join(site, "x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractTar(testContext(), makeTar(t, file(".wh.x", "")), site); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(site, "x")); !os.IsNotExist(err) {
+		t.Fatalf("symlink x still exists: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "victim.html")); err != nil {
+		t.Fatalf("whiteout followed the symlink: %v", err)
+	}
+}
+
+func TestTrustedMetaStripsOrigin(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Server.Token = "default-token"
+	cfg.Tokens = []config.TokenConfig{{Name: "primary", Token: "peer-token", Peer: true}}
+	var origin string
+	r := touka.New()
+	r.POST("/nemu/upload", auth.Middleware(cfg), func(c *touka.Context) {
+		origin = trustedMeta(c, release.MetaFromHeader(c.Request.Header)).Origin
+	})
+
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{token: "default-token", want: ""},
+		{token: "peer-token", want: "20250101-000000-abcdef"},
+	}
+	for _, tt := range tests {
+		origin = "unset"
+		header := http.Header{"Nemu-Token": {tt.token}, release.HeaderOrigin: {"20250101-000000-abcdef"}}
+		touka.PerformRequest(r, http.MethodPost, "/nemu/upload", nil, header)
+		if origin != tt.want {
+			t.Errorf("token %s: origin = %q, want %q", tt.token, origin, tt.want)
+		}
+	}
+}
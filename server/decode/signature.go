@@ -0,0 +1,182 @@
+package decode
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/preview"
+	"nemu-server/release"
+	"nemu-server/seal"
+	"nemu-server/sign"
+	"net/http"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+var (
+	// ErrSignatureRequired 表示 signing.require 开启时收到了没有签名的上传
+	ErrSignatureRequired = errors.New("signed upload is required")
+	// ErrUnknownKey 表示签名的公钥不在 [[signing.keys]] 中
+	ErrUnknownKey = errors.New("signing key is not authorized")
+	// ErrSignatureExpired 表示签名时间与服务端时间相差超过 signing.maxAge
+	ErrSignatureExpired = errors.New("archive signature has expired")
+)
+
+// 请求上下文中保存签名状态的键
+const signatureKey = "nemu.signature"
+
+// signature 一次上传的签名状态
+type signature struct {
+	name      string // 签名者在 [[signing.keys]] 中的名称
+	key       ed25519.PublicKey
+	statement sign.Statement
+	verifier  *sign.Verifier // 流式上传时读取请求体末尾的签名, 分块上传时为 nil
+	maxAge    time.Duration  // signing.maxAge
+	verified  bool
+}
+
+// CheckSigningKeys 校验 [[signing.keys]] 中的公钥, 未命名的公钥以公钥本身为名称
+func CheckSigningKeys(cfg *config.Config) error {
+	for i, k := range cfg.Signing.Keys {
+		if _, err := sign.ParsePublicKey(k.Key); err != nil {
+			return fmt.Errorf("signing key %q: %w", k.Name, err)
+		}
+		if k.Name == "" {
+			cfg.Signing.Keys[i].Name = k.Key
+		}
+	}
+	if cfg.Signing.Require && len(cfg.Signing.Keys) == 0 {
+		return errors.New("signing.require is set but no [[signing.keys]] are configured")
+	}
+	return nil
+}
+
+// authorizedKey 返回公钥 encoded 在 [[signing.keys]] 中的名称
+func authorizedKey(cfg *config.Config, encoded string) (string, ed25519.PublicKey, error) {
+	pub, err := sign.ParsePublicKey(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, k := range cfg.Signing.Keys {
+		if allowed, err := sign.ParsePublicKey(k.Key); err == nil && pub.Equal(allowed) {
+			return k.Name, pub, nil
+		}
+	}
+	return "", nil, fmt.Errorf("%w: %s", ErrUnknownKey, encoded)
+}
+
+// VerifyUpload 处理流式上传的签名, 返回去掉末尾签名的请求体
+// 带有 Nemu-Signing-Key 时公钥必须已授权, 签名在解压完成后, 激活版本前由 extract 校验
+func VerifyUpload(c *touka.Context, cfg *config.Config, header http.Header, body io.Reader) (io.Reader, error) {
+	encoded := header.Get(sign.HeaderKey)
+	if encoded == "" {
+		if cfg.Signing.Require {
+			return nil, ErrSignatureRequired
+		}
+		return body, nil
+	}
+	name, pub, err := authorizedKey(cfg, encoded)
+	if err != nil {
+		return nil, err
+	}
+	meta := release.MetaFromHeader(header)
+	s := &signature{
+		name: name,
+		key:  pub,
+		statement: sign.Statement{
+			Encoding:   header.Get("Content-Encoding"),
+			Encryption: header.Get(seal.Header),
+			Base:       header.Get("Nemu-Base"),
+			Prefix:     header.Get(release.HeaderPrefix),
+			Preview:    header.Get(preview.HeaderName),
+			Expires:    header.Get(preview.HeaderExpires),
+			Password:   header.Get(preview.HeaderPassword),
+			Commit:     meta.Commit,
+			Dirty:      meta.Dirty,
+			Branch:     meta.Branch,
+			Author:     meta.Author,
+			Message:    meta.Message,
+		},
+		verifier: sign.NewVerifier(body),
+		maxAge:   time.Duration(cfg.Signing.MaxAge) * time.Second,
+	}
+	c.Set(signatureKey, s)
+	return s.verifier, nil
+}
+
+// VerifyDetached 校验分块上传 finalize 请求中的签名, statement 的 Time 由 detached 填写
+func VerifyDetached(c *touka.Context, cfg *config.Config, detached *sign.Detached, statement sign.Statement) error {
+	if detached == nil {
+		if cfg.Signing.Require {
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+	name, pub, err := authorizedKey(cfg, detached.Key)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(detached.Signature)
+	if err != nil {
+		return sign.ErrInvalid
+	}
+	statement.Time = detached.Time
+	s := &signature{name: name, key: pub, statement: statement, maxAge: time.Duration(cfg.Signing.MaxAge) * time.Second}
+	if err := s.verify(sig); err != nil {
+		return err
+	}
+	c.Set(signatureKey, s)
+	return nil
+}
+
+// verify 校验签名时间与签名
+func (s *signature) verify(sig []byte) error {
+	age := time.Since(time.Unix(s.statement.Time, 0))
+	if s.maxAge > 0 && (age > s.maxAge || age < -s.maxAge) {
+		return fmt.Errorf("%w: signed at %s", ErrSignatureExpired, time.Unix(s.statement.Time, 0).UTC().Format(time.RFC3339))
+	}
+	if err := sign.Verify(s.key, s.statement, sig); err != nil {
+		return err
+	}
+	s.verified = true
+	return nil
+}
+
+// checkSignature 读完请求体并校验流式上传末尾的签名, 没有签名时直接返回
+func checkSignature(c *touka.Context) error {
+	s := signatureFrom(c)
+	if s == nil || s.verifier == nil || s.verified {
+		return nil
+	}
+	digest, signed, sig, err := s.verifier.Finish()
+	if err != nil {
+		return err
+	}
+	s.statement.Digest, s.statement.Time = digest, signed
+	if err := s.verify(sig); err != nil {
+		return err
+	}
+	c.Infof("Archive signature verified for key %s", s.name)
+	return nil
+}
+
+func signatureFrom(c *touka.Context) *signature {
+	if v, ok := c.Get(signatureKey); ok {
+		if s, ok := v.(*signature); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// SignerName 返回已校验的签名者名称, 上传没有签名时为空
+func SignerName(c *touka.Context) string {
+	if s := signatureFrom(c); s != nil && s.verified {
+		return s.name
+	}
+	return ""
+}
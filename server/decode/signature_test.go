@@ -0,0 +1,169 @@
+package decode
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"nemu-server/sign"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func signingConfig(t *testing.T, require bool) (*config.Config, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := sign.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfig()
+	cfg.Signing.Require = require
+	cfg.Signing.MaxAge = 300
+	cfg.Signing.Keys = []config.SigningKeyConfig{{Name: "ci", Key: sign.EncodePublicKey(pub)}}
+	return cfg, priv
+}
+
+func TestCheckSigningKeys(t *testing.T) {
+	cfg, _ := signingConfig(t, true)
+	cfg.Signing.Keys[0].Name = ""
+	if err := CheckSigningKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Signing.Keys[0].Name != cfg.Signing.Keys[0].Key {
+		t.Fatalf("unnamed key is named %q", cfg.Signing.Keys[0].Name)
+	}
+
+	cfg.Signing.Keys[0].Key = "ed25519:AAAA"
+	if err := CheckSigningKeys(cfg); !errors.Is(err, sign.ErrFormat) {
+		t.Fatalf("CheckSigningKeys with a bad key = %v, want ErrFormat", err)
+	}
+	cfg.Signing.Keys = nil
+	if err := CheckSigningKeys(cfg); err == nil {
+		t.Fatal("signing.require without keys was accepted")
+	}
+}
+
+// upload 模拟流式上传: 读完 VerifyUpload 返回的请求体后校验签名
+func upload(cfg *config.Config, header http.Header, body []byte) (string, error) {
+	c := testContext()
+	r, err := VerifyUpload(c, cfg, header, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return "", err
+	}
+	if err := checkSignature(c); err != nil {
+		return "", err
+	}
+	return SignerName(c), nil
+}
+
+func TestVerifyUpload(t *testing.T) {
+	cfg, priv := signingConfig(t, true)
+	_, other, _ := sign.GenerateKey()
+	archive := []byte("archive")
+	st := sign.Statement{Encoding: "zstd", Prefix: "docs", Commit: "abc123"}
+	header := http.Header{
+		sign.HeaderKey:       {sign.EncodePublicKey(priv.Public().(ed25519.PublicKey))},
+		"Content-Encoding":   {"zstd"},
+		release.HeaderPrefix: {"docs"},
+		release.HeaderCommit: {"abc123"},
+	}
+	body, err := io.ReadAll(sign.NewReader(bytes.NewReader(archive), priv, st))
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(key, value string) http.Header {
+		h := header.Clone()
+		h.Set(key, value)
+		return h
+	}
+
+	name, err := upload(cfg, header, body)
+	if err != nil || name != "ci" {
+		t.Fatalf("upload = %q, %v", name, err)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   []byte
+		want   error
+	}{
+		{name: "unsigned", header: http.Header{}, body: archive, want: ErrSignatureRequired},
+		{name: "unknown key", header: with(sign.HeaderKey, sign.EncodePublicKey(other.Public().(ed25519.PublicKey))), body: body, want: ErrUnknownKey},
+		{name: "malformed key", header: with(sign.HeaderKey, "ed25519:AAAA"), body: body, want: sign.ErrFormat},
+		{name: "prefix changed", header: with(release.HeaderPrefix, "blog"), body: body, want: sign.ErrInvalid},
+		{name: "commit changed", header: with(release.HeaderCommit, "def456"), body: body, want: sign.ErrInvalid},
+		{name: "trailer missing", header: header, body: archive, want: sign.ErrTruncated},
+		{name: "signed by another key", header: header, body: func() []byte {
+			b, _ := io.ReadAll(sign.NewReader(bytes.NewReader(archive), other, st))
+			return b
+		}(), want: sign.ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := upload(cfg, tt.header, tt.body); !errors.Is(err, tt.want) {
+				t.Fatalf("upload error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyUploadOptional(t *testing.T) {
+	cfg, _ := signingConfig(t, false)
+	name, err := upload(cfg, http.Header{}, []byte("archive"))
+	if err != nil || name != "" {
+		t.Fatalf("unsigned upload = %q, %v", name, err)
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	cfg, priv := signingConfig(t, true)
+	st := sign.Statement{Digest: "abc", Preview: "pr-1"}
+	// detach 以指定时间签名 st
+	detach := func(st sign.Statement, at time.Time) *sign.Detached {
+		st.Time = at.Unix()
+		return &sign.Detached{
+			Key:       cfg.Signing.Keys[0].Key,
+			Time:      st.Time,
+			Signature: base64.StdEncoding.EncodeToString(sign.Sign(priv, st)),
+		}
+	}
+
+	c := testContext()
+	if err := VerifyDetached(c, cfg, sign.Detach(priv, st), st); err != nil {
+		t.Fatal(err)
+	}
+	if SignerName(c) != "ci" {
+		t.Fatalf("signer = %q", SignerName(c))
+	}
+
+	tests := []struct {
+		name     string
+		detached *sign.Detached
+		want     error
+	}{
+		{name: "missing", detached: nil, want: ErrSignatureRequired},
+		{name: "expired", detached: detach(st, time.Now().Add(-time.Hour)), want: ErrSignatureExpired},
+		{name: "from the future", detached: detach(st, time.Now().Add(time.Hour)), want: ErrSignatureExpired},
+		{name: "other digest", detached: sign.Detach(priv, sign.Statement{Digest: "def", Preview: "pr-1"}), want: sign.ErrInvalid},
+		{name: "bad base64", detached: &sign.Detached{Key: cfg.Signing.Keys[0].Key, Time: time.Now().Unix(), Signature: "!!!"}, want: sign.ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testContext()
+			if err := VerifyDetached(c, cfg, tt.detached, st); !errors.Is(err, tt.want) {
+				t.Fatalf("VerifyDetached error = %v, want %v", err, tt.want)
+			}
+			if SignerName(c) != "" {
+				t.Fatalf("rejected signature recorded signer %q", SignerName(c))
+			}
+		})
+	}
+}
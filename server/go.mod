@@ -5,16 +5,18 @@ go 1.24.4
 require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/WJQSERVER-STUDIO/go-utils/copyb v0.0.4
+	github.com/WJQSERVER-STUDIO/httpc v0.5.1
 	github.com/fenthope/compress v0.0.3
 	github.com/fenthope/reco v0.0.1
 	github.com/fenthope/record v0.0.3
 	github.com/infinite-iroha/touka v0.1.0
 	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.38.0
 )
 
 require (
-	github.com/WJQSERVER-STUDIO/httpc v0.5.1 // indirect
 	github.com/go-json-experiment/json v0.0.0-20250517221953-25912455fbc8 // indirect
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
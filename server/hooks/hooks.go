@@ -0,0 +1,173 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fenthope/reco"
+)
+
+// MaxOutput 钩子输出最多保留的字节数, 超出时只保留末尾
+const MaxOutput = 4096
+
+// 命令超时后等待其关闭输出的时间, 避免脱离进程组的子进程使钩子无法返回
+const waitDelay = 5 * time.Second
+
+// Runner 按 [hooks] 配置以 sh -c 执行钩子命令, 实现 release.Hooks
+//
+// 命令的工作目录为服务端的工作目录, 环境变量中提供版本信息:
+//
+//	NEMU_HOOK              pre-activate 或 post-activate
+//	NEMU_ACTION            deploy 或 rollback
+//	NEMU_RELEASE           版本 ID
+//	NEMU_RELEASE_DIR       版本目录的绝对路径
+//	NEMU_PREVIOUS_RELEASE  激活前的线上版本, 首次部署时为空
+//	NEMU_SITE_DIR          站点目录 (server.dir) 的绝对路径
+//	NEMU_BASE              增量部署的基准版本
+//	NEMU_ENTRIES           条目数量
+//	NEMU_SIZE              普通文件总字节数
+//	NEMU_GIT_COMMIT, NEMU_GIT_BRANCH, NEMU_GIT_AUTHOR, NEMU_GIT_DIRTY, NEMU_MESSAGE
+//	                       客户端提交的部署信息
+//
+// 版本目录中的文件可能是基准版本或去重对象的硬链接, 钩子只能以新文件替换, 不能原地写入
+type Runner struct {
+	cfg *config.Config
+	log *reco.Logger
+}
+
+func New(cfg *config.Config, log *reco.Logger) *Runner {
+	return &Runner{cfg: cfg, log: log}
+}
+
+// PreActivate 依次执行 hooks.preActivate, 任一命令失败 (非零退出或超时) 即返回错误
+func (h *Runner) PreActivate(ev release.Event) error {
+	for _, command := range h.cfg.Hooks.PreActivate {
+		output, err := h.run("pre-activate", command, ev)
+		if err != nil {
+			h.log.Errorf("Pre-activate hook %q for release %s failed: %v\n%s", command, ev.Release.ID, err, output)
+			if output != "" {
+				return fmt.Errorf("%w: %s: %v: %s", release.ErrHookFailed, command, err, output)
+			}
+			return fmt.Errorf("%w: %s: %v", release.ErrHookFailed, command, err)
+		}
+	}
+	return nil
+}
+
+// PostActivate 依次执行 hooks.postActivate, 失败时记录日志并继续执行后续命令
+func (h *Runner) PostActivate(ev release.Event) {
+	for _, command := range h.cfg.Hooks.PostActivate {
+		output, err := h.run("post-activate", command, ev)
+		if err != nil {
+			h.log.Warnf("Post-activate hook %q for release %s failed: %v\n%s", command, ev.Release.ID, err, output)
+		}
+	}
+}
+
+// run 执行一条命令, 返回合并后的标准输出与标准错误
+func (h *Runner) run(hook, command string, ev release.Event) (string, error) {
+	timeout := time.Duration(h.cfg.Hooks.Timeout) * time.Second
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// 输出同时逐行发送到部署请求的事件流
+	out := NewTailBuffer(MaxOutput)
+	log := ev.Progress.LogWriter(map[string]any{"hook": hook})
+	cmd := Command(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), h.env(hook, ev)...)
+	cmd.Stdout = io.MultiWriter(out, log)
+	cmd.Stderr = cmd.Stdout
+
+	ev.Progress.Event("hook", map[string]any{"hook": hook, "command": command, "status": "running"})
+	start := time.Now()
+	err := cmd.Run()
+	log.Close()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	result := map[string]any{"hook": hook, "command": command, "status": "ok", "duration_ms": time.Since(start).Milliseconds()}
+	if err != nil {
+		result["status"] = "failed"
+		result["error"] = err.Error()
+	} else {
+		h.log.Infof("%s hook %q for release %s finished in %s", hook, command, ev.Release.ID, time.Since(start).Round(time.Millisecond))
+	}
+	ev.Progress.Event("hook", result)
+	return strings.TrimSpace(out.String()), err
+}
+
+func (h *Runner) env(hook string, ev release.Event) []string {
+	site, err := filepath.Abs(h.cfg.Server.Dir)
+	if err != nil {
+		site = h.cfg.Server.Dir
+	}
+	rel := ev.Release
+	return []string{
+		"NEMU_HOOK=" + hook,
+		"NEMU_ACTION=" + ev.Action,
+		"NEMU_RELEASE=" + rel.ID,
+		"NEMU_RELEASE_DIR=" + ev.Dir,
+		"NEMU_PREVIOUS_RELEASE=" + ev.Previous,
+		"NEMU_SITE_DIR=" + site,
+		"NEMU_BASE=" + rel.Base,
+		"NEMU_PREFIX=" + rel.Prefix,
+		"NEMU_ENTRIES=" + strconv.Itoa(rel.Entries),
+		"NEMU_SIZE=" + strconv.FormatInt(rel.Size, 10),
+		"NEMU_GIT_COMMIT=" + rel.Commit,
+		"NEMU_GIT_BRANCH=" + rel.Branch,
+		"NEMU_GIT_AUTHOR=" + rel.Author,
+		"NEMU_GIT_DIRTY=" + strconv.FormatBool(rel.Dirty),
+		"NEMU_MESSAGE=" + rel.Message,
+	}
+}
+
+// Command 创建在独立进程组中运行的命令
+// ctx 结束时结束整个进程组, 包括命令启动的子进程; 不支持进程组的平台上只结束命令本身
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// TailBuffer 只保留最后 limit 字节的输出, 可以同时作为 Stdout 与 Stderr
+type TailBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int
+}
+
+func NewTailBuffer(limit int) *TailBuffer {
+	return &TailBuffer{limit: limit}
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *TailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
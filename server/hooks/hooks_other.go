@@ -0,0 +1,8 @@
+//go:build !unix
+
+package hooks
+
+import "os/exec"
+
+// setProcessGroup 不支持进程组, 取消时由 exec.CommandContext 结束命令本身
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -1,24 +1,29 @@
 package main
 
 import (
-	"compress/flate"
-	"compress/gzip"
 	"flag"
 	"fmt"
+	"nemu-server/auth"
+	"nemu-server/build"
 	"nemu-server/config"
 	"nemu-server/decode"
-	"nemu-server/errpage"
+	"nemu-server/hooks"
+	"nemu-server/manifest"
+	"nemu-server/notify"
+	"nemu-server/preview"
+	"nemu-server/release"
+	"nemu-server/replicate"
+	"nemu-server/serve"
+	"nemu-server/session"
+	"nemu-server/storage"
 	"net/http"
-	"strings"
 	"time"
 
 	"os"
 
-	"github.com/fenthope/compress"
 	"github.com/fenthope/reco"
 	"github.com/fenthope/record"
 	"github.com/infinite-iroha/touka"
-	"github.com/klauspost/compress/zstd"
 )
 
 var (
@@ -41,60 +46,20 @@ func init() {
 	loadConfig()
 }
 
-// Cache-Control中间件, 针对特定文件扩展名特殊处理
-func CacheControlMiddleware(maxAge int, extensions ...string) touka.HandlerFunc {
-	return func(c *touka.Context) {
-		// 判断路径文件扩展名
-		path := c.Request.URL.Path
-		applyCache := false
-		for _, ext := range extensions {
-			if strings.HasSuffix(path, "."+ext) {
-				applyCache = true
-				break
-			}
-		}
-
-		if applyCache {
-			c.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", maxAge))
-		} else {
-			c.SetHeader("Cache-Control", "public, max-age=3600, must-revalidate")
-		}
-
-		c.Next()
-	}
-}
-
 func main() {
 
 	r := touka.New()
 	r.Use(touka.Recovery())
 	r.Use(record.Middleware())
-	r.Use(CacheControlMiddleware(36000, "woff", "woff2", "ttf", "eot", "otf"))
-	r.Use(compress.Compression(compress.CompressOptions{
-		Algorithms: map[string]compress.AlgorithmConfig{
-			compress.EncodingGzip: {
-				Level:       gzip.BestCompression, // Gzip最高压缩比
-				PoolEnabled: true,                 // 启用Gzip压缩器的对象池
-			},
-			compress.EncodingDeflate: {
-				Level:       flate.DefaultCompression, // Deflate默认压缩比
-				PoolEnabled: false,                    // Deflate不启用对象池
-			},
-			compress.EncodingZstd: {
-				Level:       int(zstd.SpeedBestCompression), // Zstandard最佳压缩比
-				PoolEnabled: true,                           // 启用Zstandard压缩器的对象池
-			},
-		},
-
-		MinContentLength:  256,
-		CompressibleTypes: compress.DefaultCompressibleTypes,
-
-		EncodingPriority: []string{
-			compress.EncodingZstd,
-			compress.EncodingGzip,
-			compress.EncodingDeflate,
-		},
-	}))
+	// 站点文件的缓存头与压缩, 与 nemu serve 共用
+	serve.Use(r)
+	// 上传时指定 Nemu-Preview 的预览部署, 不影响线上版本
+	previews := preview.NewManager(cfg)
+	if err := preview.CheckConfig(cfg); err != nil {
+		fmt.Printf("Failed to load preview config: %v\n", err)
+		os.Exit(1)
+	}
+	r.Use(preview.Middleware(cfg, previews))
 
 	r.SetLogger(reco.Config{
 		Level:           reco.LevelInfo,
@@ -109,22 +74,92 @@ func main() {
 		DefaultFields:   nil,
 	})
 
-	r.POST("/nemu/upload", decode.MakeDecodeHandler(cfg))
+	// 版本保存在 [storage] 配置的存储中: 本地存储时 cfg.Server.Dir 为指向当前版本的软链接,
+	// S3 存储时站点直接从存储桶读取
+	st, err := storage.New(cfg)
+	if err != nil {
+		fmt.Printf("Failed to load storage config: %v\n", err)
+		os.Exit(1)
+	}
+	// 部署的版本复制到 [[replication.peers]] 中的节点
+	replicator, err := replicate.New(cfg, st, r.LogReco)
+	if err != nil {
+		fmt.Printf("Failed to load replication config: %v\n", err)
+		os.Exit(1)
+	}
+	// 每次上传生成一个新版本, 激活前后执行 [hooks] 中配置的命令
+	releases := release.NewManager(cfg, st, hooks.New(cfg, r.LogReco), replicator)
+	// 部署成功或失败时发送 [[notify.webhooks]] 通知
+	notifier, err := notify.New(cfg, r.LogReco)
+	if err != nil {
+		fmt.Printf("Failed to load notify config: %v\n", err)
+		os.Exit(1)
+	}
+	// 上传的签名以 [[signing.keys]] 中的公钥校验
+	if err := decode.CheckSigningKeys(cfg); err != nil {
+		fmt.Printf("Failed to load signing config: %v\n", err)
+		os.Exit(1)
+	}
+	r.POST("/nemu/upload", auth.Middleware(cfg), decode.MakeDecodeHandler(cfg, releases, previews, notifier))
+	r.POST("/nemu/diff", auth.Middleware(cfg), manifest.MakeDiffHandler(cfg, releases))
+	r.GET("/nemu/status", auth.Middleware(cfg), release.MakeStatusHandler(releases))
+	r.GET("/nemu/releases", auth.Middleware(cfg), release.MakeListHandler(releases))
+	r.POST("/nemu/rollback", auth.Middleware(cfg), release.MakeRollbackHandler(releases))
+	r.GET("/nemu/export", auth.Middleware(cfg), release.MakeExportHandler(releases))
+	r.GET("/nemu/previews", auth.Middleware(cfg), preview.MakeListHandler(previews))
+	r.DELETE("/nemu/previews/:name", auth.Middleware(cfg), preview.MakeDeleteHandler(previews))
+
+	// 预览部署在 /_preview/<name>/ 提供, 开启 preview.subdomain 时也以 <name>.preview.<domain> 提供
+	r.GET("/_preview/:name", preview.MakeRedirectHandler())
+	r.GET("/_preview/:name/*filepath", preview.MakeServeHandler(previews))
+	r.HEAD("/_preview/:name/*filepath", preview.MakeServeHandler(previews))
+
+	// 分块上传会话, 支持失败重试与断点续传
+	sessions := session.NewManager(cfg)
+	sessionGroup := r.Group("/nemu/session", auth.Middleware(cfg))
+	sessionGroup.POST("", session.MakeCreateHandler(sessions))
+	sessionGroup.GET("/:id", session.MakeStatusHandler(sessions))
+	sessionGroup.DELETE("/:id", session.MakeAbortHandler(sessions))
+	sessionGroup.PUT("/:id/chunk/:index", session.MakeChunkHandler(sessions))
+	sessionGroup.POST("/:id/finalize", session.MakeFinalizeHandler(cfg, sessions, releases, notifier))
+	// 服务端构建: 收到 push webhook 或手动触发后拉取仓库, 或接收上传的源码, 构建并部署
+	if cfg.Build.Enabled {
+		if cfg.Signing.Require {
+			r.LogReco.Warnf("signing.require is set, server builds and the git webhook will be refused")
+		}
+		if len(cfg.Build.Sandbox) == 0 {
+			if cfg.Build.AllowUnsandboxed {
+				r.LogReco.Warnf("build.allowUnsandboxed is set, uploaded sources are built without a sandbox")
+			} else {
+				r.LogReco.Warnf("build.sandbox is empty, source uploads to /nemu/build will be refused")
+			}
+		}
+		builder := build.NewBuilder(cfg, releases, notifier, r.LogReco)
+		r.POST("/nemu/hook/git", build.MakeWebhookHandler(cfg, builder))
+		r.POST("/nemu/build", auth.Middleware(cfg), build.MakeBuildHandler(cfg, builder))
+		r.GET("/nemu/build", auth.Middleware(cfg), build.MakeStatusHandler(builder))
+	}
+
 	r.GET("/nemu/health", func(c *touka.Context) {
 		c.String(http.StatusOK, "ok")
 	})
 
-	fs := http.Dir(cfg.Server.Dir)
-	r.SetUnMatchFS(fs)
-	r.SetErrorHandler(errpage.ErrorHandler)
-	r.SetProtocols(&touka.ProtocolsConfig{
-		Http1:           true,
-		Http2_Cleartext: true,
-	})
+	serve.StaticFS(r, st.FileSystem())
 
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	r.LogReco.Infof("Server is running on %s", addr)
-	err := r.RunShutdown(addr)
+	// 配置 [tls] 时以 HTTPS 提供服务, 可以以客户端证书认证 /nemu/* 接口
+	tlsConfig, err := auth.ServerTLS(cfg)
+	if err != nil {
+		fmt.Printf("Failed to load tls config: %v\n", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		r.LogReco.Infof("Server is running on %s (https)", addr)
+		err = r.RunWithTLS(addr, tlsConfig)
+	} else {
+		r.LogReco.Infof("Server is running on %s", addr)
+		err = r.RunShutdown(addr)
+	}
 	if err != nil {
 		r.LogReco.Errorf("Failed to start server: %v", err)
 	} else {
@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"net/http"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// DiffRequest 差异请求体, 包含客户端将要上传的文件清单
+type DiffRequest struct {
+	Files []Entry `json:"files"`
+}
+
+// MakeDiffHandler 比较客户端清单与线上版本, 只读取存储, 不做任何修改
+// POST /nemu/diff
+func MakeDiffHandler(cfg *config.Config, releases *release.Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		var req DiffRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Invalid diff request: %v", err)})
+			return
+		}
+
+		// 先取线上版本再比较, 比较期间发生部署时基于该版本的增量上传会被拒绝, 不会得到错误的结果
+		live := make(map[string]Entry)
+		current, _ := releases.Current()
+		var err error
+		if current != nil {
+			live, err = liveEntries(releases, current.ID)
+		}
+		var diff *Diff
+		if err == nil {
+			diff, err = Compare(live, func(path string) (string, error) {
+				return releaseHash(releases, current.ID, path)
+			}, req.Files)
+		}
+		if err != nil {
+			c.Errorf("Failed to compare manifest: %v", err)
+			c.JSON(http.StatusInternalServerError, touka.H{"message": fmt.Sprintf("Failed to compare manifest: %v", err)})
+			return
+		}
+		if current != nil {
+			diff.Release = current.ID
+		}
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+// liveEntries 返回版本的清单, 存储提供 sha256 时一并使用
+func liveEntries(releases *release.Manager, id string) (map[string]Entry, error) {
+	files, err := releases.Files(id)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]Entry, len(files))
+	for _, file := range files {
+		entries[file.Path] = Entry{Path: file.Path, Size: file.Size, SHA256: file.SHA256, Link: file.Link}
+	}
+	return entries, nil
+}
+
+func releaseHash(releases *release.Manager, id, path string) (string, error) {
+	f, err := releases.Open(id, path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,91 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Entry 清单中的一个文件
+// 普通文件使用 Size/SHA256, 软链接使用 Link
+type Entry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+// Change 一个发生变化的文件
+type Change struct {
+	Path    string `json:"path"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+// Diff 新清单相对于线上内容的差异
+type Diff struct {
+	Release      string   `json:"release,omitempty"` // 比较时的线上版本 ID, 可作为增量上传的基准
+	Added        []Change `json:"added"`
+	Modified     []Change `json:"modified"`
+	Deleted      []Change `json:"deleted"`
+	Unchanged    int      `json:"unchanged"`
+	BytesAdded   int64    `json:"bytes_added"`   // 新增与变大的字节数
+	BytesRemoved int64    `json:"bytes_removed"` // 删除与变小的字节数
+}
+
+// Compare 比较线上内容 live 与 incoming 清单
+// live 中没有 sha256 的文件只有在大小相同时才调用 hash 计算, 避免对整个站点做哈希
+func Compare(live map[string]Entry, hash func(path string) (string, error), incoming []Entry) (*Diff, error) {
+	diff := &Diff{
+		Added:    []Change{},
+		Modified: []Change{},
+		Deleted:  []Change{},
+	}
+	seen := make(map[string]bool, len(incoming))
+	for _, entry := range incoming {
+		seen[entry.Path] = true
+		old, ok := live[entry.Path]
+		if !ok {
+			diff.Added = append(diff.Added, Change{Path: entry.Path, NewSize: entry.Size})
+			diff.BytesAdded += entry.Size
+			continue
+		}
+
+		changed := old.Size != entry.Size || old.Link != entry.Link
+		if !changed && entry.Link == "" {
+			sum := old.SHA256
+			if sum == "" {
+				var err error
+				if sum, err = hash(entry.Path); err != nil {
+					return nil, fmt.Errorf("failed to hash %s: %w", entry.Path, err)
+				}
+			}
+			changed = sum != entry.SHA256
+		}
+		if !changed {
+			diff.Unchanged++
+			continue
+		}
+		diff.Modified = append(diff.Modified, Change{Path: entry.Path, OldSize: old.Size, NewSize: entry.Size})
+		if entry.Size > old.Size {
+			diff.BytesAdded += entry.Size - old.Size
+		} else {
+			diff.BytesRemoved += old.Size - entry.Size
+		}
+	}
+	for path, old := range live {
+		if seen[path] {
+			continue
+		}
+		diff.Deleted = append(diff.Deleted, Change{Path: path, OldSize: old.Size})
+		diff.BytesRemoved += old.Size
+	}
+
+	sortChanges(diff.Added)
+	sortChanges(diff.Modified)
+	sortChanges(diff.Deleted)
+	return diff, nil
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
@@ -0,0 +1,234 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+	"github.com/fenthope/reco"
+)
+
+// 事件名称
+const (
+	EventDeploySucceeded = "deploy.succeeded"
+	EventDeployFailed    = "deploy.failed"
+)
+
+// 重试间隔从 baseDelay 开始倍增, 最长 maxDelay
+const (
+	baseDelay = time.Second
+	maxDelay  = 30 * time.Second
+)
+
+const userAgent = "NemuServer/1.0"
+
+// Payload 通知内容, 未配置模板时以 JSON 发送, 配置模板时作为模板数据
+type Payload struct {
+	Event    string    `json:"event"`
+	Site     string    `json:"site"`
+	Time     time.Time `json:"time"`
+	Release  string    `json:"release,omitempty"` // 失败时为空
+	Base     string    `json:"base,omitempty"`    // 增量部署的基准版本
+	Prefix   string    `json:"prefix,omitempty"`  // 部分部署替换的子路径
+	Entries  int       `json:"entries"`           // 条目数量
+	Size     int64     `json:"size"`              // 普通文件总字节数
+	Token    string    `json:"token"`             // 上传使用的 Token 名称
+	Signer   string    `json:"signer,omitempty"`  // 签名者在 [[signing.keys]] 中的名称, 上传没有签名时为空
+	Duration int64     `json:"duration_ms"`       // 解压与激活的耗时
+	Error    string    `json:"error,omitempty"`   // 失败原因
+	Commit   string    `json:"commit,omitempty"`  // 客户端提交的部署信息
+	Branch   string    `json:"branch,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Dirty    bool      `json:"dirty,omitempty"`
+	Delivery string    `json:"delivery,omitempty"` // 本次通知的 ID, 与 Nemu-Delivery 头部相同
+}
+
+// DeployPayload 根据部署结果构造通知, err 不为空时为失败通知
+func DeployPayload(rel *release.Release, err error) Payload {
+	if err != nil {
+		return Payload{Event: EventDeployFailed, Error: err.Error()}
+	}
+	return Payload{Event: EventDeploySucceeded, Release: rel.ID, Entries: rel.Entries, Size: rel.Size}
+}
+
+// SetMeta 填入部署信息
+func (p *Payload) SetMeta(meta release.Meta) {
+	p.Commit = meta.Commit
+	p.Branch = meta.Branch
+	p.Author = meta.Author
+	p.Message = meta.Message
+	p.Dirty = meta.Dirty
+}
+
+// Notifier 将部署事件发送到 [[notify.webhooks]] 中配置的地址
+type Notifier struct {
+	cfg       *config.Config
+	log       *reco.Logger
+	client    *httpc.Client
+	templates []*template.Template // 与 cfg.Notify.Webhooks 一一对应, 未配置模板时为 nil
+}
+
+// 模板中可用的函数, json 将值编码为 JSON, 用于在模板中安全地嵌入字符串
+var funcs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// New 创建 Notifier, 模板有语法错误时返回错误
+func New(cfg *config.Config, log *reco.Logger) (*Notifier, error) {
+	n := &Notifier{
+		cfg: cfg,
+		log: log,
+		// 重试由 deliver 处理, 每次重试都需要重新构造请求体
+		client: httpc.New(httpc.WithRetryOptions(httpc.RetryOptions{MaxAttempts: 0})),
+	}
+	for i, hook := range cfg.Notify.Webhooks {
+		if hook.Template == "" {
+			n.templates = append(n.templates, nil)
+			continue
+		}
+		tmpl, err := template.New(fmt.Sprintf("webhook-%d", i)).Funcs(funcs).Parse(hook.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template for webhook %s: %w", hook.URL, err)
+		}
+		n.templates = append(n.templates, tmpl)
+	}
+	return n, nil
+}
+
+// Send 异步发送通知, 不会阻塞调用方
+func (n *Notifier) Send(p Payload) {
+	if n == nil || len(n.cfg.Notify.Webhooks) == 0 {
+		return
+	}
+	p.Site = n.cfg.Notify.Site
+	if p.Site == "" {
+		p.Site, _ = os.Hostname()
+	}
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	for i, hook := range n.cfg.Notify.Webhooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, p.Event) {
+			continue
+		}
+		go n.deliver(hook, n.templates[i], p)
+	}
+}
+
+// deliver 发送一个通知, 网络错误, 408, 429 与 5xx 按指数退避重试
+func (n *Notifier) deliver(hook config.WebhookConfig, tmpl *template.Template, p Payload) {
+	p.Delivery = newDeliveryID()
+	body, err := render(tmpl, p)
+	if err != nil {
+		n.log.Errorf("Failed to render webhook %s for %s: %v", hook.URL, p.Event, err)
+		return
+	}
+
+	delay := baseDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(hook, p, body)
+		if err == nil {
+			n.log.Infof("Webhook %s delivered %s (%s)", hook.URL, p.Event, p.Delivery)
+			return
+		}
+		if !retry || attempt >= n.cfg.Notify.Retries {
+			n.log.Warnf("Webhook %s failed to deliver %s after %d attempt(s): %v", hook.URL, p.Event, attempt+1, err)
+			return
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// post 发送一次请求, 返回是否值得重试
+func (n *Notifier) post(hook config.WebhookConfig, p Payload, body []byte) (bool, error) {
+	ctx := context.Background()
+	if n.cfg.Notify.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(n.cfg.Notify.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	contentType := hook.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	rb := n.client.NewRequestBuilder(http.MethodPost, hook.URL)
+	rb.WithContext(ctx)
+	rb.SetBody(bytes.NewReader(body))
+	rb.NoDefaultHeaders()
+	rb.SetHeader("User-Agent", userAgent)
+	rb.SetHeader("Content-Type", contentType)
+	rb.SetHeader("Nemu-Event", p.Event)
+	rb.SetHeader("Nemu-Delivery", p.Delivery)
+	if hook.Secret != "" {
+		// 每次重试重新签名, 接收方可以拒绝时间相差过大的请求, 防止重放截获的通知
+		timestamp := time.Now().Unix()
+		rb.SetHeader("Nemu-Timestamp", strconv.FormatInt(timestamp, 10))
+		rb.SetHeader("Nemu-Signature", Sign(hook.Secret, timestamp, body))
+	}
+	req, err := rb.Build()
+	if err != nil {
+		return false, err
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+}
+
+// Sign 返回 Nemu-Signature 头部的值: sha256=<"<timestamp>.<请求体>" 的 HMAC-SHA256, 十六进制>
+// timestamp 为 Nemu-Timestamp 头部中的 Unix 时间 (秒)
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func render(tmpl *template.Template, p Payload) ([]byte, error) {
+	if tmpl == nil {
+		return json.Marshal(p)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,170 @@
+package preview
+
+import (
+	"errors"
+	"nemu-server/config"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// info 接口返回的预览信息, 不包含密码
+type info struct {
+	Preview
+	Protected bool   `json:"protected"`
+	Path      string `json:"path"`
+}
+
+func newInfo(p *Preview) info {
+	i := info{Preview: *p, Protected: p.Protected(), Path: Path(p.Name)}
+	i.Password = ""
+	return i
+}
+
+// ErrorStatus 将预览错误映射为 HTTP 状态码
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrInvalidExpires):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MakeServeHandler 提供预览站点
+// GET /_preview/:name/*filepath
+func MakeServeHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		m.serve(c, c.Param("name"), c.Param("filepath"))
+	}
+}
+
+// MakeRedirectHandler 补全预览地址末尾的 /, 使页面中的相对路径正确
+// GET /_preview/:name
+func MakeRedirectHandler() touka.HandlerFunc {
+	return func(c *touka.Context) {
+		c.Redirect(http.StatusMovedPermanently, Path(c.Param("name")))
+	}
+}
+
+// CheckConfig 校验 [preview], 开启 subdomain 时必须配置 domain
+func CheckConfig(cfg *config.Config) error {
+	if cfg.Preview.Subdomain && strings.Trim(cfg.Preview.Domain, ".") == "" {
+		return errors.New("preview.subdomain is set but preview.domain is empty")
+	}
+	return nil
+}
+
+// Middleware 以 <name>.preview.<domain> 提供预览, 未开启 preview.subdomain 时不做任何处理
+// /nemu/ 下的管理接口不受影响
+func Middleware(cfg *config.Config, m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		if !cfg.Preview.Subdomain || strings.HasPrefix(c.Request.URL.Path, "/nemu/") {
+			c.Next()
+			return
+		}
+		name, ok := subdomain(c.Request.Host, cfg.Preview.Domain)
+		if !ok || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+			c.Next()
+			return
+		}
+		m.serve(c, name, c.Request.URL.Path)
+		c.Abort()
+	}
+}
+
+// subdomain 从 <name>.preview.<domain> 中取出预览名称
+// 只匹配配置的 domain, 名称必须是单个合法的标签; 其他域名 (例如 foo.preview.attacker.example 经由 CNAME 指向本服务) 不是预览
+func subdomain(host, domain string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain == "" {
+		return "", false
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	name, ok := strings.CutSuffix(host, ".preview."+domain)
+	if !ok || !namePattern.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// serve 以 http.FileServer 提供预览目录中的文件, 需要密码时以 HTTP Basic 认证校验
+// 不存在的预览与文件使用 errpage 渲染错误页面
+func (m *Manager) serve(c *touka.Context, name, file string) {
+	p, err := m.Get(name)
+	if err != nil {
+		c.ErrorUseHandle(http.StatusNotFound)
+		return
+	}
+	// 草稿不应被缓存或收录
+	c.SetHeader("Cache-Control", "private, no-cache")
+	c.SetHeader("X-Robots-Tag", "noindex")
+	if _, password, _ := c.Request.BasicAuth(); !p.Check(password) {
+		c.SetHeader("WWW-Authenticate", `Basic realm="nemu preview `+name+`", charset="UTF-8"`)
+		c.ErrorUseHandle(http.StatusUnauthorized)
+		return
+	}
+
+	if file == "" {
+		file = "/"
+	}
+	dir := http.Dir(m.Dir(name))
+	f, err := dir.Open(file)
+	if err != nil {
+		c.ErrorUseHandle(http.StatusNotFound)
+		return
+	}
+	f.Close()
+
+	req := c.Request.Clone(c.Request.Context())
+	req.URL.Path = file
+	req.URL.RawPath = ""
+	http.FileServer(dir).ServeHTTP(c.Writer, req)
+}
+
+// MakeListHandler 列出未过期的预览
+// GET /nemu/previews
+func MakeListHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		list, err := m.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, touka.H{"message": err.Error()})
+			return
+		}
+		previews := make([]info, 0, len(list))
+		for _, p := range list {
+			previews = append(previews, newInfo(p))
+		}
+		c.JSON(http.StatusOK, touka.H{"previews": previews})
+	}
+}
+
+// MakeDeleteHandler 删除预览
+// DELETE /nemu/previews/:name
+func MakeDeleteHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		name := c.Param("name")
+		if err := m.Remove(name); err != nil {
+			c.JSON(ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.Infof("Preview %s removed", name)
+		c.JSON(http.StatusOK, touka.H{"message": "success", "preview": name})
+	}
+}
+
+// Response 上传预览成功后的响应
+func Response(p *Preview) touka.H {
+	obj := touka.H{"message": "success", "preview": p.Name, "path": Path(p.Name), "entries": p.Entries}
+	if p.Expires != nil {
+		obj["expires"] = p.Expires
+	}
+	return obj
+}
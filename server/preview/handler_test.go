@@ -0,0 +1,30 @@
+package preview
+
+import "testing"
+
+func TestSubdomain(t *testing.T) {
+	tests := []struct {
+		host   string
+		domain string
+		name   string
+		ok     bool
+	}{
+		{host: "draft-1.preview.example.com", domain: "example.com", name: "draft-1", ok: true},
+		{host: "Draft-1.Preview.Example.com:8443", domain: "example.com", name: "draft-1", ok: true},
+		{host: "draft-1.preview.example.com.", domain: ".example.com.", name: "draft-1", ok: true},
+		{host: "draft-1.preview.attacker.example", domain: "example.com", ok: false},
+		{host: "draft-1.preview.example.com.attacker.example", domain: "example.com", ok: false},
+		{host: "a.b.preview.example.com", domain: "example.com", ok: false},
+		{host: ".preview.example.com", domain: "example.com", ok: false},
+		{host: "preview.example.com", domain: "example.com", ok: false},
+		{host: "example.com", domain: "example.com", ok: false},
+		{host: "-bad.preview.example.com", domain: "example.com", ok: false},
+		{host: "draft-1.preview.example.com", domain: "", ok: false},
+	}
+	for _, tt := range tests {
+		name, ok := subdomain(tt.host, tt.domain)
+		if ok != tt.ok || name != tt.name {
+			t.Errorf("subdomain(%q, %q) = %q, %v, want %q, %v", tt.host, tt.domain, name, ok, tt.name, tt.ok)
+		}
+	}
+}
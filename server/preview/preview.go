@@ -0,0 +1,272 @@
+package preview
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidName    = errors.New("invalid preview name")
+	ErrInvalidExpires = errors.New("invalid preview expiry")
+	ErrNotFound       = errors.New("preview not found")
+)
+
+// 上传请求头, 带有 HeaderName 的上传成为预览, 不影响线上版本
+const (
+	HeaderName     = "Nemu-Preview"
+	HeaderExpires  = "Nemu-Preview-Expires"  // 有效期, 如 24h; 0 表示不过期; 未指定时使用 preview.ttl
+	HeaderPassword = "Nemu-Preview-Password" // 访问密码的 sha512, 访问时以 HTTP Basic 认证输入密码
+)
+
+// 预览名称同时用作子域名, 只允许小写字母, 数字与中间的 -
+var namePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Preview 一个预览部署
+type Preview struct {
+	Name     string     `json:"name"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"` // 为 nil 时不过期
+	Entries  int        `json:"entries"`
+	Size     int64      `json:"size"`
+	Password string     `json:"password,omitempty"` // 访问密码的 sha512, 不在接口中返回
+	release.Meta
+}
+
+// Protected 是否需要密码访问
+func (p *Preview) Protected() bool {
+	return p.Password != ""
+}
+
+// Expired 是否已过期
+func (p *Preview) Expired(now time.Time) bool {
+	return p.Expires != nil && !now.Before(*p.Expires)
+}
+
+// Check 校验访问密码, 不需要密码时总是通过
+func (p *Preview) Check(password string) bool {
+	if !p.Protected() {
+		return true
+	}
+	sum := sha512.Sum512([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(p.Password))) == 1
+}
+
+// Options 上传预览时的选项
+type Options struct {
+	TTL      time.Duration // 有效期, 0 表示不过期
+	Password string        // 访问密码的 sha512, 为空表示不需要密码
+}
+
+// Manager 管理预览部署
+// 预览保存在 <release.dir>/previews/<name>/, 元数据位于 <name>.json; 只保存在本地, 不使用 [storage] 与复制
+type Manager struct {
+	cfg *config.Config
+	mu  sync.Mutex // 保护目录替换与元数据的读写
+}
+
+func NewManager(cfg *config.Config) *Manager {
+	return &Manager{cfg: cfg}
+}
+
+func (m *Manager) root() string {
+	return filepath.Join(m.cfg.Release.Dir, "previews")
+}
+
+// Dir 返回预览的站点目录
+func (m *Manager) Dir(name string) string {
+	return filepath.Join(m.root(), name)
+}
+
+func (m *Manager) metaPath(name string) string {
+	return filepath.Join(m.root(), name+".json")
+}
+
+// Options 从上传请求头读取预览选项
+func (m *Manager) Options(h http.Header) (Options, error) {
+	opts := Options{
+		TTL:      time.Duration(m.cfg.Preview.TTL) * time.Hour,
+		Password: strings.TrimSpace(h.Get(HeaderPassword)),
+	}
+	if raw := strings.TrimSpace(h.Get(HeaderExpires)); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl < 0 {
+			return opts, fmt.Errorf("%w: %q", ErrInvalidExpires, raw)
+		}
+		opts.TTL = ttl
+	}
+	return opts, nil
+}
+
+// Path 返回预览的访问路径
+func Path(name string) string {
+	return "/_preview/" + name + "/"
+}
+
+// Deploy 创建或替换名为 name 的预览, fill 向临时目录写入内容并返回条目数量
+// 写入完成后才替换已有的同名预览, 失败时保持原样; 顺带清理过期的预览
+func (m *Manager) Deploy(name string, opts Options, meta release.Meta, fill func(dir string) (int, error)) (*Preview, error) {
+	if !namePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	m.Cleanup()
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, err
+	}
+	// 临时目录与预览目录位于同一文件系统, 以便 rename 替换
+	tmp := filepath.Join(m.root(), ".staging-"+hex.EncodeToString(buf))
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create preview directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	entries, err := fill(tmp)
+	if err == nil && entries == 0 {
+		err = release.ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := &Preview{Name: name, Created: now, Entries: entries, Size: release.DirSize(tmp), Password: opts.Password, Meta: meta.Clean()}
+	if opts.TTL > 0 {
+		expires := now.Add(opts.TTL)
+		p.Expires = &expires
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := tmp + ".old"
+	if err := os.Rename(m.Dir(name), old); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to replace preview: %w", err)
+	}
+	defer os.RemoveAll(old)
+	if err := os.Rename(tmp, m.Dir(name)); err != nil {
+		os.Rename(old, m.Dir(name))
+		return nil, fmt.Errorf("failed to replace preview: %w", err)
+	}
+	if err := os.WriteFile(m.metaPath(name), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write preview metadata: %w", err)
+	}
+	return p, nil
+}
+
+// Get 返回未过期的预览, 已过期的预览在这里删除
+func (m *Manager) Get(name string) (*Preview, error) {
+	if !namePattern.MatchString(name) {
+		return nil, ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, err := m.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.Expired(time.Now()) {
+		m.remove(name)
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+// List 返回全部未过期的预览, 按创建时间倒序
+func (m *Manager) List() ([]*Preview, error) {
+	m.Cleanup()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := os.ReadDir(m.root())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	list := []*Preview{}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || file.IsDir() || !namePattern.MatchString(name) {
+			continue
+		}
+		if p, err := m.load(name); err == nil {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, nil
+}
+
+// Remove 删除预览
+func (m *Manager) Remove(name string) error {
+	if !namePattern.MatchString(name) {
+		return ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.load(name); err != nil {
+		return err
+	}
+	return m.remove(name)
+}
+
+// Cleanup 删除已过期的预览
+func (m *Manager) Cleanup() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	files, err := os.ReadDir(m.root())
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok || !namePattern.MatchString(name) {
+			continue
+		}
+		if p, err := m.load(name); err == nil && p.Expired(now) {
+			m.remove(name)
+		}
+	}
+}
+
+func (m *Manager) load(name string) (*Preview, error) {
+	data, err := os.ReadFile(m.metaPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	var p Preview
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode preview %s: %w", name, err)
+	}
+	return &p, nil
+}
+
+// remove 先删除元数据, 之后的请求不再能访问正在删除的目录
+func (m *Manager) remove(name string) error {
+	if err := os.Remove(m.metaPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(m.Dir(name))
+}
@@ -0,0 +1,264 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// ContentType 事件流的 Content-Type, 每行一个 JSON 对象
+const ContentType = "application/x-ndjson"
+
+// 单行日志的长度上限, 超出部分截断
+const maxLine = 4096
+
+// 事件流保存在请求上下文中的键
+const streamKey = "nemu.progress"
+
+// 暂停期间最多缓存的事件数量, 超出的事件丢弃并在恢复时报告数量
+const maxHeld = 1000
+
+// Stream 以 NDJSON 向客户端推送进度事件, 每个事件写入后立即 flush
+// 事件形如 {"event":"log","time":"...","line":"..."}; 响应状态码固定为 200, 结果由最后一个事件表示
+type Stream struct {
+	mu      sync.Mutex
+	c       *touka.Context
+	flusher http.Flusher
+	started bool
+	held    bool
+	queue   [][]byte
+	dropped int
+}
+
+// NewStream 创建事件流, 响应头在第一个事件时写入, 之后不能再使用 c.JSON 等方法
+// HTTP/1.x 下开始响应后无法继续读取请求体, 读取请求体期间应调用 Hold 暂停发送
+func NewStream(c *touka.Context) *Stream {
+	s := &Stream{c: c}
+	s.flusher, _ = c.Writer.(http.Flusher)
+	return s
+}
+
+// Accepts 客户端是否通过 Accept 头部请求事件流
+func Accepts(c *touka.Context) bool {
+	return strings.Contains(c.GetReqHeader("Accept"), ContentType)
+}
+
+// Attach 将事件流保存到请求上下文中, 之后可以通过 From 获取
+func Attach(c *touka.Context, s *Stream) {
+	c.Set(streamKey, s)
+}
+
+// From 返回请求上下文中的事件流, 没有时返回 nil
+func From(c *touka.Context) *Stream {
+	if v, ok := c.Get(streamKey); ok {
+		if s, ok := v.(*Stream); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// Warnf 记录警告日志, 并向请求的事件流发送 warning 事件
+func Warnf(c *touka.Context, format string, args ...any) {
+	c.Warnf(format, args...)
+	From(c).Event("warning", map[string]any{"message": fmt.Sprintf(format, args...)})
+}
+
+// Event 发送一个事件, fields 中的 event 与 time 会被覆盖
+// s 为 nil 时不做任何事, 便于在不需要推送进度的调用方中传入 nil
+func (s *Stream) Event(name string, fields map[string]any) {
+	if s == nil {
+		return
+	}
+	event := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["event"] = name
+	event["time"] = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held {
+		if len(s.queue) < maxHeld {
+			s.queue = append(s.queue, data)
+		} else {
+			s.dropped++
+		}
+		return
+	}
+	s.write(data)
+}
+
+// Hold 暂停发送, 之后的事件缓存到 Resume 时再发送
+func (s *Stream) Hold() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held = true
+}
+
+// Resume 发送暂停期间缓存的事件, 并恢复实时发送
+func (s *Stream) Resume() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.held = false
+	for _, data := range s.queue {
+		s.write(data)
+	}
+	s.queue = nil
+	if s.dropped > 0 {
+		data, _ := json.Marshal(map[string]any{
+			"event":   "warning",
+			"time":    time.Now().UTC(),
+			"message": fmt.Sprintf("%d more events omitted", s.dropped),
+		})
+		s.write(data)
+		s.dropped = 0
+	}
+}
+
+// takeHeld 尚未开始响应时取出暂停期间缓存的事件, 之后的事件仍然缓存而不发送
+// 已经开始响应时返回 false
+func (s *Stream) takeHeld() ([]json.RawMessage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return nil, false
+	}
+	events := make([]json.RawMessage, 0, len(s.queue))
+	for _, data := range s.queue {
+		events = append(events, data)
+	}
+	s.queue = nil
+	s.held = true
+	return events, true
+}
+
+// Started 是否已经开始响应; 尚未开始时调用方仍可以用普通的 JSON 响应报告错误
+func (s *Stream) Started() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.started
+}
+
+func (s *Stream) write(data []byte) {
+	if !s.started {
+		s.started = true
+		s.c.SetHeader("Content-Type", ContentType)
+		s.c.SetHeader("Cache-Control", "no-cache")
+		s.c.SetHeader("X-Accel-Buffering", "no") // 关闭 nginx 的响应缓冲
+		s.c.Writer.WriteHeader(http.StatusOK)
+	}
+	s.c.Writer.Write(append(data, '\n'))
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// LogWriter 返回一个 io.Writer, 写入的内容按行作为 log 事件发送
+// 结束后需调用 Close 发送最后不完整的一行
+func (s *Stream) LogWriter(fields map[string]any) *LineWriter {
+	return &LineWriter{stream: s, fields: fields}
+}
+
+// LineWriter 见 Stream.LogWriter
+type LineWriter struct {
+	mu     sync.Mutex
+	stream *Stream
+	fields map[string]any
+	buf    []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > maxLine {
+		w.send(w.buf)
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// Close 发送缓冲中剩余的内容
+func (w *LineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.send(w.buf)
+		w.buf = nil
+	}
+	return nil
+}
+
+func (w *LineWriter) send(line []byte) {
+	if len(line) > maxLine {
+		line = line[:maxLine]
+	}
+	fields := make(map[string]any, len(w.fields)+1)
+	for k, v := range w.fields {
+		fields[k] = v
+	}
+	fields["line"] = string(bytes.TrimRight(line, "\r"))
+	w.stream.Event("log", fields)
+}
+
+// JSON 发送请求的最终结果, 代替 c.JSON
+// 请求没有事件流时直接以 JSON 响应; 有事件流时成功结果作为 done 事件发送,
+// 错误在事件流已经开始时作为 error 事件发送 (附带 status 字段), 否则仍以 JSON 和对应的状态码响应,
+// 暂停期间缓存的事件 (例如解压时的警告) 放在响应的 events 字段中
+func JSON(c *touka.Context, code int, obj touka.H) {
+	s := From(c)
+	if s == nil {
+		c.JSON(code, obj)
+		return
+	}
+	if code >= http.StatusBadRequest {
+		// 先检查是否已经开始响应, 发送缓存的事件会开始响应, 错误就只能以 200 中的 error 事件报告
+		if events, ok := s.takeHeld(); ok {
+			if len(events) > 0 {
+				obj["events"] = events
+			}
+			c.JSON(code, obj)
+			return
+		}
+	}
+	s.Resume()
+	if code < http.StatusBadRequest {
+		s.Event("done", obj)
+		return
+	}
+	fields := make(map[string]any, len(obj)+1)
+	for k, v := range obj {
+		fields[k] = v
+	}
+	fields["status"] = code
+	s.Event("error", fields)
+}
@@ -0,0 +1,87 @@
+package progress
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/infinite-iroha/touka"
+)
+
+func newTestStream() (*touka.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := touka.CreateTestContext(w)
+	Attach(c, NewStream(c))
+	return c, w
+}
+
+// events 解析事件流中的事件名称
+func events(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var names []string
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var event struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", scanner.Text(), err)
+		}
+		names = append(names, event.Event)
+	}
+	return names
+}
+
+func TestJSONErrorBeforeStartKeepsStatus(t *testing.T) {
+	c, w := newTestStream()
+	stream := From(c)
+	stream.Hold()
+	stream.Event("warning", map[string]any{"message": "failed to change file permissions"})
+
+	JSON(c, http.StatusBadRequest, touka.H{"message": "path traversal detected"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); strings.Contains(ct, ContentType) {
+		t.Fatalf("Content-Type = %s, want a plain JSON response", ct)
+	}
+	var body struct {
+		Message string            `json:"message"`
+		Events  []json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Message != "path traversal detected" || len(body.Events) != 1 || !strings.Contains(string(body.Events[0]), "permissions") {
+		t.Fatalf("body = %s", w.Body)
+	}
+}
+
+func TestJSONErrorAfterStartIsEvent(t *testing.T) {
+	c, w := newTestStream()
+	stream := From(c)
+	stream.Event("received", nil)
+
+	JSON(c, http.StatusUnprocessableEntity, touka.H{"message": "pre-activate hook failed"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 once the stream has started", w.Code)
+	}
+	if got := strings.Join(events(t, w), ","); got != "received,error" {
+		t.Fatalf("events = %s", got)
+	}
+}
+
+func TestJSONSuccessFlushesHeldEvents(t *testing.T) {
+	c, w := newTestStream()
+	stream := From(c)
+	stream.Hold()
+	stream.Event("warning", map[string]any{"message": "slow disk"})
+
+	JSON(c, http.StatusOK, touka.H{"message": "success"})
+	if got := strings.Join(events(t, w), ","); got != "warning,done" {
+		t.Fatalf("events = %s", got)
+	}
+}
@@ -0,0 +1,72 @@
+package release
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/infinite-iroha/touka"
+	"github.com/klauspost/compress/zstd"
+)
+
+// HeaderRelease 导出响应中归档对应的版本 ID
+const HeaderRelease = "Nemu-Release"
+
+// 导出归档支持的压缩格式, 即 ?compress= 的取值
+const (
+	ExportGzip = "gzip"
+	ExportZstd = "zstd"
+)
+
+// MakeExportHandler 以 tar.gz 或 tar.zst 流式下载版本, 用于备份与灾难恢复
+// GET /nemu/export[?release=<id>][&compress=gzip|zstd]
+// 未指定 release 时导出线上版本; 归档内容与上传时相同, 可以直接重新上传部署
+// 开始传输后出错时无法再返回错误状态, 连接在归档结束前中断, 客户端解压时会发现归档不完整
+func MakeExportHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		format := strings.ToLower(strings.TrimSpace(c.Query("compress")))
+		ext := ".tar.gz"
+		switch format {
+		case "", ExportGzip:
+			format = ExportGzip
+		case ExportZstd:
+			ext = ".tar.zst"
+		default:
+			c.JSON(http.StatusBadRequest, touka.H{"message": "unsupported export compression: " + format})
+			return
+		}
+
+		rel, err := m.Get(c.Query("release"))
+		if err != nil {
+			c.JSON(ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+
+		c.SetHeader("Content-Type", "application/"+format)
+		c.SetHeader("Content-Disposition", `attachment; filename="`+rel.ID+ext+`"`)
+		c.SetHeader(HeaderRelease, rel.ID)
+		c.SetHeader("Cache-Control", "no-store")
+		c.Writer.WriteHeader(http.StatusOK)
+
+		var zw io.WriteCloser
+		if format == ExportZstd {
+			if zw, err = zstd.NewWriter(c.Writer); err != nil {
+				c.Errorf("Failed to export release %s: %v", rel.ID, err)
+				return
+			}
+		} else {
+			zw = gzip.NewWriter(c.Writer)
+		}
+		// 出错时不关闭压缩流, 以免写出看似完整的归档
+		if err := m.WriteTar(c.Request.Context(), rel.ID, zw); err != nil {
+			c.Errorf("Failed to export release %s: %v", rel.ID, err)
+			return
+		}
+		if err := zw.Close(); err != nil {
+			c.Errorf("Failed to export release %s: %v", rel.ID, err)
+			return
+		}
+		c.Infof("Release %s exported as %s", rel.ID, format)
+	}
+}
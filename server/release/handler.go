@@ -0,0 +1,124 @@
+package release
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// RollbackRequest 回滚请求体, Release 为空时回滚到上一个版本
+type RollbackRequest struct {
+	Release string `json:"release"`
+}
+
+// 部署元数据请求头, 值经过 URL 编码 (url.QueryEscape), 以便携带非 ASCII 字符与换行
+const (
+	HeaderCommit  = "Nemu-Git-Commit"
+	HeaderDirty   = "Nemu-Git-Dirty"
+	HeaderBranch  = "Nemu-Git-Branch"
+	HeaderAuthor  = "Nemu-Git-Author"
+	HeaderMessage = "Nemu-Message"
+	HeaderOrigin  = "Nemu-Origin" // 节点间复制时为来源节点上的版本 ID
+)
+
+// HeaderPrefix 部分部署的子路径, 上传的内容只替换线上版本中的这一部分
+const HeaderPrefix = "Nemu-Prefix"
+
+// MetaFromHeader 从上传请求头读取部署元数据, 无法解码的字段按原值保存
+func MetaFromHeader(h http.Header) Meta {
+	get := func(key string) string {
+		v := h.Get(key)
+		if decoded, err := url.QueryUnescape(v); err == nil {
+			return decoded
+		}
+		return v
+	}
+	dirty, _ := strconv.ParseBool(h.Get(HeaderDirty))
+	return Meta{
+		Commit:  get(HeaderCommit),
+		Dirty:   dirty,
+		Branch:  get(HeaderBranch),
+		Author:  get(HeaderAuthor),
+		Message: get(HeaderMessage),
+		Origin:  get(HeaderOrigin),
+	}
+}
+
+// ErrorStatus 将版本错误映射为 HTTP 状态码
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrNotActive):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrEmpty), errors.Is(err, ErrInvalidPrefix):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoPrevious), errors.Is(err, ErrBaseChanged), errors.Is(err, ErrNoCurrent):
+		return http.StatusConflict
+	case errors.Is(err, ErrHookFailed):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrQuorum):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MakeStatusHandler 返回当前线上版本
+// GET /nemu/status
+func MakeStatusHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		list, err := m.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, touka.H{"message": err.Error()})
+			return
+		}
+		current, err := m.Current()
+		if err != nil && !errors.Is(err, ErrNotActive) && !errors.Is(err, ErrNotFound) {
+			c.JSON(ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, touka.H{
+			"release":  current,
+			"releases": len(list),
+		})
+	}
+}
+
+// MakeListHandler 返回全部版本, 按时间倒序
+// GET /nemu/releases
+func MakeListHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		list, err := m.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, touka.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, touka.H{"releases": list})
+	}
+}
+
+// MakeRollbackHandler 切换线上版本
+// POST /nemu/rollback
+func MakeRollbackHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		var req RollbackRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Invalid rollback request: %v", err)})
+				return
+			}
+		}
+
+		rel, err := m.Rollback(req.Release)
+		if err != nil {
+			c.Warnf("Rollback to %q failed: %v", req.Release, err)
+			c.JSON(ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.Infof("Rolled back to release %s", rel.ID)
+		c.JSON(http.StatusOK, touka.H{"message": "success", "release": rel.ID})
+	}
+}
@@ -0,0 +1,632 @@
+package release
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/progress"
+	"nemu-server/storage"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrNotFound    = storage.ErrNotFound
+	ErrNoPrevious  = errors.New("no previous release to roll back to")
+	ErrEmpty       = errors.New("no valid entries processed in tar file")
+	ErrNotActive   = storage.ErrNotActive
+	ErrInvalidName = errors.New("invalid release id")
+	ErrBaseChanged = errors.New("base release is no longer active")
+	ErrHookFailed  = errors.New("pre-activate hook failed")
+	ErrQuorum      = errors.New("replication quorum not reached")
+	// ErrInvalidPrefix 表示部分部署的子路径为空或试图离开站点目录
+	ErrInvalidPrefix = errors.New("invalid deploy prefix")
+	// ErrNoCurrent 表示部分部署时没有可以复制其余内容的线上版本
+	ErrNoCurrent = errors.New("partial deploy requires an active release")
+)
+
+// 激活版本的原因, 即 Event.Action
+const (
+	ActionDeploy   = "deploy"
+	ActionRollback = "rollback"
+)
+
+// Event 激活版本时传给 Hooks 的信息
+type Event struct {
+	Action   string           // ActionDeploy 或 ActionRollback
+	Release  *Release         // 将被激活的版本
+	Dir      string           // 版本目录的绝对路径, 版本不保存在本地时回滚为空; 其中的文件可能与其他版本共享 inode, 只读
+	Previous string           // 激活前的线上版本, 首次部署时为空
+	Progress *progress.Stream // 部署请求的事件流, 钩子的执行过程与输出发送到这里, 可为 nil
+}
+
+// Hooks 在版本激活前后执行的操作
+type Hooks interface {
+	// PreActivate 返回错误时放弃激活, 线上版本保持不变
+	PreActivate(ev Event) error
+	// PostActivate 在版本激活后执行, 此时已无法撤销
+	PostActivate(ev Event)
+}
+
+// Replicator 将本节点部署的版本复制到其他节点
+type Replicator interface {
+	// Replicate 在版本发布之后, 本节点激活之前调用, 返回各节点的结果
+	// 返回错误 (通常包装 ErrQuorum) 时部署视为失败, 本节点放弃该版本
+	Replicate(ev Event) ([]Replica, error)
+}
+
+// Replica 版本复制到一个节点的结果
+type Replica struct {
+	Peer     string `json:"peer"`
+	Status   string `json:"status"`            // ok 或 failed
+	Release  string `json:"release,omitempty"` // 节点上生成的版本 ID
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+// 版本 ID 形如 20060102-150405-a1b2c3, 前缀为创建时间 (UTC)
+var idPattern = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-f]{6}$`)
+
+// Release 一次部署产生的版本, 内容与元数据由 storage.Storage 保存
+type Release struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Entries int       `json:"entries"`          // 解压的条目数量
+	Size    int64     `json:"size"`             // 普通文件总字节数
+	Base    string    `json:"base,omitempty"`   // 增量部署的基准版本, 部分部署时为复制其余内容的版本
+	Prefix  string    `json:"prefix,omitempty"` // 部分部署替换的子路径, 如 docs
+	Active  bool      `json:"active,omitempty"` // 是否为当前线上版本, 不写入元数据文件
+	Meta
+
+	Replicas []Replica `json:"replicas,omitempty"` // 部署时复制到其他节点的结果, 只在部署的响应中返回
+}
+
+// Meta 客户端随部署提交的说明信息, 均为可选
+type Meta struct {
+	Commit  string `json:"commit,omitempty"`  // 站点仓库的 git commit
+	Dirty   bool   `json:"dirty,omitempty"`   // 工作区是否有未提交的修改
+	Branch  string `json:"branch,omitempty"`  // git 分支
+	Author  string `json:"author,omitempty"`  // commit 作者, 形如 name <email>
+	Message string `json:"message,omitempty"` // 部署说明 (nemu deploy -m)
+	Origin  string `json:"origin,omitempty"`  // 由其他节点复制而来时为来源节点上的版本 ID, 这样的版本不再复制
+}
+
+// 元数据字段的长度上限, 超出部分截断
+const (
+	maxMetaField   = 256
+	maxMetaMessage = 4096
+)
+
+// Clean 去除首尾空白与控制字符并截断过长的字段
+func (m Meta) Clean() Meta {
+	return Meta{
+		Commit:  cleanField(m.Commit, maxMetaField, false),
+		Dirty:   m.Dirty,
+		Branch:  cleanField(m.Branch, maxMetaField, false),
+		Author:  cleanField(m.Author, maxMetaField, false),
+		Message: cleanField(m.Message, maxMetaMessage, true),
+		Origin:  cleanField(m.Origin, maxMetaField, false),
+	}
+}
+
+// cleanField multiline 为 true 时保留换行
+func cleanField(s string, limit int, multiline bool) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' && multiline {
+			return r
+		}
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(s))
+	if len(s) <= limit {
+		return s
+	}
+	// 按字符边界截断, 避免产生无效的 UTF-8
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit]
+}
+
+// Manager 管理版本, 版本的保存与线上版本的切换由 storage.Storage 完成
+type Manager struct {
+	cfg        *config.Config
+	st         storage.Storage
+	hooks      Hooks        // 可为 nil
+	replicator Replicator   // 可为 nil
+	deployMu   sync.Mutex   // 同一时间只允许一个部署或回滚完成基准检查, 钩子, 复制与切换
+	mu         sync.RWMutex // 切换线上版本时持有写锁, 读取版本时持有读锁
+}
+
+func NewManager(cfg *config.Config, st storage.Storage, hooks Hooks, replicator Replicator) *Manager {
+	return &Manager{cfg: cfg, st: st, hooks: hooks, replicator: replicator}
+}
+
+func newID(now time.Time) (string, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", fmt.Errorf("failed to generate release id: %w", err)
+	}
+	return now.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(buf), nil
+}
+
+// Deploy 创建新版本目录并调用 fill 写入内容, 成功后激活该版本并清理旧版本
+// fill 返回写入的条目数量, 为 0 或出错时删除新版本, 线上版本保持不变
+// base 不为空时为增量部署: base 必须是当前线上版本, 新版本先复制 base 的内容,
+// fill 写入文件前需先删除同名文件, 以免修改到 base 中共享的 inode
+// 版本不保存在本地时 (例如 S3 存储), fill 写入 <release.dir>/staging 下的临时目录, 发布后删除
+// meta 随版本保存, 在 status 与版本列表中返回
+// fill 在锁外执行, 接收请求体期间不阻塞其他部署与读取; 加锁后再次检查 base 是否仍是线上版本
+// 激活前后分别执行 pre-activate 与 post-activate 钩子, post-activate 在释放锁之后执行
+// 激活前将版本复制到其他节点 (meta.Origin 不为空时除外), 未达到复制的法定数量时返回 ErrQuorum, 本节点不激活该版本
+// stream 不为 nil 时向其发送激活, 钩子与复制的进度
+func (m *Manager) Deploy(base string, meta Meta, stream *progress.Stream, fill func(dir string) (int, error)) (*Release, error) {
+	return m.run(base, "", meta, stream, fill)
+}
+
+// DeployPrefix 部分部署: 新版本复制当前线上版本, 只把子路径 prefix 替换为 fill 写入的内容
+// fill 收到的是一个空的暂存目录, 返回的条目数量只计算该目录中的内容;
+// 加锁后才复制当时的线上版本并把暂存目录放到 prefix 处, 不会覆盖 fill 期间的其他部署
+// 没有线上版本时返回 ErrNoCurrent; 其余行为与 Deploy 相同
+func (m *Manager) DeployPrefix(prefix string, meta Meta, stream *progress.Stream, fill func(dir string) (int, error)) (*Release, error) {
+	prefix, err := CleanPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return m.run("", prefix, meta, stream, fill)
+}
+
+func (m *Manager) run(base, prefix string, meta Meta, stream *progress.Stream, fill func(dir string) (int, error)) (*Release, error) {
+	rel, ev, err := m.deploy(base, prefix, meta, stream, fill)
+	if ev.Release != nil {
+		m.postActivate(ev)
+		if m.st.Dir(ev.Release.ID) == "" {
+			os.RemoveAll(ev.Dir)
+		}
+	}
+	return rel, err
+}
+
+func (m *Manager) deploy(base, prefix string, meta Meta, stream *progress.Stream, fill func(dir string) (int, error)) (*Release, Event, error) {
+	ctx := context.Background()
+
+	// 先检查一次, 不必读完请求体才发现无法部署
+	previous, _ := m.current()
+	if base != "" && previous != base {
+		return nil, Event{}, ErrBaseChanged
+	}
+	if prefix != "" && previous == "" {
+		return nil, Event{}, ErrNoCurrent
+	}
+
+	now := time.Now()
+	id, err := newID(now)
+	if err != nil {
+		return nil, Event{}, err
+	}
+	dir := m.st.Dir(id)
+	staged := dir == ""
+	if staged {
+		dir = filepath.Join(m.cfg.Release.Dir, "staging", id)
+	}
+	// discard 放弃新版本; 发布失败时存储中可能已有部分内容, 一并删除
+	discard := func() {
+		os.RemoveAll(dir)
+		if !staged {
+			m.st.Remove(ctx, []string{id})
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, Event{}, fmt.Errorf("failed to create release directory: %w", err)
+	}
+	if base != "" {
+		if err := m.st.Checkout(ctx, base, dir); err != nil {
+			os.RemoveAll(dir)
+			return nil, Event{}, fmt.Errorf("failed to clone release %s: %w", base, err)
+		}
+	}
+
+	target := dir
+	if prefix != "" {
+		target = filepath.Join(m.cfg.Release.Dir, "staging", id+".prefix")
+		defer os.RemoveAll(target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, Event{}, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+
+	entries, err := fill(target)
+	if err == nil && entries == 0 {
+		err = ErrEmpty
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, Event{}, err
+	}
+
+	m.deployMu.Lock()
+	defer m.deployMu.Unlock()
+	previous, _ = m.current()
+	if base != "" && previous != base {
+		os.RemoveAll(dir)
+		return nil, Event{}, ErrBaseChanged
+	}
+	// 部分部署以锁内读到的线上版本为基准, 不会覆盖其间的其他部署
+	if prefix != "" {
+		if previous == "" {
+			os.RemoveAll(dir)
+			return nil, Event{}, ErrNoCurrent
+		}
+		base = previous
+		if err := m.checkoutPrefix(ctx, base, dir, prefix, target); err != nil {
+			os.RemoveAll(dir)
+			return nil, Event{}, err
+		}
+	}
+
+	rel := &Release{ID: id, Created: now, Entries: entries, Size: DirSize(dir), Base: base, Prefix: prefix, Meta: meta.Clean()}
+	ev, err := m.preActivate(ActionDeploy, rel, dir, previous, stream)
+	if err == nil {
+		err = m.publish(ctx, rel, dir, stream)
+	}
+	// 复制在锁内, 本节点激活之前进行: 保证各节点按部署的顺序激活, 未达到法定数量时本节点保持原有版本
+	// 已激活新版本的节点不会回滚, 其结果见 ErrQuorum 的说明与 replicated 事件
+	if err == nil && m.replicator != nil && rel.Origin == "" {
+		rel.Replicas, err = m.replicator.Replicate(ev)
+	}
+	if err != nil {
+		discard()
+		return nil, Event{}, err
+	}
+	m.mu.Lock()
+	err = m.st.Activate(ctx, id)
+	m.mu.Unlock()
+	if err != nil {
+		if staged {
+			os.RemoveAll(dir)
+		}
+		return nil, Event{}, err
+	}
+	rel.Active = true
+	stream.Event("activated", map[string]any{"release": id, "previous": previous})
+	m.prune(ctx, stream)
+	return rel, ev, nil
+}
+
+// CleanPrefix 规范化部分部署的子路径: 以 / 分隔, 去除首尾的 /
+// 为空, 指向站点根目录或包含 .. 时返回 ErrInvalidPrefix
+func CleanPrefix(prefix string) (string, error) {
+	raw := strings.Trim(strings.ReplaceAll(prefix, "\\", "/"), "/")
+	for _, part := range strings.Split(raw, "/") {
+		if part == ".." || strings.ContainsRune(part, 0) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPrefix, prefix)
+		}
+	}
+	cleaned := strings.Trim(path.Clean("/"+raw), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPrefix, prefix)
+	}
+	return cleaned, nil
+}
+
+// checkoutPrefix 将版本 base 复制到 dir, 再以暂存目录 staged 替换其中的子路径 prefix
+func (m *Manager) checkoutPrefix(ctx context.Context, base, dir, prefix, staged string) error {
+	if err := m.st.Checkout(ctx, base, dir); err != nil {
+		return fmt.Errorf("failed to clone release %s: %w", base, err)
+	}
+	target, err := clearPrefix(dir, prefix)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", prefix, err)
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", prefix, err)
+	}
+	return nil
+}
+
+// clearPrefix 删除新版本中 prefix 的旧内容并重新创建为空目录, 返回该目录
+// 从基准版本复制来的路径中, 途经的软链接或文件也被替换为目录, 写入不会经由软链接离开版本目录
+func clearPrefix(dir, prefix string) (string, error) {
+	target := dir
+	for _, part := range strings.Split(prefix, "/") {
+		target = filepath.Join(target, part)
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return "", fmt.Errorf("failed to replace %s: %w", prefix, err)
+			}
+		}
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return "", fmt.Errorf("failed to clear %s: %w", prefix, err)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", prefix, err)
+	}
+	return target, nil
+}
+
+// publish 保存版本内容与元数据, 存储去重的结果以 deduplicated 事件发送
+func (m *Manager) publish(ctx context.Context, rel *Release, dir string, stream *progress.Stream) error {
+	stored := *rel
+	stored.Active = false
+	data, err := json.MarshalIndent(&stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	stats, err := m.st.Publish(ctx, rel.ID, dir, data)
+	warn(stream, stats)
+	if err != nil {
+		return fmt.Errorf("failed to publish release: %w", err)
+	}
+	if stats.Files > 0 {
+		stream.Event("deduplicated", map[string]any{"files": stats.Files, "reused": stats.Reused, "saved": stats.Saved})
+	}
+	return nil
+}
+
+// Rollback 激活指定版本, id 为空时回滚到当前版本的上一个版本
+// 与部署相同, 激活前后执行钩子, pre-activate 失败时不切换
+func (m *Manager) Rollback(id string) (*Release, error) {
+	rel, ev, err := m.rollback(id)
+	if err != nil {
+		return nil, err
+	}
+	m.postActivate(ev)
+	return rel, nil
+}
+
+func (m *Manager) rollback(id string) (*Release, Event, error) {
+	m.deployMu.Lock()
+	defer m.deployMu.Unlock()
+
+	current, _ := m.current()
+	if id == "" {
+		list, err := m.list()
+		if err != nil {
+			return nil, Event{}, err
+		}
+		for i, rel := range list {
+			// list 按时间倒序, 当前版本之后的第一个即上一个版本
+			if rel.ID == current && i+1 < len(list) {
+				id = list[i+1].ID
+				break
+			}
+		}
+		if id == "" {
+			return nil, Event{}, ErrNoPrevious
+		}
+	}
+
+	rel, err := m.load(id)
+	if err != nil {
+		return nil, Event{}, err
+	}
+	// 版本不保存在本地时钩子拿不到版本目录
+	ev, err := m.preActivate(ActionRollback, rel, m.st.Dir(id), current, nil)
+	if err != nil {
+		return nil, Event{}, err
+	}
+	m.mu.Lock()
+	err = m.st.Activate(context.Background(), id)
+	m.mu.Unlock()
+	if err != nil {
+		return nil, Event{}, err
+	}
+	rel.Active = true
+	return rel, ev, nil
+}
+
+// preActivate 执行 pre-activate 钩子, 返回之后传给 post-activate 的 Event
+func (m *Manager) preActivate(action string, rel *Release, dir, previous string, stream *progress.Stream) (Event, error) {
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return Event{}, err
+		}
+		dir = abs
+	}
+	ev := Event{Action: action, Release: rel, Dir: dir, Previous: previous, Progress: stream}
+	if m.hooks != nil {
+		if err := m.hooks.PreActivate(ev); err != nil {
+			return Event{}, err
+		}
+	}
+	return ev, nil
+}
+
+func (m *Manager) postActivate(ev Event) {
+	if m.hooks != nil {
+		m.hooks.PostActivate(ev)
+	}
+}
+
+// Current 返回当前线上版本
+func (m *Manager) Current() (*Release, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, err := m.current()
+	if err != nil {
+		return nil, err
+	}
+	rel, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	rel.Active = true
+	return rel, nil
+}
+
+// Get 返回版本 id, id 为空时返回当前线上版本
+func (m *Manager) Get(id string) (*Release, error) {
+	if id == "" {
+		return m.Current()
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rel, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := m.current()
+	rel.Active = rel.ID == current
+	return rel, nil
+}
+
+// List 返回全部版本, 按时间倒序
+func (m *Manager) List() ([]*Release, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.list()
+}
+
+// Files 返回版本中的文件与软链接
+func (m *Manager) Files(id string) ([]storage.File, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrInvalidName
+	}
+	return m.st.Files(context.Background(), id)
+}
+
+// Open 打开版本中的一个普通文件
+func (m *Manager) Open(id, name string) (io.ReadCloser, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrInvalidName
+	}
+	return m.st.Open(context.Background(), id, name)
+}
+
+// WriteTar 将版本 id 写为 tar (不压缩), 与复制到其他节点的归档内容相同
+// 写入期间版本被清理时返回错误, 此时已写入的内容不完整
+func (m *Manager) WriteTar(ctx context.Context, id string, w io.Writer) error {
+	if !idPattern.MatchString(id) {
+		return ErrInvalidName
+	}
+	files, err := m.st.Files(ctx, id)
+	if err != nil {
+		return err
+	}
+	return storage.WriteTar(ctx, m.st, id, files, w)
+}
+
+func (m *Manager) list() ([]*Release, error) {
+	ids, err := m.st.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	current, _ := m.current()
+
+	list := []*Release{}
+	for _, id := range ids {
+		if !idPattern.MatchString(id) {
+			continue
+		}
+		rel, err := m.load(id)
+		if err != nil {
+			continue
+		}
+		rel.Active = rel.ID == current
+		list = append(list, rel)
+	}
+	// 同一秒内的版本 ID 无法区分先后, 按创建时间排序
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.After(list[j].Created)
+		}
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+// current 返回线上版本的 ID
+func (m *Manager) current() (string, error) {
+	id, err := m.st.Current(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if !idPattern.MatchString(id) {
+		return "", ErrNotActive
+	}
+	return id, nil
+}
+
+func (m *Manager) load(id string) (*Release, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrInvalidName
+	}
+	data, err := m.st.Meta(context.Background(), id)
+	if err != nil {
+		return nil, err
+	}
+	var rel Release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return nil, fmt.Errorf("failed to decode release %s: %w", id, err)
+	}
+	return &rel, nil
+}
+
+// prune 只保留最近的 cfg.Release.Keep 个版本, 当前版本始终保留
+// 删除版本后回收不再被引用的内容
+func (m *Manager) prune(ctx context.Context, stream *progress.Stream) {
+	if m.cfg.Release.Keep <= 0 {
+		return
+	}
+	list, err := m.list()
+	if err != nil {
+		return
+	}
+	var pruned []string
+	for i, rel := range list {
+		if i < m.cfg.Release.Keep || rel.Active {
+			continue
+		}
+		pruned = append(pruned, rel.ID)
+	}
+	if len(pruned) == 0 {
+		return
+	}
+	stats, err := m.st.Remove(ctx, pruned)
+	warn(stream, stats)
+	if err != nil {
+		stream.Event("warning", map[string]any{"message": "failed to remove old releases: " + err.Error()})
+		return
+	}
+	stream.Event("pruned", map[string]any{"releases": len(pruned), "objects": stats.Objects, "freed": stats.Freed})
+}
+
+// warn 将存储返回的非致命错误以 warning 事件发送
+func warn(stream *progress.Stream, stats storage.Stats) {
+	for _, message := range stats.Warnings {
+		stream.Event("warning", map[string]any{"message": message})
+	}
+}
+
+// DirSize 统计目录中普通文件的总字节数
+func DirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,180 @@
+package release
+
+import (
+	"errors"
+	"nemu-server/config"
+	"nemu-server/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeReplicator 记录调用时的线上版本, 按 err 返回结果
+type fakeReplicator struct {
+	m       *Manager
+	err     error
+	calls   int
+	current string // 调用 Replicate 时本节点的线上版本
+}
+
+func (f *fakeReplicator) Replicate(ev Event) ([]Replica, error) {
+	f.calls++
+	f.current, _ = f.m.current()
+	status := "ok"
+	if f.err != nil {
+		status = "failed"
+	}
+	return []Replica{{Peer: "peer", Status: status}}, f.err
+}
+
+func newTestManager(t *testing.T) (*Manager, *fakeReplicator) {
+	t.Helper()
+	root := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.Server.Dir = filepath.Join(root, "public")
+	cfg.Release.Dir = filepath.Join(root, "releases")
+	cfg.Release.Dedupe = false
+	replicator := &fakeReplicator{}
+	m := NewManager(cfg, storage.NewLocal(cfg), nil, replicator)
+	replicator.m = m
+	return m, replicator
+}
+
+func writeIndex(content string) func(dir string) (int, error) {
+	return func(dir string) (int, error) {
+		return 1, os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0644)
+	}
+}
+
+func TestDeployReplicatesBeforeActivating(t *testing.T) {
+	m, replicator := newTestManager(t)
+	first, err := m.Deploy("", Meta{}, nil, writeIndex("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicator.current != "" {
+		t.Fatalf("replicated after activating %s", replicator.current)
+	}
+	if len(first.Replicas) != 1 || !first.Active {
+		t.Fatalf("release = %+v", first)
+	}
+
+	replicator.err = ErrQuorum
+	if _, err := m.Deploy("", Meta{}, nil, writeIndex("second")); !errors.Is(err, ErrQuorum) {
+		t.Fatalf("Deploy error = %v, want ErrQuorum", err)
+	}
+	if replicator.current != first.ID {
+		t.Fatalf("current during replication = %s, want %s", replicator.current, first.ID)
+	}
+	current, err := m.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.ID != first.ID {
+		t.Fatalf("current = %s after quorum failure, want %s", current.ID, first.ID)
+	}
+	list, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("releases = %d, want the failed release discarded", len(list))
+	}
+}
+
+func TestDeploySkipsReplicationForOrigin(t *testing.T) {
+	m, replicator := newTestManager(t)
+	replicator.err = ErrQuorum
+	rel, err := m.Deploy("", Meta{Origin: "20250101-000000-abcdef"}, nil, writeIndex("replicated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicator.calls != 0 {
+		t.Fatalf("release with origin was replicated %d times", replicator.calls)
+	}
+	if rel.Origin == "" || !rel.Active {
+		t.Fatalf("release = %+v", rel)
+	}
+}
+
+func TestFillDoesNotBlockReadsOrDeploys(t *testing.T) {
+	m, _ := newTestManager(t)
+	first, err := m.Deploy("", Meta{}, nil, writeIndex("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill 阻塞期间查询线上版本并完成另一次部署
+	filling, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.Deploy(first.ID, Meta{}, nil, func(dir string) (int, error) {
+			close(filling)
+			<-release
+			return writeIndex("incremental")(dir)
+		})
+		done <- err
+	}()
+	<-filling
+	if current, err := m.Current(); err != nil || current.ID != first.ID {
+		t.Fatalf("Current during fill = %v, %v", current, err)
+	}
+	second, err := m.Deploy("", Meta{}, nil, writeIndex("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// 基准版本在 fill 期间被替换, 增量部署加锁后发现并放弃
+	if err := <-done; !errors.Is(err, ErrBaseChanged) {
+		t.Fatalf("incremental Deploy error = %v, want ErrBaseChanged", err)
+	}
+	if current, err := m.Current(); err != nil || current.ID != second.ID {
+		t.Fatalf("current = %v, %v, want %s", current, err, second.ID)
+	}
+}
+
+func TestDeployPrefixUsesReleaseActiveAfterFill(t *testing.T) {
+	m, _ := newTestManager(t)
+	if _, err := m.Deploy("", Meta{}, nil, writeIndex("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	filling, release := make(chan struct{}), make(chan struct{})
+	done := make(chan *Release, 1)
+	go func() {
+		rel, err := m.DeployPrefix("docs", Meta{}, nil, func(dir string) (int, error) {
+			close(filling)
+			<-release
+			return writeIndex("docs")(dir)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- rel
+	}()
+	<-filling
+	second, err := m.Deploy("", Meta{}, nil, writeIndex("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	rel := <-done
+	if rel == nil {
+		t.FailNow()
+	}
+	if rel.Base != second.ID {
+		t.Fatalf("partial deploy based on %s, want %s", rel.Base, second.ID)
+	}
+	dir := m.st.Dir(rel.ID)
+	for name, want := range map[string]string{"index.html": "second", "docs/index.html": "docs"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(m.cfg.Release.Dir, "staging")); len(entries) != 0 {
+		t.Fatalf("staging directory not cleaned: %v", entries)
+	}
+}
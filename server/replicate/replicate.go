@@ -0,0 +1,248 @@
+package replicate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"nemu-server/seal"
+	"nemu-server/sign"
+	"nemu-server/storage"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+	"github.com/fenthope/reco"
+	"github.com/klauspost/compress/zstd"
+)
+
+const userAgent = "NemuServer/1.0"
+
+// Replicator 将新版本以完整上传的方式部署到 [[replication.peers]], 实现 release.Replicator
+//
+// 版本内容从存储读取并打包为 zstd 压缩的 tar, 与客户端的上传相同, 因此节点只需要是普通的 nemu-server;
+// 请求带有 Nemu-Origin 头部, 节点不会再次复制收到的版本; 配置了 signing.key 时以本节点的私钥签名归档,
+// 节点配置了 secret 时以它加密归档, 与客户端的加密上传相同
+type Replicator struct {
+	cfg    *config.Config
+	st     storage.Storage
+	log    *reco.Logger
+	client *httpc.Client
+	key    ed25519.PrivateKey
+}
+
+func New(cfg *config.Config, st storage.Storage, log *reco.Logger) (*Replicator, error) {
+	peers := cfg.Replication.Peers
+	if cfg.Replication.Quorum < 0 || cfg.Replication.Quorum > len(peers) {
+		return nil, fmt.Errorf("replication.quorum must be between 0 and the number of peers (%d)", len(peers))
+	}
+	for i, peer := range peers {
+		u, err := url.Parse(peer.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid replication peer url: %s", peer.URL)
+		}
+		if peer.Name == "" {
+			peers[i].Name = peer.URL
+		}
+	}
+	var key ed25519.PrivateKey
+	if cfg.Signing.Key != "" {
+		data, err := os.ReadFile(cfg.Signing.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing.key: %w", err)
+		}
+		if key, err = sign.ParsePrivateKey(data); err != nil {
+			return nil, fmt.Errorf("signing.key: %w", err)
+		}
+	}
+	return &Replicator{
+		cfg: cfg,
+		st:  st,
+		log: log,
+		key: key,
+		// 请求体是一次性的数据流, 内置重试无法重放
+		client: httpc.New(httpc.WithRetryOptions(httpc.RetryOptions{MaxAttempts: 0})),
+	}, nil
+}
+
+// Replicate 同时复制到全部节点并等待结果, 每个节点完成后发送 replicated 事件
+// 激活新版本的节点少于 replication.quorum 时返回 ErrQuorum
+func (r *Replicator) Replicate(ev release.Event) ([]release.Replica, error) {
+	peers := r.cfg.Replication.Peers
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	quorum := r.cfg.Replication.Quorum
+	ev.Progress.Event("replicating", map[string]any{"peers": len(peers), "quorum": quorum})
+
+	replicas := make([]release.Replica, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replicas[i] = r.replicate(peer, ev.Release)
+			replica := replicas[i]
+			if replica.Status == "ok" {
+				r.log.Infof("Release %s replicated to %s as %s in %dms", ev.Release.ID, peer.Name, replica.Release, replica.Duration)
+			} else {
+				r.log.Errorf("Failed to replicate release %s to %s: %s", ev.Release.ID, peer.Name, replica.Error)
+			}
+			ev.Progress.Event("replicated", map[string]any{
+				"peer": replica.Peer, "status": replica.Status, "release": replica.Release,
+				"error": replica.Error, "duration_ms": replica.Duration,
+			})
+		}()
+	}
+	wg.Wait()
+
+	activated := 0
+	var failed []string
+	for _, replica := range replicas {
+		if replica.Status == "ok" {
+			activated++
+		} else {
+			failed = append(failed, replica.Peer+": "+replica.Error)
+		}
+	}
+	if activated < quorum {
+		return replicas, fmt.Errorf("%w: %d/%d peers activated release %s, %d required (%s)",
+			release.ErrQuorum, activated, len(peers), ev.Release.ID, quorum, strings.Join(failed, "; "))
+	}
+	return replicas, nil
+}
+
+// replicate 上传到一个节点
+func (r *Replicator) replicate(peer config.PeerConfig, rel *release.Release) release.Replica {
+	start := time.Now()
+	replica := release.Replica{Peer: peer.Name, Status: "failed"}
+	id, err := r.upload(peer, rel)
+	replica.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		replica.Error = err.Error()
+		return replica
+	}
+	replica.Status, replica.Release = "ok", id
+	return replica
+}
+
+func (r *Replicator) upload(peer config.PeerConfig, rel *release.Release) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.cfg.Replication.Timeout)*time.Second)
+	defer cancel()
+
+	files, err := r.st.Files(ctx, rel.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list release files: %w", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.pack(ctx, rel.ID, files, peer.Secret, pw))
+	}()
+	defer pr.Close()
+
+	rb := r.client.NewRequestBuilder(http.MethodPost, strings.TrimSuffix(peer.URL, "/")+"/nemu/upload")
+	rb.WithContext(ctx)
+	rb.NoDefaultHeaders()
+	rb.SetHeader("User-Agent", userAgent)
+	rb.SetHeader("Nemu-Token", peer.Token)
+	rb.SetHeader("Content-Type", "application/x-tar")
+	rb.SetHeader("Content-Encoding", "zstd")
+	rb.SetHeader("Accept", "application/json")
+	setMeta(rb, rel)
+	encryption := ""
+	if peer.Secret != "" {
+		// 节点开启 encryption.require 时只接受加密的上传
+		encryption = seal.Scheme
+		rb.SetHeader(seal.Header, encryption)
+	}
+	if r.key != nil {
+		// 节点开启 signing.require 时只接受签名的上传, 节点需要在 [[signing.keys]] 中配置本节点的公钥
+		rb.SetHeader(sign.HeaderKey, sign.EncodePublicKey(r.key.Public().(ed25519.PublicKey)))
+		rb.SetBody(sign.NewReader(pr, r.key, sign.Statement{
+			Encoding:   "zstd",
+			Encryption: encryption,
+			Commit:     rel.Commit,
+			Dirty:      rel.Dirty,
+			Branch:     rel.Branch,
+			Author:     rel.Author,
+			Message:    rel.Message,
+		}))
+	} else {
+		rb.SetBody(pr)
+	}
+	req, err := rb.Build()
+	if err != nil {
+		return "", err
+	}
+	// Execute 会把连接错误包装为 500 响应, 直接使用 Do 以获得原始错误
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Message string `json:"message"`
+		Release string `json:"release"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(body, &result)
+	if resp.StatusCode != http.StatusOK {
+		if result.Message == "" {
+			result.Message = http.StatusText(resp.StatusCode)
+		}
+		return "", fmt.Errorf("%d %s", resp.StatusCode, result.Message)
+	}
+	return result.Release, nil
+}
+
+// setMeta 转发版本的部署信息, 并以 Nemu-Origin 标记复制来源
+func setMeta(rb *httpc.RequestBuilder, rel *release.Release) {
+	set := func(key, value string) {
+		if value != "" {
+			rb.SetHeader(key, url.QueryEscape(value))
+		}
+	}
+	set(release.HeaderCommit, rel.Commit)
+	set(release.HeaderBranch, rel.Branch)
+	set(release.HeaderAuthor, rel.Author)
+	set(release.HeaderMessage, rel.Message)
+	set(release.HeaderOrigin, rel.ID)
+	if rel.Dirty {
+		rb.SetHeader(release.HeaderDirty, strconv.FormatBool(rel.Dirty))
+	}
+}
+
+// pack 将版本中的文件写为 zstd 压缩的 tar, 目录由节点在解压时创建; secret 不为空时加密压缩后的数据
+func (r *Replicator) pack(ctx context.Context, id string, files []storage.File, secret string, w io.Writer) error {
+	var sealer *seal.Writer
+	if secret != "" {
+		var err error
+		if sealer, err = seal.NewWriter(w, secret); err != nil {
+			return err
+		}
+		w = sealer
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteTar(ctx, r.st, id, files, zw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if sealer != nil {
+		return sealer.Close()
+	}
+	return nil
+}
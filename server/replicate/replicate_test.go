@@ -0,0 +1,133 @@
+package replicate
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"nemu-server/config"
+	"nemu-server/release"
+	"nemu-server/seal"
+	"nemu-server/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fenthope/reco"
+	"github.com/klauspost/compress/zstd"
+)
+
+// peer 模拟节点的 /nemu/upload, 按 secret 解密并返回归档中的文件
+type peer struct {
+	secret  string
+	require bool // encryption.require
+	files   []string
+}
+
+func (p *peer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	switch r.Header.Get(seal.Header) {
+	case "":
+		if p.require {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": "encrypted upload is required"})
+			return
+		}
+	case seal.Scheme:
+		sr, err := seal.NewReader(r.Body, p.secret)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = sr
+	}
+	zr, err := zstd.NewReader(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+		p.files = append(p.files, hdr.Name)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "success", "release": "peer-release"})
+}
+
+func newReplicator(t *testing.T, peers ...config.PeerConfig) (*Replicator, *release.Release) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Release.Dir = t.TempDir()
+	cfg.Release.Dedupe = false
+	cfg.Replication.Peers = peers
+	cfg.Replication.Quorum = len(peers)
+	st := storage.NewLocal(cfg)
+
+	rel := &release.Release{ID: "20250101-000000-abcd"}
+	dir := st.Dir(rel.ID)
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index.html", "docs/index.html"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.Publish(context.Background(), rel.ID, dir, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	log, err := reco.New(reco.Config{Output: io.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(cfg, st, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, rel
+}
+
+func TestReplicateSealsForPeerSecret(t *testing.T) {
+	p := &peer{secret: "peer secret", require: true}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	r, rel := newReplicator(t, config.PeerConfig{Name: "peer", URL: srv.URL, Secret: p.secret})
+	replicas, err := r.Replicate(release.Event{Release: rel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replicas[0].Status != "ok" || replicas[0].Release != "peer-release" {
+		t.Fatalf("replica = %+v", replicas[0])
+	}
+	if len(p.files) != 2 {
+		t.Fatalf("peer received %v", p.files)
+	}
+}
+
+func TestReplicateWithoutSecretFailsQuorum(t *testing.T) {
+	p := &peer{require: true}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	r, rel := newReplicator(t, config.PeerConfig{Name: "peer", URL: srv.URL})
+	replicas, err := r.Replicate(release.Event{Release: rel})
+	if !errors.Is(err, release.ErrQuorum) {
+		t.Fatalf("Replicate error = %v, want ErrQuorum", err)
+	}
+	if replicas[0].Status != "failed" {
+		t.Fatalf("replica = %+v", replicas[0])
+	}
+}
@@ -0,0 +1,251 @@
+// Package seal 上传数据的端到端加密, 客户端与服务端共用
+//
+// 数据按块以 ChaCha20-Poly1305 加密, 密钥由共享的部署密钥 (encryption.secret) 经 HKDF-SHA256 派生,
+// 每个数据流使用随机的 salt, 因此每次上传的密钥都不同. 格式:
+//
+//	头部: "NEMUSEAL" | 版本 (1 字节) | 块大小 (uint32) | salt (32 字节)
+//	数据块: 密文长度 (uint32) | 密文
+//
+// 第 n 块的 nonce 为 n (uint64, 大端) 后接 3 个 0 字节与结束标记, 最后一块的结束标记为 1,
+// 头部作为每一块的附加数据. 因此块的顺序, 截断与头部的修改都会导致认证失败.
+package seal
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Header 上传请求中表示请求体已加密的头部, 取值为 Scheme
+const Header = "Nemu-Encryption"
+
+// Scheme 当前的加密方案
+const Scheme = "chacha20poly1305"
+
+const (
+	magic   = "NEMUSEAL"
+	version = 1
+	saltLen = 32
+	// headerLen 头部的长度
+	headerLen = len(magic) + 1 + 4 + saltLen
+
+	// DefaultChunkSize 每块明文的大小
+	DefaultChunkSize = 64 << 10
+	// MaxChunkSize 解密时接受的最大块, 限制单块占用的内存
+	MaxChunkSize = 1 << 20
+)
+
+// kdfInfo HKDF 的 info, 将派生的密钥限定在这一用途
+const kdfInfo = "nemu upload encryption v1"
+
+var (
+	ErrFormat    = errors.New("invalid encrypted stream")
+	ErrAuth      = errors.New("encrypted stream authentication failed")
+	ErrTruncated = errors.New("encrypted stream is truncated")
+	ErrNoSecret  = errors.New("encryption secret is empty")
+)
+
+// deriveKey 由部署密钥与 salt 派生本次数据流的密钥
+func deriveKey(secret string, salt []byte) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	key, err := hkdf.Key(sha256.New, []byte(secret), salt, kdfInfo, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// nonce 返回第 n 块的 nonce
+func nonce(n uint64, final bool) []byte {
+	b := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(b, n)
+	if final {
+		b[len(b)-1] = 1
+	}
+	return b
+}
+
+// Writer 加密写入的数据, Close 写出最后一块, 不关闭底层的 writer
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	n      uint64
+	closed bool
+	err    error
+}
+
+// NewWriter 创建加密 writer, 立即写出头部
+func NewWriter(w io.Writer, secret string) (*Writer, error) {
+	header := make([]byte, headerLen)
+	copy(header, magic)
+	header[len(magic)] = version
+	binary.BigEndian.PutUint32(header[len(magic)+1:], DefaultChunkSize)
+	salt := header[headerLen-saltLen:]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := deriveKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, header: header, buf: make([]byte, 0, DefaultChunkSize)}, nil
+}
+
+func (s *Writer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("seal: write after close")
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		// 缓冲区已满且还有数据时才写出, 保证最后一块总是由 Close 写出
+		if len(s.buf) == cap(s.buf) && len(p) > 0 {
+			if s.err = s.flush(false); s.err != nil {
+				return written, s.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close 写出带结束标记的最后一块
+func (s *Writer) Close() error {
+	if s.closed || s.err != nil {
+		return s.err
+	}
+	s.closed = true
+	s.err = s.flush(true)
+	return s.err
+}
+
+func (s *Writer) flush(final bool) error {
+	sealed := s.aead.Seal(nil, nonce(s.n, final), s.buf, s.header)
+	s.n++
+	s.buf = s.buf[:0]
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := s.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// Reader 解密 Writer 写出的数据流
+type Reader struct {
+	r         io.Reader
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	plain     []byte // 当前块中尚未读取的明文
+	buf       []byte // 明文缓冲区, 不能与密文共用: 认证失败时 Open 会清零输出
+	sealed    []byte
+	n         uint64
+	done      bool
+	err       error
+}
+
+// NewReader 读取并校验头部, 返回解密 reader
+// 密钥错误在读取第一块时以 ErrAuth 报告
+func NewReader(r io.Reader, secret string) (*Reader, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: short header", ErrFormat)
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) || header[len(magic)] != version {
+		return nil, fmt.Errorf("%w: unknown header", ErrFormat)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(magic)+1:]))
+	if chunkSize <= 0 || chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("%w: chunk size %d", ErrFormat, chunkSize)
+	}
+	aead, err := deriveKey(secret, header[headerLen-saltLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead, header: header, chunkSize: chunkSize}, nil
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.next()
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// next 读取并解密下一块
+func (s *Reader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(s.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	length := int(binary.BigEndian.Uint32(size[:]))
+	if length < s.aead.Overhead() || length > s.chunkSize+s.aead.Overhead() {
+		return fmt.Errorf("%w: chunk length %d", ErrFormat, length)
+	}
+	if cap(s.sealed) < length {
+		s.sealed = make([]byte, length)
+	}
+	s.sealed = s.sealed[:length]
+	if _, err := io.ReadFull(s.r, s.sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	// 不知道是否为最后一块, 先按普通块解密, 失败再按最后一块解密
+	plain, err := s.aead.Open(s.buf[:0], nonce(s.n, false), s.sealed, s.header)
+	if err != nil {
+		plain, err = s.aead.Open(s.buf[:0], nonce(s.n, true), s.sealed, s.header)
+		if err != nil {
+			return ErrAuth
+		}
+		s.done = true
+	}
+	s.n++
+	s.buf, s.plain = plain, plain
+	if s.done {
+		// 最后一块之后不应再有数据
+		var extra [1]byte
+		if n, _ := io.ReadFull(s.r, extra[:]); n > 0 {
+			return fmt.Errorf("%w: data after final chunk", ErrFormat)
+		}
+	}
+	return nil
+}
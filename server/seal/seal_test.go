@@ -0,0 +1,143 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+const testSecret = "correct horse battery staple"
+
+func encrypt(t *testing.T, plain []byte, secret string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 以不对齐块大小的长度分多次写入, 覆盖跨块的缓冲
+	for len(plain) > 0 {
+		n := min(len(plain), 10000)
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(sealed []byte, secret string) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), secret)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(iotest.HalfReader(r))
+}
+
+// chunks 按格式拆分加密数据流, 返回头部与各块 (含长度前缀)
+func chunks(t *testing.T, sealed []byte) (header []byte, blocks [][]byte) {
+	t.Helper()
+	header, rest := sealed[:headerLen], sealed[headerLen:]
+	for len(rest) > 0 {
+		n := 4 + int(binary.BigEndian.Uint32(rest))
+		blocks = append(blocks, rest[:n])
+		rest = rest[n:]
+	}
+	return header, blocks
+}
+
+func join(header []byte, blocks ...[]byte) []byte {
+	return bytes.Join(append([][]byte{header}, blocks...), nil)
+}
+
+func random(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 3*DefaultChunkSize + 5} {
+		plain := random(t, size)
+		sealed := encrypt(t, plain, testSecret)
+		got, err := decrypt(sealed, testSecret)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: plaintext mismatch", size)
+		}
+	}
+}
+
+func TestSaltMakesStreamsDiffer(t *testing.T) {
+	plain := []byte("same archive")
+	if bytes.Equal(encrypt(t, plain, testSecret), encrypt(t, plain, testSecret)) {
+		t.Fatal("two encryptions of the same data are identical")
+	}
+}
+
+func TestEmptySecret(t *testing.T) {
+	if _, err := NewWriter(io.Discard, ""); !errors.Is(err, ErrNoSecret) {
+		t.Fatalf("NewWriter error = %v, want ErrNoSecret", err)
+	}
+}
+
+func TestTamperedStreams(t *testing.T) {
+	plain := random(t, 3*DefaultChunkSize+100)
+	sealed := encrypt(t, plain, testSecret)
+	header, blocks := chunks(t, sealed)
+	if len(blocks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(blocks))
+	}
+	flip := func(b []byte, i int) []byte {
+		b = bytes.Clone(b)
+		b[i] ^= 1
+		return b
+	}
+	badChunkSize := bytes.Clone(header)
+	binary.BigEndian.PutUint32(badChunkSize[len(magic)+1:], MaxChunkSize+1)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		secret string
+		want   error
+	}{
+		{name: "wrong key", stream: sealed, secret: "wrong secret", want: ErrAuth},
+		{name: "final chunk dropped", stream: join(header, blocks[:3]...), want: ErrTruncated},
+		{name: "only first chunk", stream: join(header, blocks[0]), want: ErrTruncated},
+		{name: "final chunk cut short", stream: sealed[:len(sealed)-1], want: ErrTruncated},
+		{name: "header only", stream: header, want: ErrTruncated},
+		{name: "short header", stream: header[:headerLen-1], want: ErrFormat},
+		{name: "chunks reordered", stream: join(header, blocks[1], blocks[0], blocks[2], blocks[3]), want: ErrAuth},
+		{name: "middle chunk dropped", stream: join(header, blocks[0], blocks[2], blocks[3]), want: ErrAuth},
+		{name: "final chunk moved", stream: join(header, blocks[0], blocks[3]), want: ErrAuth},
+		{name: "ciphertext modified", stream: join(header, blocks[0], flip(blocks[1], 10), blocks[2], blocks[3]), want: ErrAuth},
+		{name: "salt modified", stream: join(flip(header, headerLen-1), blocks...), want: ErrAuth},
+		{name: "unknown version", stream: join(flip(header, len(magic)), blocks...), want: ErrFormat},
+		{name: "chunk size too large", stream: join(badChunkSize, blocks...), want: ErrFormat},
+		{name: "data after final chunk", stream: append(bytes.Clone(sealed), 0), want: ErrFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := tt.secret
+			if secret == "" {
+				secret = testSecret
+			}
+			if _, err := decrypt(tt.stream, secret); !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
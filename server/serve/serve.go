@@ -0,0 +1,95 @@
+package serve
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"nemu-server/errpage"
+	"net/http"
+	"strings"
+
+	"github.com/fenthope/compress"
+	"github.com/infinite-iroha/touka"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 站点文件的服务方式, 由 nemu-server 与客户端的 nemu serve 共用, 保证本地预览与线上一致
+
+// FontExtensions 使用长缓存的字体文件扩展名
+var FontExtensions = []string{"woff", "woff2", "ttf", "eot", "otf"}
+
+// FontMaxAge 字体文件的缓存时间, 单位秒
+const FontMaxAge = 36000
+
+// Cache-Control中间件, 针对特定文件扩展名特殊处理
+func CacheControlMiddleware(maxAge int, extensions ...string) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		// 判断路径文件扩展名
+		path := c.Request.URL.Path
+		applyCache := false
+		for _, ext := range extensions {
+			if strings.HasSuffix(path, "."+ext) {
+				applyCache = true
+				break
+			}
+		}
+
+		if applyCache {
+			c.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", maxAge))
+		} else {
+			c.SetHeader("Cache-Control", "public, max-age=3600, must-revalidate")
+		}
+
+		c.Next()
+	}
+}
+
+// Compression 响应压缩中间件, 按 zstd, gzip, deflate 的优先级协商
+func Compression() touka.HandlerFunc {
+	return compress.Compression(compress.CompressOptions{
+		Algorithms: map[string]compress.AlgorithmConfig{
+			compress.EncodingGzip: {
+				Level:       gzip.BestCompression, // Gzip最高压缩比
+				PoolEnabled: true,                 // 启用Gzip压缩器的对象池
+			},
+			compress.EncodingDeflate: {
+				Level:       flate.DefaultCompression, // Deflate默认压缩比
+				PoolEnabled: false,                    // Deflate不启用对象池
+			},
+			compress.EncodingZstd: {
+				Level:       int(zstd.SpeedBestCompression), // Zstandard最佳压缩比
+				PoolEnabled: true,                           // 启用Zstandard压缩器的对象池
+			},
+		},
+
+		MinContentLength:  256,
+		CompressibleTypes: compress.DefaultCompressibleTypes,
+
+		EncodingPriority: []string{
+			compress.EncodingZstd,
+			compress.EncodingGzip,
+			compress.EncodingDeflate,
+		},
+	})
+}
+
+// Use 注册缓存头与压缩中间件, 需在注册路由之前调用
+func Use(r *touka.Engine) {
+	r.Use(CacheControlMiddleware(FontMaxAge, FontExtensions...))
+	r.Use(Compression())
+}
+
+// Static 将未匹配路由的请求交给 dir 中的静态文件, 并使用 errpage 渲染错误页面
+func Static(r *touka.Engine, dir string) {
+	StaticFS(r, http.Dir(dir))
+}
+
+// StaticFS 与 Static 相同, 文件来自 fsys, 例如存储后端提供的线上版本
+func StaticFS(r *touka.Engine, fsys http.FileSystem) {
+	r.SetUnMatchFS(fsys)
+	r.SetErrorHandler(errpage.ErrorHandler)
+	r.SetProtocols(&touka.ProtocolsConfig{
+		Http1:           true,
+		Http2_Cleartext: true,
+	})
+}
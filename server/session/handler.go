@@ -0,0 +1,220 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"nemu-server/config"
+	"nemu-server/decode"
+	"nemu-server/notify"
+	"nemu-server/progress"
+	"nemu-server/release"
+	"nemu-server/sign"
+	"net/http"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// FinalizeRequest finalize 请求体
+type FinalizeRequest struct {
+	Chunks   int    `json:"chunks"`   // 分块总数
+	SHA256   string `json:"sha256"`   // 完整归档的 sha256
+	Encoding string `json:"encoding"` // 归档的压缩格式, 与 Content-Encoding 取值相同
+	Base     string `json:"base"`     // 增量上传的基准版本, 为空表示完整上传
+	Prefix   string `json:"prefix"`   // 部分部署的子路径, 与 Nemu-Prefix 头部相同
+	// 归档的加密方案, 与 Nemu-Encryption 头部相同, 为空表示未加密
+	Encryption string `json:"encryption"`
+	// 归档的签名, 签名内容中的摘要为完整归档的 sha256
+	Signature *sign.Detached `json:"signature"`
+
+	Meta release.Meta `json:"meta"` // 随版本保存的元数据, 与上传请求的 Nemu-Git-* 头部对应
+}
+
+// errorStatus 将会话错误映射为 HTTP 状态码
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrChecksumMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrChunkTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrMissingChunk):
+		return http.StatusConflict
+	case errors.Is(err, ErrAlreadyDone), errors.Is(err, ErrFinalizing):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// MakeCreateHandler 创建分块上传会话
+// POST /nemu/session
+func MakeCreateHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		s, err := m.Create()
+		if err != nil {
+			c.Errorf("Failed to create upload session: %v", err)
+			c.JSON(http.StatusInternalServerError, touka.H{"message": err.Error()})
+			return
+		}
+		c.Infof("Upload session %s created", s.ID)
+		c.JSON(http.StatusOK, touka.H{
+			"id":             s.ID,
+			"max_chunk_size": m.MaxChunkSize(),
+		})
+	}
+}
+
+// MakeStatusHandler 返回会话已接收的分块, 供客户端断点续传
+// GET /nemu/session/:id
+func MakeStatusHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		s, err := m.Load(c.Param("id"))
+		if err != nil {
+			c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, touka.H{
+			"id":      s.ID,
+			"done":    s.Done,
+			"updated": s.Updated,
+			"chunks":  s.ChunkList(),
+		})
+	}
+}
+
+// MakeChunkHandler 接收单个分块, 请求头 Nemu-Chunk-Sha256 为分块内容的 sha256
+// PUT /nemu/session/:id/chunk/:index
+func MakeChunkHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		id := c.Param("id")
+		index, err := ParseIndex(c.Param("index"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": err.Error()})
+			return
+		}
+		sum := c.GetReqHeader("Nemu-Chunk-Sha256")
+		if sum == "" {
+			c.JSON(http.StatusBadRequest, touka.H{"message": "Missing Nemu-Chunk-Sha256 header"})
+			return
+		}
+		if c.Request.Body == nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": "Request body is nil"})
+			return
+		}
+		defer c.Request.Body.Close()
+
+		chunk, err := m.PutChunk(id, index, c.Request.Body, sum)
+		if err != nil {
+			c.Warnf("Failed to store chunk %d of session %s: %v", index, id, err)
+			c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, chunk)
+	}
+}
+
+// MakeFinalizeHandler 校验全部分块后拼接并解压部署
+// POST /nemu/session/:id/finalize
+func MakeFinalizeHandler(cfg *config.Config, m *Manager, releases *release.Manager, notifier *notify.Notifier) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		id := c.Param("id")
+		var req FinalizeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, touka.H{"message": fmt.Sprintf("Invalid finalize request: %v", err)})
+			return
+		}
+		if req.Chunks <= 0 {
+			c.JSON(http.StatusBadRequest, touka.H{"message": "Chunk count must be positive"})
+			return
+		}
+
+		unlock := m.LockFinalize(id)
+		defer unlock()
+		s, err := m.Load(id)
+		if err != nil {
+			c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		// 重复 finalize (例如客户端没有收到上一次的响应) 直接返回之前的结果
+		if s.Done {
+			c.JSON(http.StatusOK, touka.H{"message": "success", "release": s.Release, "entries": s.Entries})
+			return
+		}
+
+		// 签名覆盖归档的摘要, 有签名时总是计算
+		var sum string
+		if req.SHA256 != "" || req.Signature != nil {
+			sum, err = m.Checksum(s, req.Chunks)
+			if err != nil {
+				c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+				return
+			}
+			if req.SHA256 != "" && sum != req.SHA256 {
+				c.Errorf("Archive checksum mismatch for session %s: expected %s, got %s", id, req.SHA256, sum)
+				c.JSON(http.StatusUnprocessableEntity, touka.H{"message": fmt.Sprintf("Archive checksum mismatch: expected %s, got %s", req.SHA256, sum)})
+				return
+			}
+		}
+		err = decode.VerifyDetached(c, cfg, req.Signature, sign.Statement{
+			Digest:     sum,
+			Encoding:   req.Encoding,
+			Encryption: req.Encryption,
+			Base:       req.Base,
+			Prefix:     req.Prefix,
+			Commit:     req.Meta.Commit,
+			Dirty:      req.Meta.Dirty,
+			Branch:     req.Meta.Branch,
+			Author:     req.Meta.Author,
+			Message:    req.Meta.Message,
+		})
+		if err != nil {
+			c.Warnf("Rejected upload session %s: %v", id, err)
+			c.JSON(decode.ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+
+		archive, size, err := m.Open(s, req.Chunks)
+		if err != nil {
+			c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		defer archive.Close()
+
+		c.Infof("Finalizing upload session %s (%d chunks, %d bytes)", id, req.Chunks, size)
+		// 与 /nemu/upload 相同, 客户端请求事件流时推送部署进度
+		if progress.Accepts(c) {
+			progress.Attach(c, progress.NewStream(c))
+		}
+		body, err := decode.Decrypt(cfg, req.Encryption, archive)
+		if err != nil {
+			progress.JSON(c, decode.ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		rel, err := decode.Deploy(c, releases, notifier, body, req.Encoding, req.Base, req.Prefix, req.Meta)
+		if err != nil {
+			progress.JSON(c, decode.ErrorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+
+		if err := m.MarkDone(id, rel.Entries, rel.ID); err != nil {
+			c.Warnf("Failed to mark session %s as done: %v", id, err)
+		}
+		progress.JSON(c, http.StatusOK, decode.Response(rel))
+	}
+}
+
+// MakeAbortHandler 放弃并删除会话
+// DELETE /nemu/session/:id
+func MakeAbortHandler(m *Manager) touka.HandlerFunc {
+	return func(c *touka.Context) {
+		// 等待进行中的 finalize 读完分块
+		unlock := m.Lock(c.Param("id"))
+		defer unlock()
+		if err := m.Remove(c.Param("id")); err != nil {
+			c.JSON(errorStatus(err), touka.H{"message": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, touka.H{"message": "success"})
+	}
+}
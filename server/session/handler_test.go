@@ -0,0 +1,168 @@
+package session
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"nemu-server/config"
+	"nemu-server/release"
+	"nemu-server/storage"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infinite-iroha/touka"
+)
+
+// slowHooks 统计 pre-activate 的次数, 并拖慢部署以便并发的 finalize 相互重叠
+type slowHooks struct {
+	deploys atomic.Int32
+}
+
+func (h *slowHooks) PreActivate(ev release.Event) error {
+	h.deploys.Add(1)
+	time.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+func (h *slowHooks) PostActivate(ev release.Event) {}
+
+func archive(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	body := []byte("hello")
+	if err := tw.WriteHeader(&tar.Header{Name: "index.html", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(body)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestConcurrentFinalizeDeploysOnce(t *testing.T) {
+	root := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.Server.Dir = filepath.Join(root, "public")
+	cfg.Release.Dir = filepath.Join(root, "releases")
+	cfg.Session.Dir = filepath.Join(root, "sessions")
+	hooks := &slowHooks{}
+	releases := release.NewManager(cfg, storage.NewLocal(cfg), hooks, nil)
+	m := NewManager(cfg)
+
+	s, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := archive(t)
+	sum := sha256.Sum256(data)
+	if _, err := m.PutChunk(s.ID, 0, bytes.NewReader(data), hex.EncodeToString(sum[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	r := touka.New()
+	r.POST("/nemu/session/:id/finalize", MakeFinalizeHandler(cfg, m, releases, nil))
+	request := `{"chunks": 1, "encoding": "identity"}`
+
+	var (
+		wg  sync.WaitGroup
+		ids [2]string
+	)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := touka.PerformRequest(r, http.MethodPost, "/nemu/session/"+s.ID+"/finalize", strings.NewReader(request), http.Header{"Content-Type": {"application/json"}})
+			var resp struct {
+				Release string `json:"release"`
+			}
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+				t.Errorf("finalize %d: %d %s", i, w.Code, w.Body)
+			}
+			ids[i] = resp.Release
+		}()
+	}
+	wg.Wait()
+
+	if n := hooks.deploys.Load(); n != 1 {
+		t.Fatalf("session deployed %d times, want 1", n)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Fatalf("finalize responses name releases %q and %q", ids[0], ids[1])
+	}
+	if len(m.locks) != 0 {
+		t.Fatalf("%d session locks left after finalize", len(m.locks))
+	}
+}
+
+func TestPutChunkRejectedWhileFinalizing(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Session.Dir = t.TempDir()
+	m := NewManager(cfg)
+	s, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("chunk")
+	sum := sha256.Sum256(data)
+
+	unlock := m.LockFinalize(s.ID)
+	if _, err := m.PutChunk(s.ID, 0, bytes.NewReader(data), hex.EncodeToString(sum[:])); !errors.Is(err, ErrFinalizing) {
+		t.Fatalf("PutChunk during finalize = %v, want ErrFinalizing", err)
+	}
+	if err := m.MarkDone(s.ID, 1, "release"); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if _, err := m.PutChunk(s.ID, 0, bytes.NewReader(data), hex.EncodeToString(sum[:])); !errors.Is(err, ErrAlreadyDone) {
+		t.Fatalf("PutChunk after finalize = %v, want ErrAlreadyDone", err)
+	}
+}
+
+func TestConcurrentPutChunkMatchesRecordedSum(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Session.Dir = t.TempDir()
+	m := NewManager(cfg)
+	s, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte('a' + i)}, 1<<16)
+			sum := sha256.Sum256(data)
+			if _, err := m.PutChunk(s.ID, 0, bytes.NewReader(data), hex.EncodeToString(sum[:])); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, err = m.Load(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := m.Checksum(s, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != s.Chunks[0].SHA256 {
+		t.Fatalf("chunk on disk hashes to %s, session records %s", sum, s.Chunks[0].SHA256)
+	}
+	if files, _ := filepath.Glob(filepath.Join(cfg.Session.Dir, s.ID, "*.tmp")); len(files) != 0 {
+		t.Fatalf("temporary chunk files left behind: %v", files)
+	}
+}
@@ -0,0 +1,395 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"nemu-server/config"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound         = errors.New("session not found")
+	ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+	ErrChunkTooLarge    = errors.New("chunk too large")
+	ErrMissingChunk     = errors.New("missing chunk")
+	ErrAlreadyDone      = errors.New("session already finalized")
+	ErrFinalizing       = errors.New("session is being finalized")
+)
+
+// 会话 ID 只允许 32 位十六进制字符, 同时避免路径遍历
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Chunk 已接收分块的信息
+type Chunk struct {
+	Index  int    `json:"index"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Session 分块上传会话
+type Session struct {
+	ID      string        `json:"id"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+	Done    bool          `json:"done"`    // 是否已完成 finalize
+	Entries int           `json:"entries"` // finalize 后解压的条目数量
+	Release string        `json:"release"` // finalize 后激活的版本 ID
+	Chunks  map[int]Chunk `json:"chunks"`
+}
+
+// ChunkList 返回按序号排序的分块列表
+func (s *Session) ChunkList() []Chunk {
+	list := make([]Chunk, 0, len(s.Chunks))
+	for _, chunk := range s.Chunks {
+		list = append(list, chunk)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	return list
+}
+
+// Manager 管理磁盘上的分块上传会话
+type Manager struct {
+	cfg *config.Config
+	mu  sync.Mutex // 保护 session.json 的读-改-写
+
+	locksMu sync.Mutex
+	locks   map[string]*sessionLock // 正在 finalize 或删除的会话
+}
+
+// sessionLock 串行化同一会话的 finalize, refs 为持有或等待的请求数
+type sessionLock struct {
+	mu         sync.Mutex
+	refs       int
+	finalizing bool // 持有锁的请求正在 finalize, 期间拒绝上传分块
+}
+
+func NewManager(cfg *config.Config) *Manager {
+	return &Manager{cfg: cfg, locks: make(map[string]*sessionLock)}
+}
+
+// Lock 锁定会话 id 直到调用返回的函数, 记录分块与删除会话前调用
+func (m *Manager) Lock(id string) (unlock func()) {
+	return m.lock(id, false)
+}
+
+// LockFinalize 与 Lock 相同, 持有期间新的分块上传直接以 ErrFinalizing 拒绝
+// 并发的 finalize 依次执行, 后到的请求看到 Done 后返回之前的结果, 不会重复部署
+func (m *Manager) LockFinalize(id string) (unlock func()) {
+	return m.lock(id, true)
+}
+
+func (m *Manager) lock(id string, finalize bool) func() {
+	m.locksMu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &sessionLock{}
+		m.locks[id] = l
+	}
+	l.refs++
+	m.locksMu.Unlock()
+
+	l.mu.Lock()
+	if finalize {
+		m.locksMu.Lock()
+		l.finalizing = true
+		m.locksMu.Unlock()
+	}
+	return func() {
+		m.locksMu.Lock()
+		l.finalizing = false
+		m.locksMu.Unlock()
+		l.mu.Unlock()
+		m.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, id)
+		}
+		m.locksMu.Unlock()
+	}
+}
+
+// finalizing 报告会话 id 是否正在 finalize
+func (m *Manager) finalizing(id string) bool {
+	m.locksMu.Lock()
+	defer m.locksMu.Unlock()
+	l, ok := m.locks[id]
+	return ok && l.finalizing
+}
+
+func (m *Manager) sessionDir(id string) string {
+	return filepath.Join(m.cfg.Session.Dir, id)
+}
+
+func (m *Manager) chunkPath(id string, index int) string {
+	return filepath.Join(m.sessionDir(id), fmt.Sprintf("%08d.part", index))
+}
+
+// MaxChunkSize 返回单个分块允许的最大字节数
+func (m *Manager) MaxChunkSize() int64 {
+	return int64(m.cfg.Session.MaxChunkSize) << 20
+}
+
+// Create 创建新的上传会话, 并顺带清理过期会话
+func (m *Manager) Create() (*Session, error) {
+	m.Cleanup()
+
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return nil, fmt.Errorf("failed to generate session id: %w", err)
+	}
+	now := time.Now()
+	s := &Session{
+		ID:      hex.EncodeToString(buf),
+		Created: now,
+		Updated: now,
+		Chunks:  make(map[int]Chunk),
+	}
+	if err := os.MkdirAll(m.sessionDir(s.ID), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.save(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load 读取会话信息
+func (m *Manager) Load(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load(id)
+}
+
+func (m *Manager) load(id string) (*Session, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(m.sessionDir(id), "session.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read session: %w", err)
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	if s.Chunks == nil {
+		s.Chunks = make(map[int]Chunk)
+	}
+	return &s, nil
+}
+
+func (m *Manager) save(s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+	// 先写临时文件再重命名, 避免中途崩溃留下半个 session.json
+	path := filepath.Join(m.sessionDir(s.ID), "session.json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write session: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// PutChunk 写入一个分块, 校验 sha256 后才会被记录到会话中
+// 重复上传同一序号的分块会覆盖之前的内容; 会话正在 finalize 或已完成时拒绝上传,
+// 因此 finalize 校验过的分块在部署前不会被替换
+func (m *Manager) PutChunk(id string, index int, r io.Reader, sum string) (Chunk, error) {
+	s, err := m.Load(id)
+	if err != nil {
+		return Chunk{}, err
+	}
+	if s.Done {
+		return Chunk{}, ErrAlreadyDone
+	}
+	if m.finalizing(id) {
+		return Chunk{}, ErrFinalizing
+	}
+
+	// 每个请求写入各自的临时文件, 同一分块的并发上传不会互相覆盖写到一半的内容
+	path := m.chunkPath(id, index)
+	out, err := os.CreateTemp(m.sessionDir(id), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return Chunk{}, fmt.Errorf("failed to create chunk file: %w", err)
+	}
+	tmpPath := out.Name()
+
+	hasher := sha256.New()
+	maxSize := m.MaxChunkSize()
+	size, err := io.Copy(io.MultiWriter(out, hasher), io.LimitReader(r, maxSize+1))
+	out.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return Chunk{}, fmt.Errorf("failed to write chunk: %w", err)
+	}
+	if size > maxSize {
+		os.Remove(tmpPath)
+		return Chunk{}, ErrChunkTooLarge
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != sum {
+		os.Remove(tmpPath)
+		return Chunk{}, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, sum, actual)
+	}
+
+	// 替换分块与记录摘要在会话锁内完成, 与 finalize 互斥
+	unlock := m.Lock(id)
+	defer unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err = m.load(id)
+	if err != nil {
+		os.Remove(tmpPath)
+		return Chunk{}, err
+	}
+	if s.Done {
+		os.Remove(tmpPath)
+		return Chunk{}, ErrAlreadyDone
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return Chunk{}, fmt.Errorf("failed to commit chunk: %w", err)
+	}
+
+	chunk := Chunk{Index: index, Size: size, SHA256: actual}
+	s.Chunks[index] = chunk
+	s.Updated = time.Now()
+	if err := m.save(s); err != nil {
+		return Chunk{}, err
+	}
+	return chunk, nil
+}
+
+// Open 按序号顺序拼接 0..count-1 的分块, 返回完整数据流和总大小
+// 调用者需要关闭返回的 ReadCloser
+func (m *Manager) Open(s *Session, count int) (io.ReadCloser, int64, error) {
+	files := make([]*os.File, 0, count)
+	readers := make([]io.Reader, 0, count)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	var total int64
+	for i := 0; i < count; i++ {
+		if _, ok := s.Chunks[i]; !ok {
+			closeAll()
+			return nil, 0, fmt.Errorf("%w: %d", ErrMissingChunk, i)
+		}
+		f, err := os.Open(m.chunkPath(s.ID, i))
+		if err != nil {
+			closeAll()
+			return nil, 0, fmt.Errorf("failed to open chunk %d: %w", i, err)
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+		total += s.Chunks[i].Size
+	}
+
+	return &multiReadCloser{Reader: io.MultiReader(readers...), close: closeAll}, total, nil
+}
+
+// Checksum 计算拼接后完整数据的 sha256
+func (m *Manager) Checksum(s *Session, count int) (string, error) {
+	rc, _, err := m.Open(s, count)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, rc); err != nil {
+		return "", fmt.Errorf("failed to hash chunks: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// MarkDone 记录 finalize 结果并删除分块数据
+// 会话信息会保留到过期, 以便客户端重复 finalize 时得到相同的结果
+func (m *Manager) MarkDone(id string, entries int, releaseID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.load(id)
+	if err != nil {
+		return err
+	}
+	for index := range s.Chunks {
+		os.Remove(m.chunkPath(id, index))
+	}
+	s.Done = true
+	s.Entries = entries
+	s.Release = releaseID
+	s.Chunks = make(map[int]Chunk)
+	s.Updated = time.Now()
+	return m.save(s)
+}
+
+// Remove 删除会话及其全部分块
+func (m *Manager) Remove(id string) error {
+	if !idPattern.MatchString(id) {
+		return ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return os.RemoveAll(m.sessionDir(id))
+}
+
+// Cleanup 删除超过 TTL 未更新的会话
+func (m *Manager) Cleanup() {
+	entries, err := os.ReadDir(m.cfg.Session.Dir)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-time.Duration(m.cfg.Session.TTL) * time.Hour)
+	for _, entry := range entries {
+		if !entry.IsDir() || !idPattern.MatchString(entry.Name()) {
+			continue
+		}
+		updated := time.Time{}
+		if s, err := m.Load(entry.Name()); err == nil {
+			updated = s.Updated
+		} else if info, err := entry.Info(); err == nil {
+			// session.json 缺失或损坏时以目录修改时间为准
+			updated = info.ModTime()
+		}
+		if updated.Before(deadline) {
+			m.Remove(entry.Name())
+		}
+	}
+}
+
+// ParseIndex 解析分块序号
+func ParseIndex(raw string) (int, error) {
+	index, err := strconv.Atoi(raw)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid chunk index: %q", raw)
+	}
+	return index, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	close func()
+}
+
+func (m *multiReadCloser) Close() error {
+	m.close()
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package sign 部署归档的 Ed25519 签名, 客户端与服务端共用
+//
+// 部署者持有私钥, 服务端在 [[signing.keys]] 中配置允许部署的公钥. 签名的内容是 Statement:
+// 请求体中归档的 sha256 (压缩与加密之后的字节), 签名时间, 以及决定部署结果的参数与元数据.
+//
+// 流式上传时签名附在请求体末尾, 请求体为: 归档 | 签名时间 (int64, 大端, Unix 秒) | 签名 (64 字节),
+// 签名者的公钥放在 Nemu-Signing-Key 头部. 分块上传的归档在 finalize 时已知摘要, 签名放在请求体的 signature 中.
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// HeaderKey 上传请求中签名者的公钥, 带有该头部时请求体末尾附有签名
+const HeaderKey = "Nemu-Signing-Key"
+
+// TrailerSize 附在请求体末尾的签名时间与签名的长度
+const TrailerSize = 8 + ed25519.SignatureSize
+
+// keyPrefix 公钥文本的前缀
+const keyPrefix = "ed25519:"
+
+// domain 签名内容的前缀, 避免同一把密钥的签名被用于其他用途
+const domain = "nemu archive signature v1\n"
+
+var (
+	ErrFormat    = errors.New("invalid signing key")
+	ErrTruncated = errors.New("signed upload is truncated")
+	ErrInvalid   = errors.New("invalid archive signature")
+)
+
+// Statement 签名的内容, 客户端与服务端按相同的字段构造
+type Statement struct {
+	Digest     string `json:"digest"`     // 归档的 sha256, 十六进制
+	Time       int64  `json:"time"`       // 签名时间, Unix 秒
+	Encoding   string `json:"encoding"`   // Content-Encoding
+	Encryption string `json:"encryption"` // Nemu-Encryption
+	Base       string `json:"base"`       // 增量上传的基准版本
+	Prefix     string `json:"prefix"`     // 部分部署的子路径
+	Preview    string `json:"preview"`    // 预览的名称
+	Expires    string `json:"expires"`    // 预览的有效期
+	Password   string `json:"password"`   // 预览访问密码的 sha512
+	Commit     string `json:"commit"`
+	Dirty      bool   `json:"dirty"`
+	Branch     string `json:"branch"`
+	Author     string `json:"author"`
+	Message    string `json:"message"`
+}
+
+func (s Statement) bytes() []byte {
+	b, _ := json.Marshal(s)
+	return append([]byte(domain), b...)
+}
+
+// Sign 签名 s
+func Sign(key ed25519.PrivateKey, s Statement) []byte {
+	return ed25519.Sign(key, s.bytes())
+}
+
+// Verify 校验 s 的签名
+func Verify(pub ed25519.PublicKey, s Statement, sig []byte) error {
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(pub, s.bytes(), sig) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Detached 分块上传 finalize 请求中的签名
+type Detached struct {
+	Key       string `json:"key"`       // 公钥, 与 Nemu-Signing-Key 相同
+	Time      int64  `json:"time"`      // 签名时间, Unix 秒
+	Signature string `json:"signature"` // base64
+}
+
+// Detach 以当前时间签名 s, 返回 finalize 请求使用的签名
+func Detach(key ed25519.PrivateKey, s Statement) *Detached {
+	s.Time = time.Now().Unix()
+	return &Detached{
+		Key:       EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		Time:      s.Time,
+		Signature: base64.StdEncoding.EncodeToString(Sign(key, s)),
+	}
+}
+
+// GenerateKey 生成新的密钥对
+func GenerateKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// EncodePublicKey 返回配置与请求头中使用的公钥文本, 形如 ed25519:<base64>
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return keyPrefix + base64.StdEncoding.EncodeToString(pub)
+}
+
+// ParsePublicKey 解析 EncodePublicKey 的结果
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, keyPrefix) {
+		return nil, fmt.Errorf("%w: missing %q prefix", ErrFormat, keyPrefix)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, keyPrefix))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: bad public key", ErrFormat)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// MarshalPrivateKey 将私钥编码为 PKCS#8 PEM
+func MarshalPrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey 解析 PKCS#8 PEM 格式的 Ed25519 私钥
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block", ErrFormat)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFormat, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an Ed25519 key", ErrFormat)
+	}
+	return priv, nil
+}
+
+// Reader 在 r 的数据之后追加签名时间与签名, 用作流式上传的请求体
+// 签名时间取读到 r 结尾的时刻; r 返回错误时原样返回, 不会写出签名
+type Reader struct {
+	r       io.Reader
+	key     ed25519.PrivateKey
+	st      Statement
+	hash    hash.Hash
+	trailer []byte
+	done    bool
+}
+
+// NewReader 创建签名 reader, st 中的 Digest 与 Time 由 Reader 填写
+func NewReader(r io.Reader, key ed25519.PrivateKey, st Statement) *Reader {
+	return &Reader{r: r, key: key, st: st, hash: sha256.New()}
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	if s.done {
+		if len(s.trailer) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, s.trailer)
+		s.trailer = s.trailer[n:]
+		return n, nil
+	}
+	n, err := s.r.Read(p)
+	s.hash.Write(p[:n])
+	if err == io.EOF {
+		s.done = true
+		s.st.Digest = hex.EncodeToString(s.hash.Sum(nil))
+		s.st.Time = time.Now().Unix()
+		s.trailer = binary.BigEndian.AppendUint64(nil, uint64(s.st.Time))
+		s.trailer = append(s.trailer, Sign(s.key, s.st)...)
+		if n > 0 {
+			return n, nil
+		}
+		return s.Read(p)
+	}
+	return n, err
+}
+
+// Verifier 读取 Reader 生成的请求体, 只返回归档部分并计算其摘要
+// 请求体短于签名部分时返回 ErrTruncated
+type Verifier struct {
+	r    io.Reader
+	hash hash.Hash
+	tail []byte // 尚未确定是否属于归档的最后 TrailerSize 字节
+	buf  []byte
+	err  error
+}
+
+func NewVerifier(r io.Reader) *Verifier {
+	return &Verifier{r: r, hash: sha256.New(), tail: make([]byte, 0, TrailerSize)}
+}
+
+func (v *Verifier) Read(p []byte) (int, error) {
+	for {
+		if v.err != nil {
+			return 0, v.err
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+		need := len(v.tail) + len(p)
+		if cap(v.buf) < need {
+			v.buf = make([]byte, need)
+		}
+		buf := v.buf[:need]
+		copy(buf, v.tail)
+		n, err := v.r.Read(buf[len(v.tail):])
+		total := len(v.tail) + n
+		// 始终保留最后 TrailerSize 字节, 其余的确定属于归档
+		out := max(total-TrailerSize, 0)
+		copy(p, buf[:out])
+		v.hash.Write(buf[:out])
+		v.tail = append(v.tail[:0], buf[out:total]...)
+		switch {
+		case err == io.EOF && len(v.tail) < TrailerSize:
+			v.err = ErrTruncated
+		case err != nil:
+			v.err = err
+		}
+		if out > 0 {
+			return out, nil
+		}
+	}
+}
+
+// Finish 读完剩余的请求体, 返回归档的摘要, 签名时间与签名
+func (v *Verifier) Finish() (digest string, signed int64, sig []byte, err error) {
+	if _, err := io.Copy(io.Discard, v); err != nil {
+		return "", 0, nil, err
+	}
+	if v.err != io.EOF {
+		return "", 0, nil, v.err
+	}
+	return hex.EncodeToString(v.hash.Sum(nil)), int64(binary.BigEndian.Uint64(v.tail)), v.tail[8:], nil
+}
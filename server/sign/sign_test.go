@@ -0,0 +1,184 @@
+package sign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// signed 返回 Reader 为 archive 生成的请求体
+func signed(t *testing.T, key ed25519.PrivateKey, archive []byte, st Statement) []byte {
+	t.Helper()
+	body, err := io.ReadAll(iotest.OneByteReader(NewReader(bytes.NewReader(archive), key, st)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// verify 按服务端的方式读取请求体, 返回归档部分与签名校验的结果
+func verify(key ed25519.PrivateKey, body []byte, st Statement, r func(io.Reader) io.Reader) ([]byte, error) {
+	v := NewVerifier(r(bytes.NewReader(body)))
+	archive, err := io.ReadAll(v)
+	if err != nil {
+		return archive, err
+	}
+	digest, signedAt, sig, err := v.Finish()
+	if err != nil {
+		return archive, err
+	}
+	st.Digest, st.Time = digest, signedAt
+	return archive, Verify(key.Public().(ed25519.PublicKey), st, sig)
+}
+
+func TestReaderVerifierRoundTrip(t *testing.T) {
+	key := newKey(t)
+	st := Statement{Encoding: "zstd", Prefix: "docs", Commit: "abc123"}
+	readers := map[string]func(io.Reader) io.Reader{
+		"plain":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for _, size := range []int{0, 1, TrailerSize - 1, TrailerSize, TrailerSize + 1, 100000} {
+		archive := make([]byte, size)
+		rand.Read(archive)
+		body := signed(t, key, archive, st)
+		if len(body) != size+TrailerSize {
+			t.Fatalf("size %d: body is %d bytes", size, len(body))
+		}
+		for name, r := range readers {
+			got, err := verify(key, body, st, r)
+			if err != nil {
+				t.Fatalf("size %d, %s reader: %v", size, name, err)
+			}
+			if !bytes.Equal(got, archive) {
+				t.Fatalf("size %d, %s reader: archive mismatch", size, name)
+			}
+		}
+	}
+}
+
+func TestVerifierDigest(t *testing.T) {
+	archive := []byte("archive bytes")
+	body := signed(t, newKey(t), archive, Statement{})
+	v := NewVerifier(bytes.NewReader(body))
+	digest, _, _, err := v.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(archive)
+	if digest != hex.EncodeToString(sum[:]) {
+		t.Fatalf("digest = %s, want sha256 of the archive", digest)
+	}
+}
+
+func TestVerifierRejects(t *testing.T) {
+	key := newKey(t)
+	st := Statement{Prefix: "docs"}
+	archive := bytes.Repeat([]byte("x"), 1000)
+	body := signed(t, key, archive, st)
+	flip := func(i int) []byte {
+		b := bytes.Clone(body)
+		b[i] ^= 1
+		return b
+	}
+
+	tests := []struct {
+		name string
+		key  ed25519.PrivateKey
+		body []byte
+		st   Statement
+		want error
+	}{
+		{name: "empty body", body: nil, want: ErrTruncated},
+		{name: "short trailer", body: body[len(archive)+1:], want: ErrTruncated},
+		{name: "missing trailer", body: archive, want: ErrInvalid},
+		{name: "trailer cut by one byte", body: body[:len(body)-1], want: ErrInvalid},
+		{name: "archive modified", body: flip(0), want: ErrInvalid},
+		{name: "time modified", body: flip(len(archive) + 7), want: ErrInvalid},
+		{name: "signature modified", body: flip(len(body) - 1), want: ErrInvalid},
+		{name: "statement modified", body: body, st: Statement{Prefix: "blog"}, want: ErrInvalid},
+		{name: "wrong key", body: body, key: newKey(t), want: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, s := tt.key, tt.st
+			if k == nil {
+				k = key
+			}
+			if s == (Statement{}) {
+				s = st
+			}
+			if _, err := verify(k, tt.body, s, iotest.HalfReader); !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetach(t *testing.T) {
+	key := newKey(t)
+	st := Statement{Digest: "abc", Preview: "pr-1"}
+	d := Detach(key, st)
+	pub, err := ParsePublicKey(d.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(d.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Time = d.Time
+	if err := Verify(pub, st, sig); err != nil {
+		t.Fatal(err)
+	}
+	st.Time++
+	if err := Verify(pub, st, sig); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Verify with another time = %v, want ErrInvalid", err)
+	}
+	if err := Verify(pub, st, sig[:10]); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("Verify with a short signature = %v, want ErrInvalid", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key := newKey(t)
+	pub := key.Public().(ed25519.PublicKey)
+	parsed, err := ParsePublicKey(" " + EncodePublicKey(pub) + "\n")
+	if err != nil || !parsed.Equal(pub) {
+		t.Fatalf("ParsePublicKey = %v, %v", parsed, err)
+	}
+	pemData, err := MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ParsePrivateKey(pemData)
+	if err != nil || !priv.Equal(key) {
+		t.Fatalf("ParsePrivateKey = %v", err)
+	}
+
+	for _, bad := range []string{"", "AAAA", "ed25519:", "ed25519:!!!", "ed25519:AAAA", "rsa:" + EncodePublicKey(pub)[len(keyPrefix):]} {
+		if _, err := ParsePublicKey(bad); !errors.Is(err, ErrFormat) {
+			t.Errorf("ParsePublicKey(%q) = %v, want ErrFormat", bad, err)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("not pem")); !errors.Is(err, ErrFormat) {
+		t.Errorf("ParsePrivateKey = %v, want ErrFormat", err)
+	}
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"nemu-server/blob"
+	"nemu-server/config"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Local 在本地磁盘上保存版本
+// 版本内容位于 <release.dir>/<id>/, 元数据位于 <release.dir>/<id>.json,
+// server.dir 是指向当前版本目录的软链接; 开启 release.dedupe 时文件是 <release.dir>/objects 中对象的硬链接
+type Local struct {
+	cfg   *config.Config
+	blobs *blob.Store // 关闭 release.dedupe 后仍用于回收已有对象
+}
+
+func NewLocal(cfg *config.Config) *Local {
+	return &Local{cfg: cfg, blobs: blob.New(filepath.Join(cfg.Release.Dir, "objects"))}
+}
+
+func (l *Local) releaseDir(id string) string {
+	return filepath.Join(l.cfg.Release.Dir, id)
+}
+
+func (l *Local) metaPath(id string) string {
+	return filepath.Join(l.cfg.Release.Dir, id+".json")
+}
+
+func (l *Local) Dir(id string) string {
+	return l.releaseDir(id)
+}
+
+// Checkout 以硬链接复制版本目录, 写入文件前需先删除同名文件, 以免修改到共享的 inode
+func (l *Local) Checkout(ctx context.Context, id, dir string) error {
+	return cloneTree(l.releaseDir(id), dir)
+}
+
+// Publish 版本目录已在原位, 只需去重并写入元数据
+// 去重失败不影响发布: 每个文件要么保持原样, 要么被原子地替换为内容相同的对象
+func (l *Local) Publish(ctx context.Context, id, dir string, meta []byte) (Stats, error) {
+	var stats Stats
+	if l.cfg.Release.Dedupe {
+		linked, err := l.blobs.Link(dir)
+		if err != nil {
+			stats.Warnings = append(stats.Warnings, "failed to deduplicate release: "+err.Error())
+		}
+		stats.Files, stats.Reused, stats.Saved = linked.Files, linked.Reused, linked.Saved
+	}
+	tmp := l.metaPath(id) + ".tmp"
+	if err := os.WriteFile(tmp, meta, 0644); err != nil {
+		return stats, fmt.Errorf("failed to write release metadata: %w", err)
+	}
+	return stats, os.Rename(tmp, l.metaPath(id))
+}
+
+// Activate 将 cfg.Server.Dir 原子地指向版本目录
+// 先创建临时软链接再 rename 覆盖, 读取方不会看到目录缺失的中间状态
+func (l *Local) Activate(ctx context.Context, id string) error {
+	target, err := filepath.Abs(l.releaseDir(id))
+	if err != nil {
+		return err
+	}
+	link := filepath.Clean(l.cfg.Server.Dir)
+
+	// 旧版本的站点目录是普通目录, 首次切换时移除
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		if err := os.RemoveAll(link); err != nil {
+			return fmt.Errorf("failed to remove site directory: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+
+	tmp := link + ".tmp-" + id
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to activate release %s: %w", id, err)
+	}
+	return nil
+}
+
+// Current 读取 cfg.Server.Dir 软链接指向的版本 ID
+func (l *Local) Current(ctx context.Context) (string, error) {
+	target, err := os.Readlink(l.cfg.Server.Dir)
+	if err != nil {
+		return "", ErrNotActive
+	}
+	return filepath.Base(target), nil
+}
+
+func (l *Local) List(ctx context.Context) ([]string, error) {
+	files, err := os.ReadDir(l.cfg.Release.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if id, ok := strings.CutSuffix(file.Name(), ".json"); ok && !file.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (l *Local) Meta(ctx context.Context, id string) ([]byte, error) {
+	data, err := os.ReadFile(l.metaPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if _, err := os.Stat(l.releaseDir(id)); err != nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (l *Local) Remove(ctx context.Context, ids []string) (Stats, error) {
+	var stats Stats
+	for _, id := range ids {
+		os.RemoveAll(l.releaseDir(id))
+		os.Remove(l.metaPath(id))
+	}
+	// 不支持去重的平台上不会有对象, 无需回收
+	if !blob.Supported {
+		return stats, nil
+	}
+	objects, freed, err := l.blobs.GC()
+	stats.Objects, stats.Freed = objects, freed
+	if err != nil {
+		stats.Warnings = append(stats.Warnings, "failed to collect unreferenced objects: "+err.Error())
+	}
+	return stats, nil
+}
+
+func (l *Local) Files(ctx context.Context, id string) ([]File, error) {
+	root := l.releaseDir(id)
+	var files []File
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		entry := File{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+		default:
+			return nil
+		}
+		files = append(files, entry)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return files, err
+}
+
+func (l *Local) Open(ctx context.Context, id, name string) (io.ReadCloser, error) {
+	name = path.Clean("/" + name)
+	file := filepath.Join(l.releaseDir(id), filepath.FromSlash(name))
+	// 软链接由 Files 单独列出, 不跟随, 以免读取到版本之外的文件
+	if info, err := os.Lstat(file); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return os.Open(file)
+}
+
+// FileSystem 直接提供 server.dir, 它总是指向当前版本
+func (l *Local) FileSystem() http.FileSystem {
+	return http.Dir(l.cfg.Server.Dir)
+}
+
+// cloneTree 以硬链接复制目录树, 目录与软链接重新创建
+func cloneTree(src, dst string) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return os.Link(file, target)
+		default:
+			return nil
+		}
+	})
+}
@@ -0,0 +1,457 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"nemu-server/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// 同时上传或下载的对象数量
+const s3Workers = 8
+
+// 回收对象的宽限期, 比它更新的对象可能属于其他实例正在发布的版本, 即使未被引用也不删除
+const s3GCGrace = time.Hour
+
+// S3 在 S3 兼容的对象存储中保存版本, 对象键均以 storage.s3.prefix 开头:
+//
+//	objects/<sha256>             文件内容, 所有版本共享, 按内容去重
+//	releases/<id>.manifest.json  版本的文件列表
+//	releases/<id>.json           版本的元数据, 最后写入, 存在即表示版本完整
+//	current                      线上版本的 ID
+//
+// 服务端本身不保存状态, 多个实例读取同一存储桶即可提供相同的站点
+type S3 struct {
+	client *s3Client
+	prefix string
+	fs     *s3FS
+}
+
+func NewS3(cfg *config.Config) (*S3, error) {
+	c := cfg.Storage.S3
+	if c.Endpoint == "" || c.Bucket == "" {
+		return nil, errors.New("storage.s3.endpoint and storage.s3.bucket are required")
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid storage.s3.endpoint: %s", c.Endpoint)
+	}
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix := strings.Trim(c.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &S3{
+		client: &s3Client{
+			endpoint:  endpoint,
+			region:    region,
+			bucket:    c.Bucket,
+			accessKey: c.AccessKey,
+			secretKey: c.SecretKey,
+			pathStyle: c.PathStyle,
+			// 请求体是文件, 内置重试无法重放, 由调用方决定是否重试
+			client: httpc.New(httpc.WithRetryOptions(httpc.RetryOptions{MaxAttempts: 0})),
+		},
+		prefix: prefix,
+	}
+	s.fs = &s3FS{s: s, ttl: time.Duration(c.CacheTTL) * time.Second}
+	return s, nil
+}
+
+func (s *S3) objectKey(sum string) string {
+	return s.prefix + "objects/" + sum
+}
+
+func (s *S3) metaKey(id string) string {
+	return s.prefix + "releases/" + id + ".json"
+}
+
+func (s *S3) manifestKey(id string) string {
+	return s.prefix + "releases/" + id + ".manifest.json"
+}
+
+func (s *S3) currentKey() string {
+	return s.prefix + "current"
+}
+
+// Dir 版本不保存在本地
+func (s *S3) Dir(id string) string {
+	return ""
+}
+
+// Checkout 下载版本的全部文件
+func (s *S3) Checkout(ctx context.Context, id, dir string) error {
+	files, err := s.Files(ctx, id)
+	if err != nil {
+		return err
+	}
+	var regular []File
+	for _, file := range files {
+		target := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if file.Link != "" {
+			if err := os.Symlink(file.Link, target); err != nil {
+				return err
+			}
+			continue
+		}
+		regular = append(regular, file)
+	}
+	return parallel(ctx, regular, func(file File) error {
+		return s.download(ctx, file, filepath.Join(dir, filepath.FromSlash(file.Path)))
+	})
+}
+
+func (s *S3) download(ctx context.Context, file File, target string) error {
+	body, err := s.client.get(ctx, s.objectKey(file.SHA256), 0)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+	defer body.Close()
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to download %s: %w", file.Path, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(target, file.ModTime, file.ModTime)
+}
+
+// Publish 上传存储桶中还没有的文件内容, 再写入文件列表与元数据
+func (s *S3) Publish(ctx context.Context, id, dir string, meta []byte) (Stats, error) {
+	var stats Stats
+	files, err := scan(dir)
+	if err != nil {
+		return stats, err
+	}
+
+	// 同一版本中内容相同的文件只上传一次
+	pending := make(map[string]File)
+	for _, file := range files {
+		if file.Link != "" {
+			continue
+		}
+		stats.Files++
+		if _, ok := pending[file.SHA256]; ok {
+			stats.Reused++
+			stats.Saved += file.Size
+			continue
+		}
+		pending[file.SHA256] = file
+	}
+	unique := make([]File, 0, len(pending))
+	for _, file := range pending {
+		unique = append(unique, file)
+	}
+
+	var mu sync.Mutex
+	err = parallel(ctx, unique, func(file File) error {
+		key := s.objectKey(file.SHA256)
+		exists, err := s.client.exists(ctx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			mu.Lock()
+			stats.Reused++
+			stats.Saved += file.Size
+			mu.Unlock()
+			return nil
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := s.client.put(ctx, key, f, file.Size, file.SHA256, "application/octet-stream"); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", file.Path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	manifest, err := json.Marshal(files)
+	if err != nil {
+		return stats, err
+	}
+	if err := s.client.putBytes(ctx, s.manifestKey(id), manifest, "application/json"); err != nil {
+		return stats, fmt.Errorf("failed to upload release manifest: %w", err)
+	}
+	if err := s.client.putBytes(ctx, s.metaKey(id), meta, "application/json"); err != nil {
+		return stats, fmt.Errorf("failed to upload release metadata: %w", err)
+	}
+	return stats, nil
+}
+
+// Activate 写入 current 对象, 单个对象的写入是原子的
+// 各实例在 storage.s3.cacheTTL 内陆续切换到新版本
+func (s *S3) Activate(ctx context.Context, id string) error {
+	if err := s.client.putBytes(ctx, s.currentKey(), []byte(id), "text/plain"); err != nil {
+		return fmt.Errorf("failed to activate release %s: %w", id, err)
+	}
+	s.fs.invalidate()
+	return nil
+}
+
+func (s *S3) Current(ctx context.Context) (string, error) {
+	data, err := s.client.getBytes(ctx, s.currentKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotActive
+	}
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(string(data))
+	if id == "" {
+		return "", ErrNotActive
+	}
+	return id, nil
+}
+
+func (s *S3) List(ctx context.Context) ([]string, error) {
+	var ids []string
+	err := s.client.list(ctx, s.prefix+"releases/", func(obj s3Object) error {
+		name := strings.TrimPrefix(obj.Key, s.prefix+"releases/")
+		if strings.HasSuffix(name, ".manifest.json") {
+			return nil
+		}
+		if id, ok := strings.CutSuffix(name, ".json"); ok {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s *S3) Meta(ctx context.Context, id string) ([]byte, error) {
+	data, err := s.client.getBytes(ctx, s.metaKey(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Remove 先删除元数据使版本不再可见, 再删除文件列表, 最后回收未被任何版本引用的对象
+func (s *S3) Remove(ctx context.Context, ids []string) (Stats, error) {
+	var stats Stats
+	for _, id := range ids {
+		if err := s.client.remove(ctx, s.metaKey(id)); err != nil {
+			return stats, err
+		}
+		if err := s.client.remove(ctx, s.manifestKey(id)); err != nil {
+			return stats, err
+		}
+	}
+	if err := s.gc(ctx, &stats); err != nil {
+		stats.Warnings = append(stats.Warnings, "failed to collect unreferenced objects: "+err.Error())
+	}
+	return stats, nil
+}
+
+// gc 删除不被任何文件列表引用的对象
+// 只删除早于 s3GCGrace 的对象, 以免删除其他实例正在发布, 尚未写入文件列表的内容
+func (s *S3) gc(ctx context.Context, stats *Stats) error {
+	referenced := make(map[string]bool)
+	var manifests []string
+	err := s.client.list(ctx, s.prefix+"releases/", func(obj s3Object) error {
+		if strings.HasSuffix(obj.Key, ".manifest.json") {
+			manifests = append(manifests, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range manifests {
+		files, err := s.manifest(ctx, key)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			referenced[file.SHA256] = true
+		}
+	}
+
+	deadline := time.Now().Add(-s3GCGrace)
+	var unreferenced []s3Object
+	err = s.client.list(ctx, s.prefix+"objects/", func(obj s3Object) error {
+		sum := strings.TrimPrefix(obj.Key, s.prefix+"objects/")
+		if !referenced[sum] && obj.LastModified.Before(deadline) {
+			unreferenced = append(unreferenced, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, obj := range unreferenced {
+		if err := s.client.remove(ctx, obj.Key); err != nil {
+			return err
+		}
+		stats.Objects++
+		stats.Freed += obj.Size
+	}
+	return nil
+}
+
+func (s *S3) manifest(ctx context.Context, key string) ([]File, error) {
+	data, err := s.client.getBytes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("invalid release manifest %s: %w", key, err)
+	}
+	return files, nil
+}
+
+func (s *S3) Files(ctx context.Context, id string) ([]File, error) {
+	files, err := s.manifest(ctx, s.manifestKey(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return files, err
+}
+
+func (s *S3) Open(ctx context.Context, id, name string) (io.ReadCloser, error) {
+	files, err := s.Files(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, file := range files {
+		if file.Path != name {
+			continue
+		}
+		if file.Link != "" {
+			return nil, fmt.Errorf("%s is not a regular file", name)
+		}
+		return s.client.get(ctx, s.objectKey(file.SHA256), 0)
+	}
+	return nil, fs.ErrNotExist
+}
+
+// FileSystem 按线上版本的文件列表从存储桶读取文件
+func (s *S3) FileSystem() http.FileSystem {
+	return s.fs
+}
+
+// scan 列出目录中的文件与软链接并计算内容的 sha256
+func scan(root string) ([]File, error) {
+	var files []File
+	err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		entry := File{Path: filepath.ToSlash(rel), Mode: info.Mode(), ModTime: info.ModTime().UTC()}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			entry.Size = info.Size()
+			if entry.SHA256, err = hashFile(file); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		files = append(files, entry)
+		return nil
+	})
+	return files, err
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parallel 以 s3Workers 个 goroutine 处理 items, 返回第一个错误, 出错后不再开始新的任务
+func parallel(ctx context.Context, items []File, fn func(File) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	queue := make(chan File)
+	for range s3Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				if err := fn(item); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for _, item := range items {
+		select {
+		case queue <- item:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
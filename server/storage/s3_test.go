@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"nemu-server/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testBucket    = "site"
+)
+
+// awsEscape 按 SigV4 编码一个路径段或查询参数, 与 uriEncode 相互独立地实现
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func awsEscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = awsEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// fakeS3 内存中的 S3 兼容服务, 只支持 path-style 地址与 nemu 用到的操作
+// 每个请求都按 SigV4 校验签名, 上传时校验 x-amz-content-sha256
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	pages   int // 列表请求的次数, 用于确认翻页
+}
+
+type fakeObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: make(map[string]*fakeObject)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// age 将全部对象的修改时间提前 d
+func (f *fakeS3) age(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, obj := range f.objects {
+		obj.modified = obj.modified.Add(-d)
+	}
+}
+
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: code})
+}
+
+// verify 按收到的请求重新计算签名
+func (f *fakeS3) verify(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const algorithm = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(auth, algorithm) {
+		return "missing authorization"
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, algorithm), ", ") {
+		k, v, _ := strings.Cut(part, "=")
+		fields[k] = v
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testAccessKey {
+		return "unknown access key"
+	}
+	scope := credential[1]
+	date, region, _ := strings.Cut(scope, "/")
+	region, _, _ = strings.Cut(region, "/")
+
+	// S3 以解码后的路径重新编码, 客户端发送的路径必须已经是规范形式
+	rawPath, _, _ := strings.Cut(r.RequestURI, "?")
+	canonicalPath := awsEscapePath(r.URL.Path)
+	if rawPath != canonicalPath {
+		return "path " + rawPath + " is not canonical, want " + canonicalPath
+	}
+	query := r.URL.Query()
+	var params []string
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(params)
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	canonical := strings.Join([]string{r.Method, canonicalPath, strings.Join(params, "&"), headers.String(), fields["SignedHeaders"], payloadHash}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + r.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(fields["Signature"])) {
+		return "signature does not match"
+	}
+	return ""
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if reason := f.verify(r); reason != "" {
+		f.t.Logf("rejected %s %s: %s", r.Method, r.RequestURI, reason)
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket+"/")
+	if !ok {
+		f.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.fail(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+			f.fail(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+			return
+		}
+		f.objects[key] = &fakeObject{data: data, modified: time.Now().UTC()}
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		data := obj.data
+		if rng := r.Header.Get("Range"); rng != "" {
+			offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if err != nil || offset > len(data) {
+				f.fail(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			data = data[offset:]
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// list 实现 ListObjectsV2, 每页两个对象以覆盖翻页
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	f.pages++
+	prefix, token := query.Get("prefix"), query.Get("continuation-token")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string    `xml:"Key"`
+		Size         int       `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	for i, key := range keys {
+		if i == 2 {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[i-1]
+			break
+		}
+		result.Contents = append(result.Contents, content{Key: key, Size: len(f.objects[key].data), LastModified: f.objects[key].modified})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T, endpoint, prefix string) *S3 {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Storage.S3 = config.S3Config{
+		Endpoint:  endpoint,
+		Bucket:    testBucket,
+		Prefix:    prefix,
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		PathStyle: true,
+	}
+	s, err := NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// writeSite 在 dir 中写入 files (路径 -> 内容), 内容以 -> 开头的为软链接
+func writeSite(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if link, ok := strings.CutPrefix(content, "->"); ok {
+			err = os.Symlink(link, target)
+		} else {
+			err = os.WriteFile(target, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestS3SignKnownAnswer(t *testing.T) {
+	endpoint, _ := url.Parse("http://127.0.0.1:9000")
+	c := &s3Client{endpoint: endpoint, region: "us-east-1", bucket: testBucket, accessKey: testAccessKey, secretKey: testSecretKey, pathStyle: true}
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// 预期值由独立的实现按 AWS 文档计算
+	tests := []struct {
+		name      string
+		key       string
+		query     url.Values
+		path      string
+		rawQuery  string
+		signature string
+	}{
+		{
+			name:      "object key with space, non-ASCII and plus",
+			key:       "my site/ü+.html",
+			path:      "/site/my%20site/%C3%BC%2B.html",
+			signature: "2a3d3a433daa838ffe42039b494a3fa766feeaf58e0a263554cc8c6823a9a301",
+		},
+		{
+			name:      "list with encoded prefix",
+			query:     url.Values{"prefix": {"my site/ü+"}, "list-type": {"2"}},
+			path:      "/site/",
+			rawQuery:  "list-type=2&prefix=my%20site%2F%C3%BC%2B",
+			signature: "cbdd865c1d2d8be3fd5f945d9259901a58e3c634bf19840a2dd641be5cd21759",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := c.objectURL(tt.key, tt.query)
+			if u.EscapedPath() != tt.path || u.RawQuery != tt.rawQuery {
+				t.Fatalf("url = %s %s, want %s %s", u.EscapedPath(), u.RawQuery, tt.path, tt.rawQuery)
+			}
+			req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.sign(req, emptySHA256, now)
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20250102/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Fatalf("Authorization = %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestS3WrongSecretIsRejected(t *testing.T) {
+	_, srv := newFakeS3(t)
+	s := newTestS3(t, srv.URL, "")
+	s.client.secretKey = "wrong"
+	var s3err *s3Error
+	if _, err := s.Current(context.Background()); !errors.As(err, &s3err) || s3err.StatusCode != http.StatusForbidden || s3err.Code != "SignatureDoesNotMatch" {
+		t.Fatalf("Current error = %v, want SignatureDoesNotMatch", err)
+	}
+}
+
+func TestS3PublishCheckoutAndServe(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	// 前缀中的空格, 非 ASCII 字符与 + 需要按 SigV4 编码
+	s := newTestS3(t, srv.URL, "/my site/ü+/")
+	ctx := context.Background()
+
+	if _, err := s.Current(ctx); !errors.Is(err, ErrNotActive) {
+		t.Fatalf("Current before activation = %v, want ErrNotActive", err)
+	}
+	if _, err := s.Meta(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Meta of missing release = %v, want ErrNotFound", err)
+	}
+
+	files := map[string]string{
+		"index.html":          "home",
+		"copy.html":           "home",
+		"docs/a b+c.html":     "docs",
+		"docs/中文.html":        "中文",
+		"latest":              "->docs",
+		"assets/style.css":    "body{}",
+		"assets/app.js":       "console.log(1)",
+		"assets/img/logo.svg": "<svg/>",
+	}
+	id := "20250101-000000-aaaaaa"
+	stats, err := s.Publish(ctx, id, writeSite(t, files), []byte(`{"id":"`+id+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 7 || stats.Reused != 1 || stats.Saved != 4 {
+		t.Fatalf("stats = %+v, want 7 files with copy.html reused", stats)
+	}
+	if keys := fake.keys("my site/ü+/objects/"); len(keys) != 6 {
+		t.Fatalf("objects = %v, want 6 unique contents", keys)
+	}
+
+	if err := s.Activate(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := s.Current(ctx); err != nil || current != id {
+		t.Fatalf("Current = %q, %v", current, err)
+	}
+	if ids, err := s.List(ctx); err != nil || len(ids) != 1 || ids[0] != id {
+		t.Fatalf("List = %v, %v", ids, err)
+	}
+
+	listed, err := s.Files(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(files) {
+		t.Fatalf("Files returned %d entries, want %d", len(listed), len(files))
+	}
+
+	dir := t.TempDir()
+	if err := s.Checkout(ctx, id, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if link, ok := strings.CutPrefix(content, "->"); ok {
+			if got, err := os.Readlink(target); err != nil || got != link {
+				t.Errorf("checkout %s -> %q, %v, want %s", name, got, err, link)
+			}
+			continue
+		}
+		if got, err := os.ReadFile(target); err != nil || string(got) != content {
+			t.Errorf("checkout %s = %q, %v, want %q", name, got, err, content)
+		}
+	}
+
+	body, err := s.Open(ctx, id, "docs/a b+c.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "docs" {
+		t.Fatalf("Open = %q", data)
+	}
+
+	// 站点经由软链接 latest 读取 docs 下的文件, 并支持从偏移开始读取
+	f, err := s.FileSystem().Open("/latest/中文.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(f); err != nil || string(data) != "文" {
+		t.Fatalf("FileSystem read = %q, %v", data, err)
+	}
+}
+
+func TestS3GCKeepsSharedAndRecentObjects(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3(t, srv.URL, "site")
+	ctx := context.Background()
+
+	first, second := "20250101-000000-aaaaaa", "20250102-000000-bbbbbb"
+	if _, err := s.Publish(ctx, first, writeSite(t, map[string]string{"index.html": "v1", "shared.css": "shared", "old.js": "old"}), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Publish(ctx, second, writeSite(t, map[string]string{"index.html": "v2", "shared.css": "shared"}), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	// 两个版本的对象都早于宽限期; 之后另一个实例正在发布的对象尚未写入文件列表
+	fake.age(2 * s3GCGrace)
+	pending := sha256.Sum256([]byte("pending"))
+	if err := s.client.putBytes(ctx, s.objectKey(hex.EncodeToString(pending[:])), []byte("pending"), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.pages = 0
+	stats, err := s.Remove(ctx, []string{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.pages < 3 {
+		t.Fatalf("gc listed %d pages, want the object listing to be paginated", fake.pages)
+	}
+	if len(stats.Warnings) > 0 {
+		t.Fatalf("warnings: %v", stats.Warnings)
+	}
+	if stats.Objects != 2 || stats.Freed != int64(len("v1")+len("old")) {
+		t.Fatalf("stats = %+v, want v1 and old.js collected", stats)
+	}
+	if _, err := s.Meta(ctx, first); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Meta of removed release = %v", err)
+	}
+	if _, err := s.Files(ctx, first); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Files of removed release = %v", err)
+	}
+
+	want := map[string]bool{}
+	for _, content := range []string{"v2", "shared", "pending"} {
+		sum := sha256.Sum256([]byte(content))
+		want[s.objectKey(hex.EncodeToString(sum[:]))] = true
+	}
+	keys := fake.keys("site/objects/")
+	if len(keys) != len(want) {
+		t.Fatalf("objects after gc = %v", keys)
+	}
+	for _, key := range keys {
+		if !want[key] {
+			t.Fatalf("unexpected object %s after gc", key)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WJQSERVER-STUDIO/httpc"
+)
+
+// 空请求体的 sha256
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+const s3UserAgent = "NemuServer/1.0"
+
+// s3Client 最小的 S3 兼容客户端, 只实现 nemu 需要的对象操作, 以 AWS Signature Version 4 签名
+// 兼容 AWS S3, MinIO, Cloudflare R2 等实现
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool // 使用 <endpoint>/<bucket>/<key>, 否则使用 <bucket>.<endpoint>/<key>
+	client    *httpc.Client
+}
+
+// s3Error S3 返回的错误
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// Is 让 errors.Is(err, fs.ErrNotExist) 识别不存在的对象
+func (e *s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// objectURL 返回对象的地址, key 为空时返回 bucket 的地址
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if c.pathStyle {
+		p += "/" + c.bucket
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	p += "/" + key
+	u.Path = p
+	u.RawPath = uriEncode(p, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do 发送一个签名的请求; payloadHash 为请求体的 sha256, 状态码不是 2xx 时返回 *s3Error
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	if body == nil {
+		body = http.NoBody
+		payloadHash = emptySHA256
+	}
+	rb := c.client.NewRequestBuilder(method, c.objectURL(key, query).String())
+	rb.WithContext(ctx)
+	rb.SetBody(body)
+	rb.NoDefaultHeaders()
+	rb.SetHeader("User-Agent", s3UserAgent)
+	for k, values := range header {
+		for _, v := range values {
+			rb.AddHeader(k, v)
+		}
+	}
+	req, err := rb.Build()
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	c.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3err := &s3Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, s3err)
+	return nil, s3err
+}
+
+// sign 按 Signature Version 4 为请求添加 Authorization 头部
+// 签名的头部为 host, x-amz-content-sha256 与 x-amz-date
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.URL.Host
+	if req.Host != "" {
+		host = req.Host
+	}
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// get 从 offset 开始读取对象
+func (c *s3Client) get(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {"bytes=" + strconv.FormatInt(offset, 10) + "-"}}
+	}
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, 0, "", header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// getBytes 读取整个对象, 用于元数据等小对象
+func (c *s3Client) getBytes(ctx context.Context, key string) ([]byte, error) {
+	body, err := c.get(ctx, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// put 上传对象, sum 为内容的 sha256
+func (c *s3Client) put(ctx context.Context, key string, body io.Reader, size int64, sum, contentType string) error {
+	header := http.Header{"Content-Type": {contentType}}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, body, size, sum, header)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (c *s3Client) putBytes(ctx context.Context, key string, data []byte, contentType string) error {
+	return c.put(ctx, key, bytes.NewReader(data), int64(len(data)), sha256Hex(data), contentType)
+}
+
+// exists 对象是否存在
+func (c *s3Client) exists(ctx context.Context, key string) (bool, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, 0, "", nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// remove 删除对象, 对象不存在时不视为错误
+func (c *s3Client) remove(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, 0, "", nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3Object ListObjectsV2 返回的对象
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// list 列出 prefix 下的全部对象, 自动翻页
+func (c *s3Client) list(ctx context.Context, prefix string, fn func(obj s3Object) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, 0, "", nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: invalid list response: %w", err)
+		}
+		for _, obj := range result.Contents {
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// uriEncode 按 SigV4 的规则编码, 只保留 A-Z a-z 0-9 - _ . ~, encodeSlash 为 false 时保留 /
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery 按键排序并编码查询参数, 同时用作请求的查询字符串
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 解析软链接的最大层数
+const maxLinkDepth = 8
+
+// s3FS 以线上版本的文件列表提供站点, 文件内容在读取时才从存储桶下载
+// 文件列表缓存 ttl, 各实例在这段时间内切换到其他实例激活的版本
+type s3FS struct {
+	s   *S3
+	ttl time.Duration
+
+	mu      sync.Mutex
+	id      string
+	checked time.Time
+	tree    *s3Tree
+}
+
+// s3Tree 一个版本的文件与目录索引
+type s3Tree struct {
+	files map[string]*File                  // 以 / 开头的路径
+	dirs  map[string]map[string]os.FileInfo // 目录路径 -> 子项
+}
+
+func (f *s3FS) invalidate() {
+	f.mu.Lock()
+	f.checked = time.Time{}
+	f.mu.Unlock()
+}
+
+// load 返回线上版本的索引; 刷新失败时继续使用已缓存的版本
+func (f *s3FS) load() (*s3Tree, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tree != nil && time.Since(f.checked) < f.ttl {
+		return f.tree, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	id, err := f.s.Current(ctx)
+	if err == nil && (id != f.id || f.tree == nil) {
+		var files []File
+		if files, err = f.s.Files(ctx, id); err == nil {
+			f.id, f.tree = id, newTree(files)
+		}
+	}
+	if errors.Is(err, ErrNotActive) {
+		f.id, f.tree = "", newTree(nil)
+		err = nil
+	}
+	if err != nil && f.tree == nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+	return f.tree, nil
+}
+
+func newTree(files []File) *s3Tree {
+	t := &s3Tree{files: make(map[string]*File), dirs: map[string]map[string]os.FileInfo{"/": {}}}
+	for i := range files {
+		file := &files[i]
+		name := "/" + file.Path
+		t.files[name] = file
+		// 逐级登记父目录
+		child := os.FileInfo(&s3Info{name: path.Base(name), file: file})
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			entries, ok := t.dirs[dir]
+			if !ok {
+				entries = make(map[string]os.FileInfo)
+				t.dirs[dir] = entries
+			}
+			entries[child.Name()] = child
+			if ok || dir == "/" {
+				break
+			}
+			child = &s3Info{name: path.Base(dir), dir: true, mtime: file.ModTime}
+		}
+	}
+	return t
+}
+
+// resolve 解析软链接, 包括路径中途经的软链接, 只允许指向版本内的相对路径
+func (t *s3Tree) resolve(name string) (*File, bool, error) {
+	for range maxLinkDepth {
+		if target, ok := t.throughLink(name); ok {
+			if target == "" {
+				return nil, false, fs.ErrNotExist
+			}
+			name = target
+			continue
+		}
+		if _, ok := t.dirs[name]; ok {
+			return nil, true, nil
+		}
+		file, ok := t.files[name]
+		if !ok {
+			return nil, false, fs.ErrNotExist
+		}
+		if file.Link == "" {
+			return file, false, nil
+		}
+		if path.IsAbs(file.Link) {
+			return nil, false, fs.ErrNotExist
+		}
+		name = path.Join(path.Dir(name), file.Link)
+	}
+	return nil, false, fs.ErrNotExist
+}
+
+// throughLink 找到 name 的上层路径中的第一个软链接, 返回替换为链接目标后的路径
+// 上层路径中没有软链接时 ok 为 false; 链接目标不可用或上层路径是普通文件时返回空路径
+func (t *s3Tree) throughLink(name string) (target string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	parent := "/"
+	for i, part := range parts[:len(parts)-1] {
+		parent = path.Join(parent, part)
+		file, exists := t.files[parent]
+		if !exists {
+			continue
+		}
+		if file.Link == "" || path.IsAbs(file.Link) {
+			return "", true
+		}
+		return path.Join(path.Dir(parent), file.Link, strings.Join(parts[i+1:], "/")), true
+	}
+	return "", false
+}
+
+func (f *s3FS) Open(name string) (http.File, error) {
+	tree, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	name = path.Clean("/" + name)
+	file, isDir, err := tree.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return &s3Dir{info: &s3Info{name: path.Base(name), dir: true}, entries: tree.dirs[name]}, nil
+	}
+	return &s3File{s: f.s, file: file, info: &s3Info{name: path.Base(name), file: file}}, nil
+}
+
+// s3Info 实现 os.FileInfo
+type s3Info struct {
+	name  string
+	file  *File // 目录为 nil
+	dir   bool
+	mtime time.Time
+}
+
+func (i *s3Info) Name() string { return i.name }
+func (i *s3Info) IsDir() bool  { return i.dir }
+func (i *s3Info) Sys() any     { return nil }
+
+func (i *s3Info) Size() int64 {
+	if i.file == nil {
+		return 0
+	}
+	return i.file.Size
+}
+
+func (i *s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return i.file.Mode
+}
+
+func (i *s3Info) ModTime() time.Time {
+	if i.file == nil {
+		return i.mtime
+	}
+	return i.file.ModTime
+}
+
+// s3File 按需以 Range 请求读取对象, Seek 只记录位置, 下一次 Read 时重新请求
+type s3File struct {
+	s      *S3
+	file   *File
+	info   *s3Info
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := f.s.client.get(context.Background(), f.s.objectKey(f.file.SHA256), f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.file.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != f.offset {
+		f.Close()
+		f.offset = offset
+	}
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+func (f *s3File) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// s3Dir 只用于列出目录, 读取目录时返回错误
+type s3Dir struct {
+	info    *s3Info
+	entries map[string]os.FileInfo
+	list    []os.FileInfo
+	read    bool
+}
+
+func (d *s3Dir) Read(p []byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *s3Dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *s3Dir) Close() error { return nil }
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.read {
+		for _, info := range d.entries {
+			d.list = append(d.list, info)
+		}
+		sort.Slice(d.list, func(i, j int) bool { return strings.Compare(d.list[i].Name(), d.list[j].Name()) < 0 })
+		d.read = true
+	}
+	if count <= 0 {
+		list := d.list
+		d.list = nil
+		return list, nil
+	}
+	if len(d.list) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.list))
+	list := d.list[:n]
+	d.list = d.list[n:]
+	return list, nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"nemu-server/blob"
+	"nemu-server/config"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("release not found")
+	ErrNotActive = errors.New("no active release")
+)
+
+// 存储类型, 即 storage.type
+const (
+	TypeLocal = "local"
+	TypeS3    = "s3"
+)
+
+// Storage 保存已部署的版本, 并提供线上版本的文件
+//
+// 版本总是先在本地目录中生成 (解压, 执行钩子), 再由 Publish 保存, Activate 使之成为线上版本.
+// 本地存储中这个目录就是版本本身; S3 存储将内容上传到 bucket 后, 本地目录可以删除,
+// 任何读取同一 bucket 的服务端都能提供线上版本, 因此可以在负载均衡之后部署多个无状态的实例
+type Storage interface {
+	// Dir 返回版本在本地的目录; 版本不保存在本地时返回空字符串
+	Dir(id string) string
+	// Checkout 将版本 id 的内容写入空目录 dir, 作为增量部署的基准
+	Checkout(ctx context.Context, id, dir string) error
+	// Publish 保存本地目录 dir 中的版本 id 与元数据 meta (JSON)
+	Publish(ctx context.Context, id, dir string, meta []byte) (Stats, error)
+	// Activate 原子地将版本 id 设为线上版本
+	Activate(ctx context.Context, id string) error
+	// Current 返回线上版本 ID, 没有线上版本时返回 ErrNotActive
+	Current(ctx context.Context) (string, error)
+	// List 返回全部版本的 ID, 顺序不定
+	List(ctx context.Context) ([]string, error)
+	// Meta 返回版本的元数据, 版本不存在时返回 ErrNotFound
+	Meta(ctx context.Context, id string) ([]byte, error)
+	// Remove 删除版本, 并回收不再被任何版本引用的内容
+	Remove(ctx context.Context, ids []string) (Stats, error)
+	// Files 返回版本中的文件与软链接 (不含目录), 本地存储不计算 SHA256
+	Files(ctx context.Context, id string) ([]File, error)
+	// Open 打开版本中的一个普通文件
+	Open(ctx context.Context, id, name string) (io.ReadCloser, error)
+	// FileSystem 返回线上版本的文件系统, 用于提供站点
+	FileSystem() http.FileSystem
+}
+
+// File 版本中的一个文件
+type File struct {
+	Path    string      `json:"path"` // 以 / 分隔的相对路径
+	Size    int64       `json:"size"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Link    string      `json:"link,omitempty"` // 软链接的目标
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+}
+
+// Stats 发布或删除版本的结果
+type Stats struct {
+	Files   int   `json:"files"`   // 发布时检查的文件数量
+	Reused  int   `json:"reused"`  // 与已有版本内容相同, 无需再次保存的文件数量
+	Saved   int64 `json:"saved"`   // 因此节省的字节数
+	Objects int   `json:"objects"` // 删除版本后回收的对象数量
+	Freed   int64 `json:"freed"`   // 删除版本后回收的字节数
+
+	Warnings []string `json:"-"` // 不影响结果的错误, 例如去重或回收失败
+}
+
+// New 按 storage.type 创建存储
+func New(cfg *config.Config) (Storage, error) {
+	switch cfg.Storage.Type {
+	case "", TypeLocal:
+		if cfg.Release.Dedupe && !blob.Supported {
+			return nil, blob.ErrUnsupported
+		}
+		return NewLocal(cfg), nil
+	case TypeS3:
+		return NewS3(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported storage type: %s (local, s3)", cfg.Storage.Type)
+	}
+}
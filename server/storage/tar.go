@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"nemu-server/tarball"
+	"sort"
+)
+
+// WriteTar 将版本 id 中的文件按路径顺序写为 tar (不压缩), 目录由解压方按需创建
+// files 为 st.Files 的结果, 会被原地排序; 条目格式与客户端打包的相同
+func WriteTar(ctx context.Context, st Storage, id string, files []File, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry := tarball.Entry{Path: file.Path, Mode: file.Mode, ModTime: file.ModTime, Size: file.Size, Link: file.Link}
+		err := tarball.Write(tw, entry, func() (io.ReadCloser, error) {
+			return st.Open(ctx, id, file.Path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
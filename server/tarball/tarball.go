@@ -0,0 +1,67 @@
+// Package tarball 写出部署归档中的条目, 客户端打包与服务端导出, 复制共用
+//
+// 条目只记录路径, 类型, 权限位与修改时间, 不记录属主; 同一目录无论由哪一方打包, 得到的归档条目都相同
+package tarball
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Entry 归档中的一个条目
+type Entry struct {
+	Path    string      // 以 '/' 分隔的相对路径
+	Mode    fs.FileMode // 条目类型与权限
+	ModTime time.Time
+	Size    int64  // 普通文件的字节数
+	Link    string // 软链接的目标, 不为空时条目为软链接
+}
+
+// Header 返回 e 的 tar 头部, 只支持普通文件, 目录与软链接
+func Header(e Entry) (*tar.Header, error) {
+	header := &tar.Header{
+		Name:    e.Path,
+		Mode:    int64(e.Mode.Perm()),
+		ModTime: e.ModTime,
+	}
+	switch {
+	case e.Link != "":
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = e.Link
+	case e.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+	case e.Mode.IsRegular():
+		header.Typeflag = tar.TypeReg
+		header.Size = e.Size
+	default:
+		return nil, fmt.Errorf("%s: unsupported file type %s", e.Path, e.Mode.Type())
+	}
+	return header, nil
+}
+
+// Write 写出 e 的头部, 非空的普通文件由 open 打开后写出内容
+// 写入 tw 的错误原样包装, 调用方可以用 errors.Is 判断下游是否已关闭
+func Write(tw *tar.Writer, e Entry, open func() (io.ReadCloser, error)) error {
+	header, err := Header(e)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", e.Path, err)
+	}
+	if header.Typeflag != tar.TypeReg || header.Size == 0 {
+		return nil
+	}
+	f, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", e.Path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(tw, f); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", e.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package tarball
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	mtime := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Path: "docs", Mode: fs.ModeDir | 0755, ModTime: mtime, Size: 4096},
+		{Path: "docs/index.html", Mode: 0644, ModTime: mtime, Size: 5},
+		{Path: "docs/empty.html", Mode: 0600, ModTime: mtime},
+		{Path: "latest", Mode: fs.ModeSymlink | 0777, ModTime: mtime, Link: "docs"},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		err := Write(tw, e, func() (io.ReadCloser, error) {
+			if e.Size == 0 {
+				t.Fatalf("opened %s", e.Path)
+			}
+			return io.NopCloser(strings.NewReader("hello")), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typeflag byte
+		mode     int64
+		size     int64
+		link     string
+	}{
+		{tar.TypeDir, 0755, 0, ""},
+		{tar.TypeReg, 0644, 5, ""},
+		{tar.TypeReg, 0600, 0, ""},
+		{tar.TypeSymlink, 0777, 0, "docs"},
+	}
+	tr := tar.NewReader(&buf)
+	for i, w := range want {
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != entries[i].Path || h.Typeflag != w.typeflag || h.Mode != w.mode || h.Size != w.size || h.Linkname != w.link || !h.ModTime.Equal(mtime) {
+			t.Errorf("entry %d = %+v", i, h)
+		}
+		if h.Uname != "" || h.Uid != 0 {
+			t.Errorf("entry %d records owner %s/%d", i, h.Uname, h.Uid)
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tw := tar.NewWriter(io.Discard)
+	if err := Write(tw, Entry{Path: "fifo", Mode: fs.ModeNamedPipe | 0644}, nil); err == nil {
+		t.Fatal("named pipe was written")
+	}
+	err := Write(tw, Entry{Path: "gone.html", Mode: 0644, Size: 1}, func() (io.ReadCloser, error) {
+		return nil, os.ErrNotExist
+	})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Write error = %v, want ErrNotExist", err)
+	}
+}